@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"strings"
+)
+
+// readHeader returns the header of an input file, reading
+// no further, with its delimiter detected as process would.
+func readHeader(path string) ([]string, error) {
+	file, err := openInput(path)
+	if err != nil {
+		return nil, fmt.Errorf("%v - unable to open file %v for reading", err, path)
+	}
+	defer file.Close()
+
+	buffered := bufio.NewReader(file)
+	skipBOM(buffered)
+	comma := delimiter
+	if comma == 0 {
+		comma = sniffDelimiter(buffered)
+	}
+	r := csv.NewReader(buffered)
+	r.Comma = comma
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%v - unable to read the header of %v", err, path)
+	}
+	return header, nil
+}
+
+// missingTargets returns the targets without a found column in the
+// headers of the already augmented files, for -append. The files must
+// all be missing the same targets, since they're searched for each.
+func missingTargets(all []target, filenames []string) ([]target, error) {
+	var missing []target
+	first := ""
+	for _, filename := range filenames {
+		header, err := readHeader(filename)
+		if err != nil {
+			return nil, err
+		}
+		present := map[string]bool{}
+		for _, label := range header {
+			present[strings.ToUpper(strings.TrimSpace(label))] = true
+		}
+
+		fileMissing := []target{}
+		for _, t := range all {
+			if !present[strings.ToUpper(t.column("found"))] {
+				fileMissing = append(fileMissing, t)
+			}
+		}
+		if missing == nil {
+			missing, first = fileMissing, filename
+			continue
+		}
+		if targetNames(missing) != targetNames(fileMissing) {
+			return nil, fmt.Errorf("%v is missing the targets %v but %v is missing %v, append to them separately", first, targetNames(missing), filename, targetNames(fileMissing))
+		}
+	}
+	if len(missing) == 0 {
+		return nil, fmt.Errorf("every target already has columns in %v, there's nothing to append", first)
+	}
+	return missing, nil
+}
+
+// targetNames returns the targets' names as a comma separated list.
+func targetNames(targets []target) string {
+	names := []string{}
+	for _, t := range targets {
+		names = append(names, t.Name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchmark records how long each query took by target, and how many
+// searches were answered without one, for -bench. A nil *benchmark
+// records nothing.
+type benchmark struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	searches  int
+	cached    int
+}
+
+// bench is the -bench recorder, nil unless it's set.
+var bench *benchmark
+
+func newBenchmark() *benchmark {
+	return &benchmark{latencies: map[string][]time.Duration{}}
+}
+
+// observe records one query of the target which took elapsed.
+func (b *benchmark) observe(target string, elapsed time.Duration) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.latencies[target] = append(b.latencies[target], elapsed)
+}
+
+// search records a search, and whether the cache or another row's
+// search in progress answered it.
+func (b *benchmark) search(cached bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.searches++
+	if cached {
+		b.cached++
+	}
+}
+
+// write prints the throughput of rows rows processed in elapsed, and
+// each target's median and 95th percentile query latency.
+func (b *benchmark) write(w io.Writer, rows int, elapsed time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var s strings.Builder
+	seconds := elapsed.Seconds()
+	queries := 0
+	for _, latencies := range b.latencies {
+		queries += len(latencies)
+	}
+	fmt.Fprintf(&s, "rows: %v in %v, %.1f rows/s\n", rows, elapsed.Round(time.Millisecond), perSecond(rows, seconds))
+	fmt.Fprintf(&s, "queries: %v, %.1f queries/s\n", queries, perSecond(queries, seconds))
+	fmt.Fprintf(&s, "cache hit rate: %.1f%% (%v of %v searches)\n", percentOf(b.cached, b.searches), b.cached, b.searches)
+	for _, t := range targets {
+		latencies := b.latencies[t.Name]
+		if len(latencies) == 0 {
+			continue
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		fmt.Fprintf(&s, "query latency of %v: p50 %v, p95 %v (%v queries)\n", t.Name, percentile(latencies, 50).Round(time.Millisecond), percentile(latencies, 95).Round(time.Millisecond), len(latencies))
+	}
+	_, err := io.WriteString(w, s.String())
+	return err
+}
+
+// perSecond returns n over seconds, or 0 if no time passed.
+func perSecond(n int, seconds float64) float64 {
+	if seconds == 0 {
+		return 0
+	}
+	return float64(n) / seconds
+}
+
+// percentile returns the nearest rank p percentile of sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// observeQuery records one query of the target for -metrics-addr
+// and -bench.
+func observeQuery(target string, elapsed time.Duration, result searchResult, err error) {
+	stats.observe(target, elapsed, result, err)
+	bench.observe(target, elapsed)
+}
+
+// writesOutput reports whether the augmented files are written, which
+// -dry-run, -bench and -seed-cache skip.
+func writesOutput() bool {
+	return !*dryRun && !*benchFlag && !*seedCache
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cacheEntry is one remembered search, stored as a line of JSON.
+type cacheEntry struct {
+	Target  string    `json:"target"`
+	ISBN    string    `json:"isbn"`
+	Found   bool      `json:"found"`
+	Hits    int       `json:"hits"`
+	Matched string    `json:"matched,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+// resultCache remembers search results between runs, keyed by target
+// name and normalized ISBN, or access point and term for other searches.
+// Each result is appended to the file as it's put, so a run which is
+// killed still leaves the searches it made for the next, and save
+// rewrites the file without the entries since replaced.
+type resultCache struct {
+	path string
+	ttl  time.Duration
+	// Results checked before since are stale, whatever the ttl.
+	since time.Time
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	// The file appended to, the lines not yet written to
+	// it, and when they last were.
+	journal  *os.File
+	pending  []byte
+	buffered int
+	lastSync time.Time
+}
+
+// Appended entries are written and synced to disk in batches, once
+// there are cacheSyncEntries of them or cacheSyncInterval has passed.
+const (
+	cacheSyncEntries  = 100
+	cacheSyncInterval = time.Second
+)
+
+// maxLineLength is the longest line of a cache file or ISBN list read,
+// far past bufio.Scanner's default of 64KB.
+const maxLineLength = 64 << 20
+
+func cacheKey(target string, isbn string) string {
+	return target + "\t" + isbn
+}
+
+// parseSince parses a -cache-since date, at midnight local time, or time.
+func parseSince(value string) (time.Time, error) {
+	if since, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return since, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// loadCache reads the cache file at path, which needn't exist yet,
+// and opens it for appending the results put.
+func loadCache(path string, ttl time.Duration, since time.Time) (*resultCache, error) {
+	c := &resultCache{path: path, ttl: ttl, since: since, lastSync: time.Now()}
+
+	entries, partial, err := readCacheFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c.entries = entries
+	if partial {
+		// Start appending on a new line after the one cut short.
+		c.pending = []byte("\n")
+	}
+	c.journal, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("%v - unable to open cache file %v for writing", err, path)
+	}
+	return c, nil
+}
+
+// readCacheFile returns the entries in the cache file, if it exists,
+// the last of any repeated, and whether it ends with a line cut short,
+// as when a run is killed while appending to it, which is ignored.
+func readCacheFile(path string) (map[string]cacheEntry, bool, error) {
+	entries := map[string]cacheEntry{}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return entries, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("%v - unable to open cache file %v", err, path)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxLineLength)
+	var bad error
+	for scanner.Scan() {
+		if bad != nil {
+			return nil, false, bad
+		}
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		entry := cacheEntry{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			bad = fmt.Errorf("%v - unable to parse cache file %v", err, path)
+			continue
+		}
+		entries[cacheKey(entry.Target, entry.ISBN)] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, fmt.Errorf("%v - unable to read cache file %v", err, path)
+	}
+	if bad != nil {
+		slog.Warn("ignoring the cache file's last line, which was cut short", "path", path)
+	}
+	return entries, bad != nil, nil
+}
+
+// newMemoryCache returns a cache which isn't saved, so an ISBN repeated
+// across rows or files is only searched for once per run.
+func newMemoryCache() *resultCache {
+	return &resultCache{entries: map[string]cacheEntry{}}
+}
+
+// size returns how many results the cache remembers.
+func (c *resultCache) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// get returns the remembered result, if there is one which isn't stale.
+func (c *resultCache) get(target string, isbn string) (searchResult, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[cacheKey(target, isbn)]
+	c.mu.Unlock()
+	if !ok || (c.ttl > 0 && time.Since(entry.Checked) > c.ttl) || entry.Checked.Before(c.since) {
+		return searchResult{}, false
+	}
+	return searchResult{hits: entry.Hits, matched: entry.Matched, cached: true}, true
+}
+
+// put remembers a result. Results with diagnostics aren't
+// remembered since they point to a problem with the search.
+func (c *resultCache) put(target string, isbn string, result searchResult) {
+	if result.diagnostic != "" {
+		return
+	}
+	entry := cacheEntry{
+		Target:  target,
+		ISBN:    isbn,
+		Found:   result.found(),
+		Hits:    result.hits,
+		Matched: result.matched,
+		Checked: time.Now(),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[cacheKey(target, isbn)] = entry
+	if c.journal == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	c.pending = append(append(c.pending, line...), '\n')
+	c.buffered++
+	if c.buffered >= cacheSyncEntries || time.Since(c.lastSync) >= cacheSyncInterval {
+		c.syncLocked()
+	}
+}
+
+// sync appends the entries put since the last sync to the file.
+func (c *resultCache) sync() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.syncLocked()
+}
+
+// syncLocked is sync, with c.mu held. The lines are written in one
+// call, so they aren't interleaved with another run's appending to
+// the same file. After an error the results are only kept in memory.
+func (c *resultCache) syncLocked() {
+	if c.journal == nil || len(c.pending) == 0 {
+		return
+	}
+	_, err := c.journal.Write(c.pending)
+	if err == nil {
+		err = c.journal.Sync()
+	}
+	if err != nil {
+		slog.Error("unable to append to the cache file, results will be saved at the end of the run", "path", c.path, "err", err)
+		c.journal.Close()
+		c.journal = nil
+	}
+	c.pending, c.buffered, c.lastSync = nil, 0, time.Now()
+}
+
+// save replaces the cache file with the current entries, and those
+// other runs appended to it since it was loaded, if newer.
+func (c *resultCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.syncLocked()
+	if c.journal != nil {
+		c.journal.Close()
+		c.journal = nil
+	}
+	// Nothing is lost if the file can't be read, it's appended to.
+	if others, _, err := readCacheFile(c.path); err == nil {
+		for key, entry := range others {
+			if current, ok := c.entries[key]; !ok || entry.Checked.After(current.Checked) {
+				c.entries[key] = entry
+			}
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("%v - unable to create temporary cache file", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(w)
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := encoder.Encode(c.entries[key]); err != nil {
+			tmp.Close()
+			return fmt.Errorf("%v - unable to write cache file %v", err, c.path)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("%v - unable to write cache file %v", err, c.path)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("%v - unable to close cache file %v", err, c.path)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("%v - unable to replace cache file %v", err, c.path)
+	}
+	return nil
+}
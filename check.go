@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// The ISBN searched for by -check. Whether it's held doesn't matter,
+// only that the target answers.
+const checkISBN = "9780306406157"
+
+// checkResult is how one target answered the -check search.
+type checkResult struct {
+	result  searchResult
+	err     error
+	elapsed time.Duration
+}
+
+// checkTargets searches every target for checkISBN at once, the same
+// way rows are searched, and writes a table with a line per target
+// saying whether it answered, or a JSON array with -format json. It
+// reports whether they all did.
+func checkTargets(ctx context.Context, w io.Writer) bool {
+	checks := make([]checkResult, len(targets))
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			start := time.Now()
+			checks[i].result, checks[i].err = query(ctx, t, isbnAccess, checkISBN)
+			checks[i].elapsed = time.Since(start).Round(time.Millisecond)
+		}(i, t)
+	}
+	wg.Wait()
+
+	reachable := true
+	reports := make([]checkReport, len(targets))
+	for i, t := range targets {
+		check := checks[i]
+		reports[i] = checkReport{
+			Target:     t.Name,
+			Protocol:   t.Protocol,
+			Host:       t.Host,
+			Reachable:  check.err == nil,
+			MS:         check.elapsed.Milliseconds(),
+			Hits:       check.result.hits,
+			Diagnostic: check.result.diagnostic,
+		}
+		if reports[i].Protocol == "" {
+			reports[i].Protocol = "z3950"
+		}
+		if check.err != nil {
+			reachable = false
+			reports[i].Hits = 0
+			reports[i].Error = check.err.Error()
+		}
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(reports)
+		return reachable
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tPROTOCOL\tHOST\tREACHABLE\tMS\tHITS\tDETAIL")
+	for _, r := range reports {
+		detail := r.Error
+		if r.Diagnostic != "" {
+			detail = "diagnostic " + r.Diagnostic
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", r.Target, r.Protocol, r.Host, r.Reachable, r.MS, r.Hits, detail)
+	}
+	tw.Flush()
+	return reachable
+}
+
+// checkReport is a target's line of the -check report, and its
+// object with -format json, for monitoring to alert on.
+type checkReport struct {
+	Target     string `json:"target"`
+	Protocol   string `json:"protocol"`
+	Host       string `json:"host"`
+	Reachable  bool   `json:"reachable"`
+	MS         int64  `json:"ms"`
+	Hits       int    `json:"hits"`
+	Diagnostic string `json:"diagnostic,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// describeTargets writes the targets as they'll be searched, for
+// -config-check, with the config's defaults applied: the query for each
+// access point, the links with their search types filled in, and the
+// limits. Passwords and header values aren't shown.
+func describeTargets(w io.Writer) {
+	for i, t := range targets {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		protocol := t.Protocol
+		if protocol == "" {
+			protocol = "z3950"
+		}
+		fmt.Fprintf(tw, "%v\n", t.Name)
+		fmt.Fprintf(tw, "  protocol\t%v\n", protocol)
+		fmt.Fprintf(tw, "  host\t%v\n", t.Host)
+		if databases := t.databases(); len(databases) > 0 {
+			fmt.Fprintf(tw, "  databases\t%v\n", strings.Join(databases, ", "))
+		}
+		if t.User != "" {
+			fmt.Fprintf(tw, "  user\t%v\n", t.User)
+		}
+		if t.Charset != "" {
+			fmt.Fprintf(tw, "  charset\t%v\n", t.Charset)
+		}
+		if len(t.YazArgs) > 0 {
+			// Hide -u's value, which may have a password, like the password.
+			args := append([]string{}, t.YazArgs...)
+			for i := 0; i+1 < len(args); i += 2 {
+				if args[i] == "-u" {
+					args[i+1] = "..."
+				}
+			}
+			fmt.Fprintf(tw, "  yaz args\t%v\n", strings.Join(args, " "))
+		}
+		if t.overHTTP() {
+			fmt.Fprintf(tw, "  user agent\t%v\n", t.userAgent())
+			if len(t.Headers) > 0 {
+				fmt.Fprintf(tw, "  headers\t%v\n", strings.Join(sortedKeys(t.Headers), ", "))
+			}
+		}
+		for _, ap := range []accessPoint{isbnAccess, oclcAccess, lccnAccess, ismnAccess, titleAccess} {
+			query := t.withAttributes(ap).pqf()
+			switch protocol {
+			case "sru":
+				query = ap.cql
+			case "worldcat":
+				query = worldcatIndexes[ap.name]
+			}
+			fmt.Fprintf(tw, "  %v query\t%v\n", ap.name, query)
+		}
+		notFound := t.NotFoundURLTemplate
+		if t.NoFallbackURL {
+			notFound = ""
+		}
+		links := []struct{ name, template, kind string }{
+			{"found link", t.FoundURLTemplate, "isbn"},
+			{"oclc link", t.OCLCURLTemplate, "oclc"},
+			{"lccn link", t.LCCNURLTemplate, "lccn"},
+			{"ismn link", t.ISMNURLTemplate, "ismn"},
+			{"not found link", notFound, *notFoundSearch},
+		}
+		for _, l := range links {
+			if l.template != "" {
+				fmt.Fprintf(tw, "  %v\t%v\n", l.name, strings.ReplaceAll(l.template, "{searchType}", t.SearchTypes[l.kind]))
+			}
+		}
+		fmt.Fprintf(tw, "  min hits\t%v\n", t.minHits())
+		if t.FoundIf != nil {
+			fmt.Fprintf(tw, "  found if\t%v\n", t.FoundIf.text)
+		}
+		rate := "no limit"
+		if t.Rate > 0 {
+			rate = fmt.Sprintf("%v queries a second", t.Rate)
+		}
+		fmt.Fprintf(tw, "  rate\t%v\n", rate)
+		fmt.Fprintf(tw, "  delay\t%v\n", t.delay())
+		fmt.Fprintf(tw, "  columns\t%v, %v\n", t.column("found"), t.column("search"))
+		tw.Flush()
+	}
+}
+
+// listTargets writes a line for each of the targets, for -list-targets,
+// with the names -targets takes.
+func listTargets(w io.Writer, targets []target) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPROTOCOL\tHOST\tDATABASES")
+	for _, t := range targets {
+		protocol := t.Protocol
+		if protocol == "" {
+			protocol = "z3950"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", t.Name, protocol, t.Host, strings.Join(t.databases(), ", "))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseDelimiter converts a -delimiter value to the field separator rune.
+// A blank value means the delimiter should be detected, and returns 0.
+func parseDelimiter(value string) (rune, error) {
+	switch value {
+	case "":
+		return 0, nil
+	case "tab":
+		return '\t', nil
+	case "comma":
+		return ',', nil
+	}
+	r, size := utf8.DecodeRuneInString(value)
+	if size != len(value) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		return 0, fmt.Errorf("invalid -delimiter %q, must be tab, comma, or a single character", value)
+	}
+	return r, nil
+}
+
+// skipBOM discards a leading UTF-8 byte order mark, as Excel writes,
+// which would otherwise become part of the first header label.
+func skipBOM(r *bufio.Reader) {
+	if bom, err := r.Peek(3); err == nil && string(bom) == "\ufeff" {
+		r.Discard(3)
+	}
+}
+
+// sniffDelimiter peeks at the header line and returns a tab if it
+// has at least as many tabs as commas, otherwise a comma.
+func sniffDelimiter(r *bufio.Reader) rune {
+	line, _ := r.Peek(r.Size())
+	firstLine := string(line)
+	if i := strings.IndexByte(firstLine, '\n'); i >= 0 {
+		firstLine = firstLine[:i]
+	}
+	if strings.Count(firstLine, ",") > strings.Count(firstLine, "\t") {
+		return ','
+	}
+	return '\t'
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// diffLog lists just the columns appended to each row, keyed by its ROW
+// and -diff-key column, for -diff. It's much smaller than the augmented
+// file, for sending to someone who already has the input.
+type diffLog struct {
+	path string
+	file *os.File
+	w    *csv.Writer
+	// The index of the -diff-key column, or -1 without one.
+	key int
+}
+
+// diffPath returns the name of the -diff file for an augmented file,
+// with the input's extension, so list_augmented.tsv has
+// list_augmented_diff.tsv.
+func diffPath(modified string, input string) string {
+	base := filepath.Base(modified)
+	stem := base
+	if i := strings.Index(base, "."); i > 0 {
+		stem = base[:i]
+	}
+	ext := filepath.Ext(strings.TrimSuffix(input, ".gz"))
+	return filepath.Join(filepath.Dir(modified), stem+"_diff"+ext)
+}
+
+// newDiffLog creates the file, or appends to it when resuming.
+func newDiffLog(path string, comma rune, resuming bool) (*diffLog, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resuming {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(path, flags, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("%v - unable to open file %v for writing", err, path)
+	}
+	w := csv.NewWriter(file)
+	w.Comma = comma
+	return &diffLog{path: path, file: file, w: w, key: -1}, nil
+}
+
+// writeHeader writes ROW, the key column's label, and the appended
+// columns' labels, unless the file already has a header. key is the
+// index of the key column in the input's header, or -1.
+func (l *diffLog) writeHeader(header []string, key int) error {
+	l.key = key
+	if info, err := l.file.Stat(); err == nil && info.Size() > 0 {
+		return nil
+	}
+	labels := []string{"ROW"}
+	if key >= 0 {
+		labels = append(labels, header[key])
+	}
+	l.w.Write(append(labels, augmentedHeader(header)[len(header):]...))
+	l.w.Flush()
+	return l.w.Error()
+}
+
+// write adds the row's appended columns.
+func (l *diffLog) write(row augmentedRow) error {
+	values := []string{strconv.Itoa(row.row)}
+	if l.key >= 0 {
+		values = append(values, row.record[l.key])
+	}
+	l.w.Write(append(values, augmentedRecord(row)[len(row.record):]...))
+	l.w.Flush()
+	if err := l.w.Error(); err != nil {
+		return fmt.Errorf("%v - unable to write to %v", err, l.path)
+	}
+	return nil
+}
+
+func (l *diffLog) close() error {
+	return l.file.Close()
+}
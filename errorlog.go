@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// errorLog lists the searches which failed in a file, so just those
+// rows can be run again. The file is only created once there's an error.
+type errorLog struct {
+	path string
+	file *os.File
+	w    *csv.Writer
+}
+
+// errorsPath returns the name of the errors file for an augmented file,
+// list_augmented.tsv has list_augmented_errors.tsv.
+func errorsPath(modified string) string {
+	base := filepath.Base(modified)
+	stem := base
+	if i := strings.Index(base, "."); i > 0 {
+		stem = base[:i]
+	}
+	return filepath.Join(filepath.Dir(modified), stem+"_errors.tsv")
+}
+
+// write adds the row's failed searches for the target.
+func (l *errorLog) write(row int, t target, result targetResult) error {
+	if len(result.failures) == 0 || result.found {
+		return nil
+	}
+	if l.file == nil {
+		file, err := os.Create(l.path)
+		if err != nil {
+			return fmt.Errorf("%v - unable to create errors file %v", err, l.path)
+		}
+		l.file = file
+		l.w = csv.NewWriter(file)
+		l.w.Comma = '\t'
+		l.w.Write([]string{"ROW", "TARGET", "ACCESS POINT", "TERM", "ERROR"})
+	}
+	for _, f := range result.failures {
+		l.w.Write([]string{strconv.Itoa(row), t.Name, f.accessPoint, f.term, f.err.Error()})
+	}
+	l.w.Flush()
+	return l.w.Error()
+}
+
+func (l *errorLog) close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
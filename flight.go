@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// flightGroup collapses concurrent identical searches, like the same
+// ISBN in rows of different files, into one query whose result they
+// all share, since the cache only helps once the first has finished.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+	// waiting, if set, is called as a search starts waiting for
+	// another's result.
+	waiting func(key string)
+}
+
+// flight is a search in progress, done is closed once it has finished.
+type flight struct {
+	done   chan struct{}
+	result searchResult
+	err    error
+}
+
+// searches is shared by every file's queries.
+var searches = &flightGroup{calls: map[string]*flight{}}
+
+// do runs search, unless a search with the same key is already in
+// progress, in which case it waits for that one's result instead. A
+// shared result is marked cached, as no query was made for it.
+func (g *flightGroup) do(ctx context.Context, key string, search func() (searchResult, error)) (searchResult, error) {
+	g.mu.Lock()
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		if g.waiting != nil {
+			g.waiting(key)
+		}
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return searchResult{}, ctx.Err()
+		}
+		// The search was stopped for its own caller, like an ISBN
+		// whose record another of the row's ISBNs found, or ran out of
+		// its caller's -file-timeout or -query-timeout, not this one's.
+		if (errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded)) && ctx.Err() == nil {
+			return search()
+		}
+		result := f.result
+		result.cached = true
+		return result, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	// If search panics, those waiting get an error rather than waiting
+	// forever, and the panic carries on to be recovered by the caller.
+	finished := false
+	defer func() {
+		if !finished {
+			r := recover()
+			f.err = fmt.Errorf("panic: %v", r)
+			g.finish(key, f)
+			panic(r)
+		}
+	}()
+	f.result, f.err = search()
+	finished = true
+	g.finish(key, f)
+	return f.result, f.err
+}
+
+// finish removes the finished flight, and wakes those waiting for it.
+func (g *flightGroup) finish(key string, f *flight) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(f.done)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testFlightGroup returns a flightGroup, with a channel which is sent
+// each time a search starts waiting for another's result.
+func testFlightGroup() (*flightGroup, chan string) {
+	waiting := make(chan string, 1)
+	g := &flightGroup{calls: map[string]*flight{}, waiting: func(key string) { waiting <- key }}
+	return g, waiting
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	g, waiting := testFlightGroup()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		g.do(context.Background(), "T:0306406152", func() (searchResult, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	waited := make(chan error)
+	go func() {
+		_, err := g.do(context.Background(), "T:0306406152", func() (searchResult, error) {
+			t.Error("a second search ran while the first was in progress")
+			return searchResult{}, nil
+		})
+		waited <- err
+	}()
+	<-waiting
+	close(release)
+
+	if r := <-panicked; r != "boom" {
+		t.Errorf("the search's caller recovered %v, want the panic", r)
+	}
+	select {
+	case err := <-waited:
+		if err == nil {
+			t.Error("the waiting search got no error from the one which panicked")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiting search is still waiting for the one which panicked")
+	}
+	if len(g.calls) != 0 {
+		t.Errorf("the flight which panicked is still in progress: %v", g.calls)
+	}
+}
+
+func TestFlightGroupLeaderError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		// Whether the waiting search runs its own.
+		rerun bool
+	}{
+		{"cancelled", context.Canceled, true},
+		{"-query-timeout", fmt.Errorf("%w - unable to search T", context.DeadlineExceeded), true},
+		{"failed", errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, waiting := testFlightGroup()
+			started := make(chan struct{})
+			release := make(chan struct{})
+			go g.do(context.Background(), "T:0306406152", func() (searchResult, error) {
+				close(started)
+				<-release
+				return searchResult{}, tt.err
+			})
+			<-started
+
+			type outcome struct {
+				result searchResult
+				err    error
+			}
+			waited := make(chan outcome)
+			go func() {
+				result, err := g.do(context.Background(), "T:0306406152", func() (searchResult, error) {
+					return searchResult{hits: 3, matched: "0306406152"}, nil
+				})
+				waited <- outcome{result, err}
+			}()
+			<-waiting
+			close(release)
+
+			got := <-waited
+			switch {
+			case tt.rerun && (got.err != nil || got.result.hits != 3 || got.result.cached):
+				t.Errorf("the waiting search got %+v, %v, want its own search's result", got.result, got.err)
+			case !tt.rerun && !errors.Is(got.err, tt.err):
+				t.Errorf("the waiting search got error %v, want the shared %v", got.err, tt.err)
+			}
+		})
+	}
+}
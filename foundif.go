@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// foundIfRecords is how many of the records a search found are shown to
+// check against a target's foundIf rule.
+const foundIfRecords = 10
+
+// recordRule is a target's foundIf, which the records a search finds must
+// meet for it to count as found, for catalogues whose hits include
+// records which aren't holdings, like order records. It's written in the
+// config as a MARC tag, optionally with a subfield code, which must be in
+// the record, and optionally a regular expression its value must match:
+//
+//	"852"            an 852 field
+//	"852$b"          an 852 field with a $b
+//	"852$b ~ ^MAIN"  an 852 $b starting MAIN
+//	"999 ~ avail"    a 999 field with avail anywhere in it
+//
+// A whole field's value is as yaz-client shows it, with its indicators
+// and subfield codes.
+type recordRule struct {
+	text     string
+	tag      string
+	subfield byte
+	pattern  *regexp.Regexp
+}
+
+// parseRecordRule parses a foundIf rule.
+func parseRecordRule(text string) (*recordRule, error) {
+	field, expression, hasPattern := strings.Cut(text, "~")
+	field = strings.TrimSpace(field)
+	rule := &recordRule{text: text}
+	tag, code, hasSubfield := strings.Cut(field, "$")
+	if len(tag) != 3 || !allDigits(tag) {
+		return nil, fmt.Errorf("rule %q must start with a three digit MARC tag, like 852 or 852$b", text)
+	}
+	rule.tag = tag
+	if hasSubfield {
+		if len(code) != 1 {
+			return nil, fmt.Errorf("rule %q must have a one character subfield code after the $", text)
+		}
+		rule.subfield = code[0]
+	}
+	if hasPattern {
+		pattern, err := regexp.Compile(strings.TrimSpace(expression))
+		if err != nil {
+			return nil, fmt.Errorf("%v - unable to parse the regular expression of rule %q", err, text)
+		}
+		rule.pattern = pattern
+	}
+	return rule, nil
+}
+
+func (r *recordRule) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := parseRecordRule(s)
+	if err != nil {
+		return err
+	}
+	*r = *parsed
+	return nil
+}
+
+func (r recordRule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.text)
+}
+
+// match reports whether the record, as the yaz line format lines of its
+// fields like "852 01 $b MAIN $h QA76", meets the rule.
+func (r *recordRule) match(record []string) bool {
+	for _, line := range record {
+		if !strings.HasPrefix(line, r.tag+" ") {
+			continue
+		}
+		value := strings.TrimSpace(line[len(r.tag):])
+		if r.subfield == 0 {
+			if r.pattern == nil || r.pattern.MatchString(value) {
+				return true
+			}
+			continue
+		}
+		for _, subfield := range strings.Split(value, "$")[1:] {
+			if len(subfield) > 0 && subfield[0] == r.subfield {
+				if r.pattern == nil || r.pattern.MatchString(strings.TrimSpace(subfield[1:])) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// checkFound shows the first foundIfRecords of the records a search by
+// the query found, and leaves the search found only if one of them meets
+// the target's foundIf rule, otherwise setting its hits to 0.
+func checkFound(ctx context.Context, t target, query string, result searchResult) (searchResult, error) {
+	if t.FoundIf == nil || !result.found() {
+		return result, nil
+	}
+	shown := result.hits
+	if shown > foundIfRecords {
+		shown = foundIfRecords
+	}
+	results, err := runYaz(ctx, t.YazArgs, t.yazScript(query, "format usmarc", fmt.Sprintf("show 1+%v", shown)))
+	if err != nil {
+		return result, err
+	}
+	if len(results) == 0 {
+		return result, errNoResults
+	}
+	for _, record := range results[0].records {
+		if t.FoundIf.match(record) {
+			return result, nil
+		}
+	}
+	logger(ctx).Debug("no record meets foundIf, not counting the search as found", "rule", t.FoundIf.text, "hits", result.hits, "records", len(results[0].records))
+	result.hits = 0
+	return result, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+)
+
+// gzipped reports whether a file is gzip compressed, judging by its
+// name, ignoring the .partial suffix of output still being written.
+func gzipped(path string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(strings.ToLower(path), ".partial"), ".gz")
+}
+
+// gzipFile closes both the gzip reader and the file beneath it.
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// openInput opens a file for reading, decompressing it if it's gzipped.
+func openInput(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !gzipped(path) {
+		return file, nil
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return gzipFile{reader, file}, nil
+}
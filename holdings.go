@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// holdingsRecords is how many of the records a search found are shown to
+// read their holdings, for -enrich holdings.
+const holdingsRecords = 10
+
+// fetchHoldings fetches the holdings of the records found by each target
+// which found the record, searching again by the term which matched, like
+// fetchTitles. A failed fetch is logged and leaves the holdings blank,
+// unless the context is done.
+func fetchHoldings(ctx context.Context, results []targetResult, title string) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(targets))
+	for i, t := range targets {
+		if !results[i].found {
+			continue
+		}
+		ap, term := matchedSearch(results[i], title)
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			defer recoverAsError(&errs[i])
+			results[i].holdings, errs[i] = queryHoldings(ctx, t, ap, term, results[i].hits)
+		}(i, t)
+	}
+	wg.Wait()
+	if err := firstPanic(errs...); err != nil {
+		return err
+	}
+
+	for i, t := range targets {
+		if errs[i] == nil {
+			continue
+		}
+		err := fmt.Errorf("%v - unable to fetch the holdings of a record %v holds", errs[i], t.Name)
+		if ctx.Err() != nil {
+			return err
+		}
+		logger(withTarget(ctx, t)).Warn("holdings fetch failed", "err", err)
+	}
+	return nil
+}
+
+// queryHoldings searches the target again with yaz-client, showing up to
+// holdingsRecords of the hits records found to return their holdings.
+// Holdings aren't cached.
+func queryHoldings(ctx context.Context, t target, ap accessPoint, term string, hits int) ([]string, error) {
+	ctx = withTarget(ctx, t)
+	query := t.withAttributes(ap).pqf() + " \"" + pqfTerm(term) + "\""
+	shown := hits
+	if shown > holdingsRecords {
+		shown = holdingsRecords
+	}
+	if shown < 1 {
+		shown = 1
+	}
+
+	var found []string
+	err := withRetries(ctx, fmt.Sprintf("holdings fetch from %v", t.Name), func() error {
+		if err := limiter.acquireFor(ctx, t); err != nil {
+			return err
+		}
+		defer limiter.release()
+
+		ctx, cancel := queryContext(ctx)
+		defer cancel()
+
+		start := time.Now()
+		results, err := runYaz(ctx, t.YazArgs, t.yazScript(query, "format usmarc", fmt.Sprintf("show 1+%v", shown)))
+		if err != nil {
+			observeQuery(t.Name, time.Since(start), searchResult{}, err)
+			return err
+		}
+		observeQuery(t.Name, time.Since(start), searchResult{}, nil)
+		if len(results) == 0 {
+			return errNoResults
+		}
+		found = holdings(results[0].records)
+		return nil
+	})
+	return found, err
+}
+
+// holdings returns the holdings in the records' 852 fields, each the
+// holding library's symbol from $a and its location from $b and $c,
+// like "OCU: MAIN STACKS", without repeats.
+func holdings(records [][]string) []string {
+	found := []string{}
+	seen := map[string]bool{}
+	for _, record := range records {
+		for _, line := range record {
+			if !strings.HasPrefix(line, "852 ") {
+				continue
+			}
+			var symbol string
+			var location []string
+			for _, subfield := range strings.Split(line, "$")[1:] {
+				if subfield == "" {
+					continue
+				}
+				value := strings.TrimSpace(subfield[1:])
+				switch subfield[0] {
+				case 'a':
+					symbol = value
+				case 'b', 'c':
+					if value != "" {
+						location = append(location, value)
+					}
+				}
+			}
+			holding := strings.Join(location, " ")
+			if symbol != "" && holding != "" {
+				holding = symbol + ": " + holding
+			} else if symbol != "" {
+				holding = symbol
+			}
+			if holding != "" && !seen[holding] {
+				seen[holding] = true
+				found = append(found, holding)
+			}
+		}
+	}
+	return found
+}
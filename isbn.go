@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+)
+
+// errInvalidISBN fails rows with an invalid ISBN when -strict-isbn is set.
+var errInvalidISBN = errors.New("invalid ISBN check digit or length")
+
+// cleanISBN removes hyphens and spaces from an ISBN and
+// uppercases a trailing 'x' check digit.
+func cleanISBN(isbn string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, isbn)
+	return strings.ToUpper(cleaned)
+}
+
+// isbn10CheckDigit computes the mod-11 check digit for the
+// first nine digits of an ISBN-10.
+func isbn10CheckDigit(first9 string) string {
+	sum := 0
+	for i, r := range first9 {
+		sum += (10 - i) * int(r-'0')
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return "X"
+	}
+	return string(rune('0' + check))
+}
+
+// isbn13CheckDigit computes the mod-10 check digit for the
+// first twelve digits of an ISBN-13.
+func isbn13CheckDigit(first12 string) string {
+	sum := 0
+	for i, r := range first12 {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += weight * int(r-'0')
+	}
+	return string(rune('0' + (10-sum%10)%10))
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// validISBN10 reports whether a cleaned ISBN-10 has a correct check digit.
+func validISBN10(isbn string) bool {
+	if len(isbn) != 10 || !allDigits(isbn[:9]) {
+		return false
+	}
+	return isbn10CheckDigit(isbn[:9]) == isbn[9:]
+}
+
+// validISBN13 reports whether a cleaned ISBN-13 has a correct check digit
+// and a Bookland (978 or 979) prefix.
+func validISBN13(isbn string) bool {
+	if len(isbn) != 13 || !allDigits(isbn) {
+		return false
+	}
+	if !strings.HasPrefix(isbn, "978") && !strings.HasPrefix(isbn, "979") {
+		return false
+	}
+	return isbn13CheckDigit(isbn[:12]) == isbn[12:]
+}
+
+// isbnForms returns the ISBN-10 and ISBN-13 forms of an ISBN.
+// Either value is blank when that form can't be produced, for example
+// a 979-prefixed ISBN-13 has no ISBN-10, and both are blank when the
+// ISBN isn't valid.
+func isbnForms(isbn string) (string, string) {
+	isbn = cleanISBN(isbn)
+	switch {
+	case validISBN10(isbn):
+		first12 := "978" + isbn[:9]
+		return isbn, first12 + isbn13CheckDigit(first12)
+	case validISBN13(isbn):
+		if strings.HasPrefix(isbn, "978") {
+			return isbn[3:12] + isbn10CheckDigit(isbn[3:12]), isbn
+		}
+		return "", isbn
+	}
+	return "", ""
+}
+
+// firstISBNForms returns the ISBN-10 and ISBN-13 forms of the
+// first valid ISBN in the list.
+func firstISBNForms(isbns []string) (string, string) {
+	for _, isbn := range isbns {
+		isbn10, isbn13 := isbnForms(isbn)
+		if isbn10 != "" || isbn13 != "" {
+			return isbn10, isbn13
+		}
+	}
+	return "", ""
+}
+
+// normalizeISBN strips hyphens and spaces from an ISBN, reporting
+// whether the result is a valid ISBN-10 or ISBN-13.
+func normalizeISBN(isbn string) (string, bool) {
+	isbn = cleanISBN(isbn)
+	return isbn, validISBN10(isbn) || validISBN13(isbn)
+}
+
+// validISBNs normalizes the extracted ISBNs, dropping any which
+// aren't valid so no queries are wasted on junk, and returning those
+// separately. Repeats, including the ISBN-10 and ISBN-13 forms of the
+// same ISBN, are dropped too.
+func validISBNs(raw []string) ([]string, []string) {
+	isbns := []string{}
+	invalid := []string{}
+	seen := map[string]bool{}
+	for _, candidate := range raw {
+		isbn, ok := normalizeISBN(candidate)
+		if !ok {
+			invalid = append(invalid, candidate)
+			continue
+		}
+		_, isbn13 := isbnForms(isbn)
+		if seen[isbn13] {
+			slog.Debug("skipping repeated ISBN", "isbn", candidate)
+			continue
+		}
+		seen[isbn13] = true
+		isbns = append(isbns, isbn)
+	}
+	return isbns, invalid
+}
+
+// withoutSkippedPrefixes returns the ISBNs which start with none
+// of the prefixes, in either their ISBN-10 or ISBN-13 form.
+func withoutSkippedPrefixes(isbns []string, prefixes []string) []string {
+	kept := []string{}
+	for _, isbn := range isbns {
+		isbn10, isbn13 := isbnForms(isbn)
+		skip := false
+		for _, prefix := range prefixes {
+			if (isbn10 != "" && strings.HasPrefix(isbn10, prefix)) || strings.HasPrefix(isbn13, prefix) {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			kept = append(kept, isbn)
+		}
+	}
+	return kept
+}
+
+// isbnVariants returns the normalized ISBN followed by its other
+// form, since some catalogues only index one of the two.
+func isbnVariants(isbn string) []string {
+	isbn10, isbn13 := isbnForms(isbn)
+	variants := []string{isbn}
+	for _, variant := range []string{isbn10, isbn13} {
+		if variant != "" && variant != isbn {
+			variants = append(variants, variant)
+		}
+	}
+	return variants
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestISBNVariants(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want []string
+	}{
+		{"0306406152", []string{"0306406152", "9780306406157"}},
+		{"9780306406157", []string{"9780306406157", "0306406152"}},
+		// A 979 ISBN-13 has no ISBN-10, so it's searched by itself.
+		{"9791090636071", []string{"9791090636071"}},
+		{"979-10-90636-07-1", []string{"979-10-90636-07-1", "9791090636071"}},
+		// Invalid ISBNs have no other form.
+		{"0306406153", []string{"0306406153"}},
+	}
+	for _, tt := range tests {
+		if got := isbnVariants(tt.isbn); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("isbnVariants(%q) = %q, want %q", tt.isbn, got, tt.want)
+		}
+	}
+}
+
+func TestISBNForms(t *testing.T) {
+	tests := []struct {
+		isbn           string
+		isbn10, isbn13 string
+	}{
+		{"0306406152", "0306406152", "9780306406157"},
+		{"978-0-306-40615-7", "0306406152", "9780306406157"},
+		{"9791090636071", "", "9791090636071"},
+		{"9791090636072", "", ""},
+		{"9770306406157", "", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		isbn10, isbn13 := isbnForms(tt.isbn)
+		if isbn10 != tt.isbn10 || isbn13 != tt.isbn13 {
+			t.Errorf("isbnForms(%q) = %q, %q, want %q, %q", tt.isbn, isbn10, isbn13, tt.isbn10, tt.isbn13)
+		}
+	}
+}
+
+func TestXCheckDigit(t *testing.T) {
+	tests := []struct {
+		field          string
+		isbn           string
+		isbn10, isbn13 string
+	}{
+		{"080442957X", "080442957X", "080442957X", "9780804429573"},
+		{"080442957x (pbk.)", "080442957X", "080442957X", "9780804429573"},
+		{"0-8044-2957-X", "080442957X", "080442957X", "9780804429573"},
+		// Set apart from the rest, as some records have it.
+		{"0-8044-2957 X", "080442957X", "080442957X", "9780804429573"},
+		{"097522980X:", "097522980X", "097522980X", "9780975229804"},
+		{"155860832X.", "155860832X", "155860832X", "9781558608320"},
+		// The ISBN-13 recomputes its own check digit.
+		{"9780804429573", "9780804429573", "080442957X", "9780804429573"},
+	}
+	for _, tt := range tests {
+		isbns, invalid := validISBNs(getISBNs(tt.field))
+		if len(isbns) != 1 || isbns[0] != tt.isbn || len(invalid) > 0 {
+			t.Errorf("ISBNs of %q = %q, invalid %q, want %q", tt.field, isbns, invalid, tt.isbn)
+			continue
+		}
+		isbn10, isbn13 := isbnForms(isbns[0])
+		if isbn10 != tt.isbn10 || isbn13 != tt.isbn13 {
+			t.Errorf("isbnForms(%q) = %q, %q, want %q, %q", isbns[0], isbn10, isbn13, tt.isbn10, tt.isbn13)
+		}
+	}
+	// An X anywhere but the check digit isn't an ISBN.
+	for _, isbn := range []string{"08044295X3", "978080442957X"} {
+		if _, valid := normalizeISBN(isbn); valid {
+			t.Errorf("normalizeISBN(%q) is valid", isbn)
+		}
+	}
+}
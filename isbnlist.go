@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"strings"
+)
+
+// The header of the single column of an -input-mode isbn-list file.
+const isbnListColumn = "ISBN"
+
+// isbnListReader reads a plain list of ISBNs, one per line, as a TSV file
+// with just an ISBN column, so the list is processed like any other file.
+// Blank lines are skipped. The returned reader should be closed to stop
+// reading early.
+func isbnListReader(r io.Reader) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		w := csv.NewWriter(pw)
+		w.Comma = '\t'
+		w.Write([]string{isbnListColumn})
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, maxLineLength)
+		for scanner.Scan() {
+			line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+			if line == "" {
+				continue
+			}
+			w.Write([]string{line})
+		}
+		w.Flush()
+		err := scanner.Err()
+		if err == nil {
+			err = w.Error()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
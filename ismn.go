@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+)
+
+// getISMNs extracts the ISMNs, the standard numbers of printed music,
+// from a field like 024|a, as 13 digit ISMNs. Repeated values are
+// separated like ISBNs, and values which aren't ISMNs, like the UPCs
+// and EANs 024 holds too, are dropped.
+func getISMNs(raw024pipeA string) []string {
+	ismns := []string{}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(strings.TrimSpace(raw024pipeA), "\";\"") {
+		words := strings.Fields(removeQualifiers(part))
+		if len(words) == 0 {
+			continue
+		}
+		if ismn, ok := normalizeISMN(words[0]); ok && !seen[ismn] {
+			seen[ismn] = true
+			ismns = append(ismns, ismn)
+		}
+	}
+	return ismns
+}
+
+// normalizeISMN removes hyphens and spaces, and writes a 10 character
+// ISMN like M-2306-7118-7 in its 13 digit form, 979-0-2306-7118-7, the
+// M standing for 979-0, which leaves the check digit the same.
+// It reports whether the result is an ISMN with a valid check digit.
+func normalizeISMN(ismn string) (string, bool) {
+	ismn = cleanISBN(strings.Trim(ismn, "\":;,."))
+	if len(ismn) == 10 && ismn[0] == 'M' {
+		ismn = "9790" + ismn[1:]
+	}
+	if len(ismn) != 13 || !strings.HasPrefix(ismn, "9790") || !allDigits(ismn) {
+		return "", false
+	}
+	return ismn, isbn13CheckDigit(ismn[:12]) == ismn[12:]
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+)
+
+// getLCCNs extracts the LCCNs from a 010|a field and normalizes them
+// as the Library of Congress does, so "n 79-1234" and "n79001234"
+// are searched for alike. Repeated values are separated like ISBNs.
+func getLCCNs(raw010pipeA string) []string {
+	lccns := []string{}
+	for _, part := range strings.Split(strings.TrimSpace(raw010pipeA), "\";\"") {
+		if lccn, ok := normalizeLCCN(part); ok {
+			lccns = append(lccns, lccn)
+		}
+	}
+	return lccns
+}
+
+// normalizeLCCN removes blanks and anything after a slash, then
+// zero pads the serial number following a hyphen to six digits,
+// reporting whether the result is an alphabetic prefix of up to
+// three letters followed by an eight or ten digit number.
+func normalizeLCCN(lccn string) (string, bool) {
+	lccn = strings.Join(strings.Fields(lccn), "")
+	lccn = strings.Trim(lccn, "\"")
+	if i := strings.Index(lccn, "/"); i >= 0 {
+		lccn = lccn[:i]
+	}
+	if i := strings.Index(lccn, "-"); i >= 0 {
+		serial := lccn[i+1:]
+		if len(serial) < 6 {
+			serial = strings.Repeat("0", 6-len(serial)) + serial
+		}
+		lccn = lccn[:i] + serial
+	}
+	lccn = strings.ToLower(lccn)
+
+	digits := strings.TrimLeft(lccn, "abcdefghijklmnopqrstuvwxyz")
+	prefix := len(lccn) - len(digits)
+	if prefix > 3 || (len(digits) != 8 && len(digits) != 10) || !allDigits(digits) {
+		return "", false
+	}
+	return lccn, true
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// queryLimiter bounds the number of catalogue queries in flight.
+// The bound starts at one and grows linearly to max over the warm-up
+// period, so partner servers aren't all hit at once when a run starts.
+// Queries may also be limited to a rate.
+type queryLimiter struct {
+	max    int
+	warmup time.Duration
+	start  time.Time
+	rate   *rateLimiter
+
+	mu     sync.Mutex
+	active int
+	// waiting are the queries waiting for a place, in the order they
+	// asked, each closed by grant when a place is theirs.
+	waiting []chan struct{}
+}
+
+// newQueryLimiter returns a limiter of maxQueries in flight, and
+// perSecond queries started each second, if it's more than 0.
+func newQueryLimiter(maxQueries int, warmup time.Duration, perSecond float64) *queryLimiter {
+	if maxQueries < 1 {
+		maxQueries = 1
+	}
+	l := &queryLimiter{max: maxQueries, warmup: warmup, start: time.Now(), rate: newRateLimiter(perSecond)}
+	if warmup > 0 && maxQueries > 1 {
+		go l.warm()
+	}
+	return l
+}
+
+// warm grants places to waiting queries each time the warm-up raises
+// the limit, until it reaches max.
+func (l *queryLimiter) warm() {
+	steps := int64(l.max - 1)
+	for step := int64(1); step <= steps; step++ {
+		// When the limit is 1+step, rounded up so it's reached.
+		at := (int64(l.warmup)*step + steps - 1) / steps
+		time.Sleep(time.Until(l.start.Add(time.Duration(at))))
+		l.mu.Lock()
+		l.grant()
+		l.mu.Unlock()
+	}
+}
+
+// limit returns the number of queries currently allowed in flight.
+func (l *queryLimiter) limit() int {
+	elapsed := time.Since(l.start)
+	if l.warmup <= 0 || elapsed >= l.warmup {
+		return l.max
+	}
+	return 1 + int(float64(l.max-1)*float64(elapsed)/float64(l.warmup))
+}
+
+// acquire blocks until a query may start or the context is done.
+func (l *queryLimiter) acquire(ctx context.Context) error {
+	if err := l.rate.wait(ctx); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	if len(l.waiting) == 0 && l.active < l.limit() {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	l.waiting = append(l.waiting, ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-ready:
+		// Granted a place as the context was done, so pass it on.
+		l.active--
+		l.grant()
+	default:
+		for i, w := range l.waiting {
+			if w == ready {
+				l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// grant gives the places free under the limit to the queries waiting
+// longest. l.mu must be held.
+func (l *queryLimiter) grant() {
+	for len(l.waiting) > 0 && l.active < l.limit() {
+		l.active++
+		close(l.waiting[0])
+		l.waiting = l.waiting[1:]
+	}
+}
+
+// acquireFor waits for each target's own rate limit, then acquires.
+func (l *queryLimiter) acquireFor(ctx context.Context, targets ...target) error {
+	for _, t := range targets {
+		if err := t.rateLimit.wait(ctx); err != nil {
+			return err
+		}
+	}
+	return l.acquire(ctx)
+}
+
+// release marks a query started by acquire as finished.
+func (l *queryLimiter) release() {
+	l.mu.Lock()
+	l.active--
+	l.grant()
+	l.mu.Unlock()
+}
+
+// rateLimiter spaces queries evenly, so no more than a given
+// number start each second. A nil rateLimiter doesn't limit.
+type rateLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// newRateLimiter returns a limiter of perSecond queries,
+// or nil if perSecond isn't more than 0.
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until the next query may start or the context is done.
+func (r *rateLimiter) wait(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	delay := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
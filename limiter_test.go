@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// waitFor waits until the limiter has n queries waiting for a place.
+func waitFor(t *testing.T, l *queryLimiter, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		l.mu.Lock()
+		waiting := len(l.waiting)
+		l.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v queries are waiting, want %v", waiting, n)
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestQueryLimiterRelease(t *testing.T) {
+	l := newQueryLimiter(1, 0, 0)
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		go func(i int) {
+			if err := l.acquire(context.Background()); err == nil {
+				acquired <- i
+			}
+		}(i)
+		waitFor(t, l, i)
+	}
+
+	// Each release hands the place to the query waiting longest.
+	for want := 1; want <= 2; want++ {
+		l.release()
+		select {
+		case got := <-acquired:
+			if got != want {
+				t.Errorf("query %v was given the place, want %v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("a waiting query wasn't given the released place")
+		}
+	}
+}
+
+func TestQueryLimiterCancel(t *testing.T) {
+	l := newQueryLimiter(1, 0, 0)
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- l.acquire(ctx) }()
+	waitFor(t, l, 1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire error = %v, want it cancelled", err)
+	}
+	waitFor(t, l, 0)
+
+	// The cancelled query didn't take the place once it was released.
+	l.release()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := l.acquire(ctx); err != nil {
+		t.Errorf("acquire after the release error = %v", err)
+	}
+}
+
+func TestQueryLimiterWarmup(t *testing.T) {
+	l := newQueryLimiter(3, 100*time.Millisecond, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// One place at the start, then the others as the warm-up raises the
+	// limit, without any being released.
+	for i := 0; i < 3; i++ {
+		if err := l.acquire(ctx); err != nil {
+			t.Fatalf("acquire %v error = %v", i+1, err)
+		}
+	}
+	if elapsed := time.Since(l.start); elapsed < 100*time.Millisecond {
+		t.Errorf("three queries were in flight %v into a warm-up of 100ms", elapsed)
+	}
+}
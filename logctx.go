@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// traceKey is the context key of a search's trace.
+type traceKey struct{}
+
+// trace identifies the row being searched, and once a target's search
+// of it has started, the query, in every line logged about it, so one
+// query's lines can be picked out of a concurrent run's with grep.
+type trace struct {
+	logger *slog.Logger
+	row    int
+}
+
+// withRow returns a context whose searches log the file and row.
+func withRow(ctx context.Context, file string, row int) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace{logger: slog.Default().With("file", file, "row", row), row: row})
+}
+
+// withTarget returns a context whose searches log the query, a short
+// correlation ID like 12/UofT of the row and target, as well.
+func withTarget(ctx context.Context, t target) context.Context {
+	tr, ok := ctx.Value(traceKey{}).(trace)
+	if !ok {
+		return ctx
+	}
+	tr.logger = tr.logger.With("query", fmt.Sprintf("%v/%v", tr.row, t.Name))
+	return context.WithValue(ctx, traceKey{}, tr)
+}
+
+// logger returns the logger of the context's search, or the default
+// logger outside of one.
+func logger(ctx context.Context) *slog.Logger {
+	if tr, ok := ctx.Value(traceKey{}).(trace); ok {
+		return tr.logger
+	}
+	return slog.Default()
+}
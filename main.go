@@ -2,103 +2,619 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
 	"context"
 	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
+)
+
+// Exit statuses, from the least to the most severe.
+const (
+	exitOK          = 0
+	exitQueryErrors = 1
+	exitFileFailed  = 2
+	exitFatal       = 3
+	exitInterrupted = 130
 )
 
 var (
 	// Verbose flag
-	v = flag.Bool("v", false, "Verbose output")
+	v = flag.Bool("v", false, "Verbose output, the same as -log-level debug")
+	// How input files are read.
+	inputMode = flag.String("input-mode", "table", "How input files are read: table, a delimited file with a header row, or isbn-list, one ISBN per line written out as a TSV table")
+	// Stop at the first failed search, rather than marking it and carrying on.
+	abortOnError = flag.Bool("abort-on-error", false, "Stop processing a file at the first search which fails even after retrying, rather than marking its cells as errors and continuing")
+	// Stop everything at the first failure, for checking a list in CI.
+	failFast = flag.Bool("fail-fast", false, "Stop the whole run at the first search or file which fails, cancelling the other files, rather than carrying on and reporting every failure at the end")
+	// Fail rows with an invalid ISBN, for data quality audits.
+	strictISBN = flag.Bool("strict-isbn", false, "Mark rows with an invalid ISBN as errors without searching for them, rather than just skipping the invalid ISBN")
+	// Only errors, for cron jobs.
+	quiet = flag.Bool("quiet", false, "Only log errors, and don't print the summary, the same as -log-level error")
+	// The least severe log messages to write.
+	logLevel = flag.String("log-level", "info", "Minimum level of log messages: debug, info, warn, or error")
+	// Append the ISBN-10 and ISBN-13 forms of the first valid ISBN.
+	isbnFormsFlag = flag.Bool("isbn-forms", false, "Append ISBN10 and ISBN13 columns with the converted forms of the first valid ISBN")
+	// Append a RECOMMENDATION column computed from the holdings results.
+	recommend = flag.Bool("recommend", false, "Append a RECOMMENDATION column based on how many partners hold the title")
+	// Thresholds and labels for the recommendation policy.
+	discardThreshold = flag.Int("discard-threshold", 2, "Recommend discard when held by at least this many partners")
+	reviewThreshold  = flag.Int("review-threshold", 1, "Recommend review when held by at least this many partners")
+	discardLabel     = flag.String("discard-label", "DISCARD", "Recommendation label when the discard threshold is met")
+	reviewLabel      = flag.String("review-label", "REVIEW", "Recommendation label when the review threshold is met")
+	keepLabel        = flag.String("keep-label", "KEEP", "Recommendation label when the title is held by too few partners")
+	// Descend into subdirectories of directory arguments.
+	recursive = flag.Bool("recursive", false, "Process matching files in subdirectories of directory arguments")
+	// The pattern files within directory arguments must match.
+	globPattern = flag.String("glob", "*.tsv", "Only process files in directory arguments whose names match this pattern")
+	// Run as an ingest worker, processing files as they're dropped in.
+	watchDir      = flag.String("watch", "", "Keep running, processing each new file matching -glob which lands in this directory, until interrupted")
+	watchInterval = flag.Duration("watch-interval", 5*time.Second, "How often -watch looks for new files")
+	moveProcessed = flag.Bool("move-processed", false, "With -watch, move each processed input into a processed subdirectory")
+	// Append a compact per-target code describing what happened.
+	diag = flag.Bool("diag", false, "Append a DIAG column per catalogue with a code such as hit:3, miss, diag:114, timeout, error, skipped:no-isbn or skipped:prefix")
+	// Append the number of records each catalogue found.
+	hitsColumn = flag.Bool("hits", false, "Append a HITS column per catalogue with the number of records found")
+	// Search every ISBN, to show which editions each catalogue holds.
+	allMatchedISBNs = flag.Bool("all-matched-isbns", false, "Search each catalogue for all of a record's ISBNs, not just until one is found, and append a MATCHED ISBNS column per catalogue listing those it held")
+	// Fetch the title of the first matching record, to check the match.
+	fetchTitle = flag.Bool("fetch-title", false, "Append a MATCHED TITLE column per catalogue with the 245 title of the first record found")
+	// Append what the catalogues hold rather than only whether they do.
+	enrich = flag.String("enrich", "", "Append more about the records found: holdings, a HOLDINGS column per catalogue with the library symbol and location of each of the records' 852 fields")
+	// Flag matched titles unlike the record's, as the ISBN may be reused.
+	titleMatch = flag.Float64("title-match", 0, "With -fetch-title, append a TITLE MATCH column per catalogue saying whether the matched title is at least this similar to the record's, from 0 to 1 (0 means no column)")
+	// The kind of search linked to when a catalogue doesn't hold the record.
+	notFoundSearch = flag.String("not-found-search", "title", "The search type of not found links, title or keyword, from each target's searchTypes")
+	// Link both ways, whether or not a catalogue held the record.
+	bothURLs = flag.Bool("both-urls", false, "Make each catalogue's SEARCH column an ISBN, OCLC, LCCN or ISMN link even when not found, and append a FALLBACK SEARCH column with the not found link")
+	// Leave the link out when not found, for consumers which take any link as verified.
+	noFallbackURL = flag.Bool("no-fallback-url", false, "Leave a catalogue's SEARCH column blank when it didn't hold the record, rather than linking to a title search")
+	// Link with the title as older versions did, to reproduce their output.
+	rawLinkTitle = flag.Bool("raw-link-title", false, "Put everything before the title's first / into not found links, rather than the title proper without a leading article")
+	// Time each catalogue's searches.
+	timings = flag.Bool("timings", false, "Append a MS column per catalogue with how long its searches for the row took, and summarize them")
+	// Append the input file's base name so rows stay traceable once combined.
+	sourceFileColumn = flag.Bool("source-file", false, "Append a SOURCE FILE column holding the input file's base name")
+	// Retry files which fail before writing any rows after this delay.
+	retryFailedAfter = flag.Duration("retry-failed-after", 0, "Retry files which failed before writing any rows once, after this delay, at the end of the run")
+	// Prepend a UTF-8 byte order mark for tools which need one.
+	outputBOM = flag.Bool("output-bom", false, "Prepend a UTF-8 byte order mark to the output file")
+	// The format of the augmented output.
+	format = flag.String("format", "tsv", "Output format: tsv, json for an array of objects, or xlsx for an Excel workbook with clickable search links")
+	// The written columns, by label, in the order written.
+	columns = flag.String("columns", "", "Comma separated labels of the columns to write, input and appended, in the order to write them, leaving out the rest (tsv and xlsx only)")
+	// Columns kept out of the output, though they're still read.
+	stripColumns = flag.String("strip-columns", "", "Comma separated labels of columns to leave out of the output, like barcodes or notes, which are still searched by if they're the ISBN or title columns")
+	// How catalogues are searched.
+	backend = flag.String("backend", "yaz", "Z39.50 client to use: yaz to run yaz-client, or native for the built-in client")
+	// Search by title at the title step of -search-order.
+	titleSearch = flag.Bool("title-search", false, "Search by title, at the title step of -search-order, for the catalogues which haven't found the record yet, and append an ACCESS POINT column per catalogue")
+	// AND the author into title searches, as common titles alone match other books.
+	titleAuthorFallback = flag.Bool("title-author-fallback", false, "With -title-search, search by title and author together for rows with an -author-field value, reported as the title+author access point")
+	authorField         = flag.String("author-field", "100|a,author", "Comma separated header labels to take the author from, for -title-author-fallback, the first in the header is used")
+	// SRU and WorldCat searches go through this proxy instead of the environment's.
+	proxyURL = flag.String("proxy", "", "URL of the HTTP proxy to send SRU and WorldCat searches through, rather than what HTTP_PROXY, HTTPS_PROXY and NO_PROXY give")
+	// Give up on a single catalogue search after this long.
+	queryTimeout = flag.Duration("query-timeout", 0, "Stop waiting for a single catalogue search after this long (0 means no limit)")
+	// A ceiling on the whole run, for scheduled jobs.
+	runTimeout = flag.Duration("timeout", 0, "Stop the whole run after this long, keeping what's done as Ctrl+C does (0 means no limit)")
+	// A ceiling on each file, so one slow file can't hold up the rest.
+	fileTimeout = flag.Duration("file-timeout", 0, "Stop processing a file after this long, keeping what's done for -resume as -timeout does, and go on to the next (0 means no limit)")
+	// The politeness pause between searches.
+	delay = flag.Duration("delay", 500*time.Millisecond, "Pause after each round of catalogue searches, targets may override this in -config")
+	// The yaz-client executable, and how it's run, which can be replaced to fake it.
+	yazClient   = flag.String("yaz-client", defaultYazClient(), "Path of the yaz-client executable, defaults to $YAZ_CLIENT if set")
+	execCommand = exec.CommandContext
+	// Replace the built-in yaz-client scripts, for commands they don't use.
+	templateFile = flag.String("template-file", "", "A yaz-client command script to search with instead of the built-in one, with \"{term}\" for the search term and {address}, {attributes}, {auth} and {charset} for each target's")
+	// Builds of yaz-client which don't read commands from stdin need a file.
+	yazScriptFile = flag.Bool("yaz-script-file", false, "Pass yaz-client its commands in a temporary file with -f, rather than on stdin")
+	// yaz-client builds translated into other languages phrase the line
+	// with each search's hits differently, like "Nombre de résultats : 12".
+	hitsPattern = flag.String("hits-pattern", defaultHitsPattern, "Regular expression matching the line of yaz-client's output with a search's hits, with a group capturing the count, for builds which print it in another language")
+	// Where those files go, when the system's temporary directory is small.
+	tmpDir = flag.String("tmpdir", "", "Directory for the -yaz-script-file command files and the files extracted from zip archives (default $TMPDIR, or the system's temporary directory)")
+	// Search a record's ISBNs together rather than one after another.
+	parallelISBNs = flag.Int("parallel-isbns", 1, "Search up to this many of a record's ISBNs at once per catalogue, stopping at the first found")
+	// Records with more ISBNs than this are probably malformed.
+	maxISBNs = flag.Int("max-isbns", 0, "Search at most this many of a record's ISBNs, marking the row miss:capped if none are found (0 means no limit)")
+	// Publishers, like local or self-published ones, never in the catalogues.
+	skipISBNPrefixes = flag.String("skip-isbn-prefixes", "", "Comma separated ISBN prefixes, like 978-0-9812, which aren't searched for, rows with only those are marked skipped")
+	skipPrefixes     []string
+	// Search a record's ISBNs in one query rather than one at a time.
+	orISBNs = flag.Bool("or-isbns", false, "Search for all of a record's ISBNs in a single query per catalogue, ORed together, at the cost of not knowing which one matched")
+	// Run all of a record's searches in one yaz-client session.
+	batchYaz = flag.Bool("batch-yaz", false, "Run every ISBN and catalogue search for a record in a single yaz-client session")
+	// How many files are processed at once, and rows of each searched at once.
+	jobs           = flag.Int("jobs", 4, "Maximum number of files to process at the same time")
+	rowConcurrency = flag.Int("row-concurrency", 1, "Search up to this many rows of each file at the same time, still writing them in order")
+	// One malformed file shouldn't stop a batch run over dozens of them.
+	keepGoing = flag.Bool("keep-going", false, "Log the stack and skip a file whose processing panics, carrying on with the others, rather than exiting")
+	// Bound and warm up the number of simultaneous catalogue queries.
+	concurrency = flag.Int("concurrency", 0, "Maximum simultaneous catalogue queries across all files (0 means one per target per row being searched)")
+	rampUp      = flag.Duration("ramp-up", 0, "Grow the query concurrency from 1 to the maximum over this warm-up period")
+	rate        = flag.Float64("rate", 0, "Maximum catalogue queries started per second across all files and targets (0 means no limit)")
+	// Try transient search failures again before giving up.
+	retries      = flag.Int("retries", 2, "Retry a catalogue search which fails to connect or times out this many times")
+	retryBackoff = flag.Duration("retry-backoff", time.Second, "Pause before the first retry of a search, doubling for each retry after")
+	// How to resolve header names which appear more than once.
+	duplicateHeaders = flag.String("duplicate-headers", "last", "Which column a duplicated header name refers to: first, last, or fail")
+	// Periodically log how far through each file processing is.
+	progressInterval = flag.Duration("progress", 0, "Log each file's progress, with counts of titles found and an ETA, at this interval (0 means never)")
+	// Report what would be searched without searching.
+	dryRun = flag.Bool("dry-run", false, "Log the ISBNs extracted from each row and the catalogues which would be searched, without searching or writing output")
+	// Measure a run with the real settings, to size batch jobs.
+	benchFlag = flag.Bool("bench", false, "Search as usual without writing output, then report rows and queries a second, the cache hit rate, and each catalogue's median and 95th percentile query latency")
+	// Try a config against the start of a big file.
+	sample = flag.Int("sample", 0, "Process only the first this many data rows of each file (0 means all of them)")
+	// What to do with rows which don't have a value for every header.
+	onBadRow = flag.String("on-bad-row", "skip", "How to handle a row with a different number of columns than the header: skip, pad, or fail. Blank extra columns are always dropped")
+	// The header labels which may hold the ISBNs and title, the first present is used.
+	isbnField  = flag.String("isbn-field", "020|a", "Comma separated header labels to take the ISBNs from, the first in the header is used")
+	titleField = flag.String("title-field", "title", "Comma separated header labels to take the title from, the first in the header is used")
+	// Other fields which can hold ISBNs, searched after the -isbn-field's.
+	extraISBNFields = flag.String("extra-isbn-fields", "", "Comma separated header labels, like 020|z,024|a, whose ISBNs are also searched for, after the -isbn-field's")
+	// Exports which repeat a field in columns of its own, like 020|a.1.
+	isbnColumns = flag.String("isbn-columns", "", "A pattern, like 020|a*, of header labels whose columns all hold ISBNs like the -isbn-field's, for exports which put each 020 in its own column")
+	// The header labels which may hold LCCNs, searched for after OCLC numbers.
+	lccnField = flag.String("lccn-field", "010|a", "Comma separated header labels to take LCCNs from, searched for when the ISBNs and OCLC numbers aren't found (blank means never)")
+	// The header labels which may hold ISMNs, for printed music.
+	ismnField = flag.String("ismn-field", "024|a", "Comma separated header labels to take ISMNs from, searched for when the ISBNs, OCLC numbers and LCCNs aren't found (blank means never)")
+	// Which identifiers are searched for, in what order, for targets
+	// without a match yet.
+	searchOrder = flag.String("search-order", defaultSearchOrder, "Comma separated steps, from isbn, oclc, lccn, ismn and title, searching by each of a record's identifiers in turn for the catalogues which haven't found it yet, and appending an ACCESS POINT column per catalogue if it isn't the default. Steps left out aren't searched")
+	// Header labels, and the labels flags name, are lowercased before
+	// they're matched, unless they're to be matched as written.
+	caseSensitiveHeaders = flag.Bool("case-sensitive-headers", false, "Match header labels to -isbn-field, -title-field and the other label flags as written, rather than ignoring case")
+	// Source systems label the same fields differently.
+	headerMapFlag = flag.String("map", "", "Comma separated label=name pairs, like ISBN=020|a,245|a=title, reading a column labelled label as if it were labelled name")
+	headerMap     map[string]string
+	// Write every file's rows to one file instead.
+	mergePath = flag.String("merge", "", "Write the augmented rows of every file to this one file, under a single header, rather than each to its own. Rows of files processed at once are interleaved, see -source-file")
+	// Where augmented files are written.
+	outPath  = flag.String("out", "", "Write the augmented file here, or into this directory when it is one, instead of beside the input (- is always written to stdout), or to a URL like s3://bucket/key when an output sink for its scheme is built in")
+	suffix   = flag.String("suffix", "_augmented", "Added to the input's base name to name the augmented file")
+	outIsDir bool
+	// Compress the augmented files, which gzipped input always is.
+	gzipOutput = flag.Bool("gzip", false, "Gzip the augmented files, which is the default for gzipped (.gz) input")
+	// List the failed searches of each file.
+	errorsFile = flag.Bool("errors-file", false, "Write the row, target, term and error of each failed search to a _errors.tsv file beside the augmented file")
+	// The rows worth weeding decisions, on their own.
+	onlyMissing = flag.Bool("only-missing", false, "Also write a _missing file beside the augmented file with just the rows no catalogue held, in their original columns")
+	// A smaller file of just what was appended, for those with the input.
+	diffFlag = flag.Bool("diff", false, "Also write a _diff file beside the augmented file with just the appended columns of each row, keyed by its ROW and -diff-key column")
+	diffKey  = flag.String("diff-key", "001", "Comma separated labels of the column identifying each row in the -diff file, the first found of which is used")
+	// Protect finished output from an accidental re-run.
+	noClobber = flag.Bool("no-clobber", false, "Skip files whose augmented file already exists, rather than overwriting it")
+	// What's left of the output of a file which failed or was interrupted.
+	keepPartial = flag.Bool("keep-partial", true, "Keep the .partial output of a file which failed or was interrupted, for -resume to finish, rather than removing it")
+	// Continue an interrupted run, appending to existing output.
+	resume = flag.Bool("resume", false, "Skip input rows already in an existing augmented file, or its .partial output, and append the rest")
+	// Flushing less often is faster on network filesystems.
+	flushEvery = flag.Int("flush-every", 1, "Flush the augmented file after this many rows, or a second, rather than after every row")
+	// Add targets to files augmented by an earlier run.
+	appendMode = flag.Bool("append", false, "Read already augmented files, search only the targets they have no columns for, and replace them with those columns added")
+	// Search again the rows of augmented files which had failed searches.
+	redoErrors = flag.Bool("redo-errors", false, "Read already augmented files and their _errors.tsv files, search the rows listed again, and replace the files with their new results, keeping the other rows as they were")
+	// The field delimiter of the input, which the output also uses.
+	delimiterFlag = flag.String("delimiter", "", "Field delimiter: tab, comma, or a single character (detected from the header line when not set)")
+	delimiter     rune
 	// A version flag, which should be overwritten when building using ldflags.
-	version = "devel"
+	version      = "devel"
+	printVersion = flag.Bool("version", false, "Print the version, and yaz-client's if it's found, then exit")
+	// Check the targets can be searched before a long run.
+	check = flag.Bool("check", false, "Search each target for a test ISBN, report whether each answered, how quickly and with how many hits, as a table or as JSON with -format json, then exit")
+	// See what a config resolves to without searching anything.
+	configCheck = flag.Bool("config-check", false, "Validate the config and print each target as it will be searched, with defaults applied, then exit")
+	// Find the names -targets can take.
+	listTargetsFlag = flag.Bool("list-targets", false, "Print the name, protocol and host of each target in -config, or the built-in ones, then exit")
+	// The catalogues to search, from -config or the built-in defaults.
+	configPath = flag.String("config", "", "JSON file listing the Z39.50 targets to search, or - to read it from stdin (YAML isn't supported)")
+	targetList = flag.String("targets", "", "Comma separated names of the targets to search, in the order their columns are appended (default all)")
+	targets    []target
+	// Remember results between runs.
+	cachePath = flag.String("cache", "", "File to remember search results in between runs (not used with -batch-yaz)")
+	// Warm the cache off-peak, so the run which writes the output is fast.
+	seedCache = flag.Bool("seed-cache", false, "Search every target for the input files' rows, or an ISBN list's with -input-mode isbn-list, only to fill the -cache file, without writing output")
+	cacheTTL  = flag.Duration("cache-ttl", 0, "Search again when a cached result is older than this (0 means never)")
+	cache     *resultCache
+	// Catalogues reloaded on a known date make older results stale.
+	cacheSinceFlag = flag.String("cache-since", "", "Search again when a cached result was checked before this date, like 2024-05-01, or time, like 2024-05-01T09:00:00-04:00")
+	cacheSince     time.Time
+	// Checkpoints of each file's progress, which -resume can skip to.
+	statePath = flag.String("state", "", "File to record how many rows of each input file have been written, which -resume skips rather than counting the output's rows")
+	state     *runState
+	// Counts across every file, for the summary at the end of the run.
+	reportPath = flag.String("report", "", "Write the end of run summary to this file as well as stderr")
+	totals     *summary
+	// Shared by every file so the total query rate is bounded.
+	limiter *queryLimiter
+	// Observe long runs as they go.
+	metricsAddr = flag.String("metrics-addr", "", "Serve query, hit and error counts and query latencies per catalogue at /metrics on this address, like :9090")
+	stats       *metrics
 )
 
-const YazTemplateISBNUofT string = `open sirsi.library.utoronto.ca:2200
-find @attr 1=7 "%v"
-quit
-`
-
-const YazTemplateISBNUofO string = `open orbis.uottawa.ca:210/INNOPAC
-find @attr 1=7 "%v"
-close
-quit
-`
-
 func init() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Well Connected Gardener - Version %v\n", version)
 		fmt.Fprintf(os.Stderr, "Enhance weeding lists by adding search results from other library OPACs.\n")
-		fmt.Fprintf(os.Stderr, "usage: well-connected-gardener [-v] file [...]\n")
+		fmt.Fprintf(os.Stderr, "usage: well-connected-gardener [flags] file|dir|zip|- [...]\n")
 		fmt.Fprintf(os.Stderr, "flags:\n")
 		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "exit status:\n")
+		fmt.Fprintf(os.Stderr, "  %v    every file was processed without errors\n", exitOK)
+		fmt.Fprintf(os.Stderr, "  %v    some searches failed, those rows are marked as errors\n", exitQueryErrors)
+		fmt.Fprintf(os.Stderr, "  %v    a file couldn't be read or written, or reached the -file-timeout, or with\n        -fail-fast, a search failed\n", exitFileFailed)
+		fmt.Fprintf(os.Stderr, "  %v    the run couldn't start, for example yaz-client is missing\n", exitFatal)
+		fmt.Fprintf(os.Stderr, "  %v  interrupted, or the -timeout was reached\n", exitInterrupted)
+		fmt.Fprintf(os.Stderr, "environment:\n")
+		fmt.Fprintf(os.Stderr, "  each flag can be set by a variable named %v and the flag in capitals with _ for -,\n", envPrefix)
+		fmt.Fprintf(os.Stderr, "  like %v for -retry-backoff, or in the config file's settings, by flag name.\n", envName("retry-backoff"))
+		fmt.Fprintf(os.Stderr, "  A flag on the command line beats the environment, which beats the config file.\n")
 	}
 }
 
-func process(ctx context.Context, filename string) {
-	if *v {
-		log.Printf("processing filename: %v\n", filename)
+// process augments one file, returning what it learned of each data
+// row written and the error, if any, which stopped processing early.
+func process(ctx context.Context, filename string) ([]rowResult, error) {
+	slog.Debug("processing", "file", filename)
+
+	// A filename of "-" reads from stdin and writes to stdout.
+	var input io.Reader = os.Stdin
+	// Where the output is written, until it's committed under modified.
+	var sink outputSink = stdoutSink{}
+	absPath, base, modified := "stdin", "stdin", "stdout"
+	resuming := false
+	// The rows the -state file records as written, when resuming by it.
+	resumeAfter := 0
+	fromState := false
+	var compressor *gzip.Writer
+	var partial, resumePath string
+
+	if filename != "-" {
+		var err error
+		absPath, err = filepath.Abs(filename)
+		if err != nil {
+			return nil, fmt.Errorf("%v - unable to get absolute path of %v", err, filename)
+		}
+
+		slog.Debug("absolute path", "path", absPath)
+
+		file, err := openInput(absPath)
+		if err != nil {
+			return nil, fmt.Errorf("%v - unable to open file %v for reading", err, filename)
+		}
+		defer file.Close()
+		input = file
+
+		base = filepath.Base(absPath)
+		modified = outputPath(absPath)
+		if modified == absPath && !*appendMode && !*redoErrors && merged == nil {
+			return nil, fmt.Errorf("refusing to overwrite %v with its augmented version", filename)
+		}
+		if *redoErrors && modified != absPath {
+			return nil, fmt.Errorf("%v isn't an augmented file, its name doesn't end in %v", filename, *suffix)
+		}
+
+		if *noClobber && !*resume {
+			if _, err := os.Stat(modified); err == nil {
+				slog.Warn("output already exists, skipping", "file", filename, "output", modified)
+				return nil, nil
+			}
+		}
+
+		// A local output is written beside the finished file, see fileSink.
+		partial = modified + ".partial"
+		resumePath = partial
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if *resume && state != nil {
+			resumeAfter, fromState = state.rows(absPath)
+		}
+		if *resume {
+			if _, err := os.Stat(partial); os.IsNotExist(err) {
+				resumePath = modified
+				if _, err := os.Stat(modified); err == nil && writesOutput() {
+					// Finish the finished output, in case there are new rows.
+					if err := os.Rename(modified, partial); err != nil {
+						return nil, fmt.Errorf("%v - unable to resume %v", err, modified)
+					}
+					resumePath = partial
+				}
+			}
+			if info, err := os.Stat(resumePath); err == nil && info.Size() > 0 {
+				resuming = true
+				flags = os.O_WRONLY | os.O_APPEND
+			}
+		}
+		// With -merge, modified only names the file's -errors-file and
+		// -only-missing files, its rows are written to the merged file.
+		sink = nil
+		if writesOutput() && merged == nil {
+			var err error
+			sink, err = openSink(modified, partial, flags)
+			if err != nil {
+				return nil, err
+			}
+			defer func() {
+				if sink != nil {
+					sink.abort()
+					if state != nil && !*keepPartial {
+						state.forget(absPath)
+					}
+				}
+			}()
+		}
+	}
+	var output io.Writer = ioutil.Discard
+	if sink != nil {
+		output = sink
+		if filename != "-" && (*gzipOutput || gzipped(modified)) {
+			compressor = gzip.NewWriter(sink)
+			defer compressor.Close()
+			output = compressor
+		}
+	}
+	if !writesOutput() {
+		// Nothing is written, the report is logged.
+		output = ioutil.Discard
 	}
 
-	absPath, err := filepath.Abs(filename)
-	if err != nil {
-		log.Printf("%v - unable to get absolute path of %v.\n", err, filename)
-		return
+	if *outputBOM && !resuming && merged == nil {
+		if _, err := io.WriteString(output, "\ufeff"); err != nil {
+			return nil, fmt.Errorf("%v - unable to write byte order mark to %v", err, modified)
+		}
 	}
 
-	if *v {
-		log.Printf("absolute path: %v\n", absPath)
+	comma := delimiter
+	if *inputMode == "isbn-list" {
+		list := isbnListReader(input)
+		defer list.Close()
+		input = list
+		comma = '\t'
+	}
+	buffered := bufio.NewReader(input)
+	skipBOM(buffered)
+	if comma == 0 {
+		comma = sniffDelimiter(buffered)
+		slog.Debug("detected delimiter", "delimiter", string(comma), "file", absPath)
 	}
 
-	file, err := os.Open(absPath)
-	if err != nil {
-		log.Printf("%v - unable to open file for reading.", err)
-		return
+	// The header and number of rows already written, when resuming.
+	var existingHeader []string
+	skip := 0
+	if resuming {
+		var err error
+		existingHeader, skip, err = readAugmented(resumePath, comma)
+		if err != nil {
+			return nil, err
+		}
+		if fromState {
+			// The state's count of input rows is used instead.
+			skip = 0
+		}
+		slog.Debug("resuming", "file", absPath, "rows", skip, "output", modified)
 	}
-	defer file.Close()
 
-	dir := filepath.Dir(absPath)
-	ext := filepath.Ext(absPath)
-	base := filepath.Base(absPath)
-	modified := filepath.Join(dir, strings.TrimSuffix(base, ext)+"_augmented"+ext)
+	r := csv.NewReader(buffered)
+	r.Comma = comma
+	r.LazyQuotes = true
+	// Rows of the wrong length are handled below, following -on-bad-row.
+	r.FieldsPerRecord = -1
 
-	output, err := os.Create(modified)
-	if err != nil {
-		log.Printf("%v - unable to open file for writing.", err)
-		return
+	o := newRowWriter(output, comma)
+	// Where the rows are written, for errors writing them.
+	destination := modified
+	if merged != nil && writesOutput() {
+		o = merged.writer(filename, comma)
+		destination = merged.path
 	}
-	defer output.Close()
+	// Finish the output even when processing stops early.
+	defer o.close()
 
-	r := csv.NewReader(file)
-	r.Comma = '\t'
-	r.LazyQuotes = true
+	var progress *progressReport
+	if *progressInterval > 0 {
+		total := 0
+		if filename != "-" {
+			total = countRows(absPath, comma)
+			if *inputMode == "isbn-list" && total > 0 {
+				// The list has no header.
+				total++
+			}
+		}
+		progress = newProgressReport(base, total, *progressInterval)
+	}
+
+	var missing *missingLog
+	if *onlyMissing && filename != "-" && writesOutput() {
+		var err error
+		missing, err = newMissingLog(missingPath(modified, base), comma, resuming)
+		if err != nil {
+			return nil, err
+		}
+		defer missing.close()
+	}
+
+	var diff *diffLog
+	if *diffFlag && filename != "-" && writesOutput() {
+		var err error
+		diff, err = newDiffLog(diffPath(modified, base), comma, resuming)
+		if err != nil {
+			return nil, err
+		}
+		defer diff.close()
+	}
+
+	var failures *errorLog
+	if *errorsFile && filename != "-" && writesOutput() {
+		failures = &errorLog{path: errorsPath(modified)}
+		defer failures.close()
+	}
+	// The rows to search again, the errors file listing them is
+	// replaced once the file is.
+	var redo *redoRows
+	if *redoErrors {
+		if _, err := os.Stat(errorsPath(absPath)); os.IsNotExist(err) {
+			slog.Info("no errors file, nothing to search again", "file", filename)
+			return nil, nil
+		}
+		var err error
+		redo, err = readRedoRows(errorsPath(absPath))
+		if err != nil {
+			return nil, err
+		}
+		failures = &errorLog{path: redo.errorsPath + ".partial"}
+		defer failures.close()
+	}
+
+	fileSummary := newSummary()
+	defer totals.merge(fileSummary)
+
+	// flushOutput writes the rows buffered, before the -state file
+	// records them as written.
+	flushOutput := func() error {
+		if t, ok := o.(*tsvWriter); ok {
+			if err := t.flush(); err != nil {
+				return fmt.Errorf("%v - unable to write to %v", err, destination)
+			}
+		}
+		if compressor != nil {
+			if err := compressor.Flush(); err != nil {
+				return fmt.Errorf("%v - unable to write to %v", err, destination)
+			}
+		}
+		return nil
+	}
 
-	o := csv.NewWriter(output)
-	o.Comma = '\t'
+	// Rows are searched with rowCtx, so those being searched stop
+	// when processing does.
+	rowCtx, cancelRows := context.WithCancel(ctx)
+	defer cancelRows()
+	rows := []rowResult{}
+	// The -columns order of the written columns, once the header is read.
+	var order []int
+	// emit writes a searched row, and everything else recorded of it.
+	emit := func(row augmentedRow) error {
+		row.columns = order
+		if err := o.writeRow(row); err != nil {
+			return fmt.Errorf("%v - unable to write to %v", err, destination)
+		}
+		if state != nil && sink != nil && filename != "-" {
+			if err := state.record(absPath, row.row, flushOutput); err != nil {
+				return err
+			}
+		}
+		if row.kept != nil {
+			rows = append(rows, rowResult{row: row.row})
+			return nil
+		}
+		if diff != nil {
+			if err := diff.write(row); err != nil {
+				return err
+			}
+		}
+		if missing != nil {
+			if err := missing.write(row.record, row.results); err != nil {
+				return err
+			}
+		}
+		if failures != nil {
+			for i, t := range targets {
+				if err := failures.write(row.row, t, row.results[i]); err != nil {
+					return err
+				}
+			}
+		}
+		rows = append(rows, row.result())
+		fileSummary.record(row.isbns, row.results)
+		if progress != nil {
+			progress.record(row.results)
+		}
+		if *abortOnError || *failFast {
+			for i, t := range targets {
+				if row.results[i].failed && !row.results[i].found {
+					f := row.results[i].failures[0]
+					return fmt.Errorf("%v - unable to search %v for %v %q in row %v of %v, stopping as -abort-on-error or -fail-fast is set", f.err, t.Name, f.accessPoint, f.term, row.row, filename)
+				}
+			}
+		}
+		return nil
+	}
+	// The rows being searched, oldest first, which are written in that
+	// order whichever finishes first.
+	inflight := []chan rowOutcome{}
+	// writeNext waits for the oldest row being searched, and writes it.
+	writeNext := func() error {
+		outcome := <-inflight[0]
+		inflight = inflight[1:]
+		if outcome.err != nil {
+			return outcome.err
+		}
+		return emit(outcome.row)
+	}
+	// writeFinished writes the oldest rows which have finished being
+	// searched, in order, up to the first which hasn't or which failed.
+	writeFinished := func() error {
+		for len(inflight) > 0 {
+			select {
+			case outcome := <-inflight[0]:
+				inflight = inflight[1:]
+				if outcome.err != nil {
+					return nil
+				}
+				if err := emit(outcome.row); err != nil {
+					return err
+				}
+			default:
+				return nil
+			}
+		}
+		return nil
+	}
 
 	var header []string
+	var isbnLabel, titleLabel, lccnLabel, ismnLabel, authorLabel string
+	var extraISBNLabels, repeatedISBNLabels []string
+	rowNumber := 0
+	var duplicates map[string][]int
 
-ProcessingLoop:
 	for {
 		select {
 		case <-ctx.Done():
-			if *v {
-				log.Printf("canceling processing of: %v\n", absPath)
+			slog.Debug("canceling processing", "file", absPath)
+			// Rows searched before the rows still being searched are
+			// written ahead of the checkpoint, rather than searched again.
+			if err := writeFinished(); err != nil {
+				return rows, err
 			}
-			break ProcessingLoop
+			if state != nil && sink != nil && filename != "-" {
+				// Checkpoint the rows written, for -resume.
+				if err := flushOutput(); err != nil {
+					return rows, err
+				}
+				if err := state.save(); err != nil {
+					return rows, err
+				}
+			}
+			return rows, nil
 		default:
 		}
 
@@ -107,246 +623,2292 @@ ProcessingLoop:
 			break
 		}
 		if err != nil {
-			log.Printf("%v - unable to process file %v.", err, filename)
-			return
+			return rows, fmt.Errorf("%v - unable to process file %v", err, filename)
 		}
 
-		if header == nil {
-			newHeader := append([]string{}, record...)
-			newHeader = append(newHeader, "FOUND IN UOFO CATALOGUE")
-			newHeader = append(newHeader, "UOFO CATALOGUE SEARCH")
-			newHeader = append(newHeader, "FOUND IN UOFT CATALOGUE")
-			newHeader = append(newHeader, "UOFT CATALOGUE SEARCH")
-			o.Write(newHeader)
-
-			lowercaserecord := record[:0]
-			for _, x := range record {
-				lowercaserecord = append(lowercaserecord, strings.TrimSpace(strings.ToLower(x)))
+		if header != nil {
+			rowNumber++
+			if *sample > 0 && rowNumber > *sample {
+				slog.Info("stopping after the -sample rows", "file", base, "rows", *sample)
+				break
 			}
-			header = lowercaserecord
-		} else {
-			recordMap := map[string]string{}
-			for i, label := range header {
-				recordMap[label] = record[i]
+			// Rows searched again have the columns appended to them before.
+			width := len(header)
+			if redo != nil {
+				width += redo.appended
 			}
-
-			if *v {
-				log.Printf("%#v\n", recordMap)
+			// Blank trailing columns, usually from a trailing tab, are
+			// dropped so they don't push the appended columns out of line.
+			record = trimBlankTail(record, width)
+			if len(record) != width {
+				problem := fmt.Sprintf("row %v of %v has %v columns but the header has %v", rowNumber, filename, len(record), width)
+				switch *onBadRow {
+				case "fail":
+					return rows, errors.New(problem)
+				case "skip":
+					slog.Warn(problem + ", skipping it")
+					continue
+				default:
+					slog.Warn(problem + ", padding or truncating it")
+					record = fitRow(record, width)
+				}
 			}
+			if redo != nil {
+				if !redo.rows[rowNumber] {
+					// Written as it was, once the rows before it are.
+					done := make(chan rowOutcome, 1)
+					done <- rowOutcome{row: augmentedRow{row: rowNumber, kept: record}}
+					inflight = append(inflight, done)
+					continue
+				}
+				record = record[:len(header)]
+			}
+		}
 
-			foundInUofOCat := false
-			isbnInUofOCat := ""
-			foundInUofTCat := false
-			isbnInUofTCat := ""
-
-			for _, isbn := range getISBNs(recordMap["020|a"]) {
+		if header == nil {
+			if redo != nil {
+				record, err = redo.inputHeader(record, filename)
+				if err != nil {
+					return rows, err
+				}
+			}
+			order, err = columnOrder(augmentedHeader(record))
+			if err != nil {
+				return rows, fmt.Errorf("%v - unable to order the columns of %v by -columns and -strip-columns", err, filename)
+			}
+			if resuming {
+				if !sameHeader(existingHeader, outputHeader(record)) {
+					return rows, fmt.Errorf("the header of %v doesn't match the augmented header expected for %v, not resuming", modified, filename)
+				}
+			} else if err := o.writeHeader(record); err != nil {
+				return rows, fmt.Errorf("%v - unable to write header to %v", err, destination)
+			}
+			if missing != nil {
+				if err := missing.writeHeader(record); err != nil {
+					return rows, fmt.Errorf("%v - unable to write header to %v", err, missing.path)
+				}
+			}
 
-				if *v {
-					log.Printf("ISBN: %v\n", isbn)
+			// A new slice, so the record written above isn't modified.
+			labels := make([]string, 0, len(record))
+			for _, x := range record {
+				label := headerKey(x)
+				if name, ok := headerMap[label]; ok {
+					label = name
 				}
+				labels = append(labels, label)
+			}
+			header = labels
 
-				if !foundInUofOCat {
-					uoforesult, err := z3950forISBN(isbn, YazTemplateISBNUofO)
-					if err != nil {
-						log.Println(err)
-						break ProcessingLoop
-					}
-					if uoforesult {
-						foundInUofOCat = true
-						isbnInUofOCat = isbn
+			isbnLabel = firstColumn(header, *isbnField)
+			if *inputMode == "isbn-list" {
+				isbnLabel = headerKey(isbnListColumn)
+			}
+			repeatedISBNLabels = nil
+			if *isbnColumns != "" && *inputMode != "isbn-list" {
+				for _, label := range header {
+					if matched, _ := path.Match(headerKey(*isbnColumns), label); matched && label != isbnLabel {
+						repeatedISBNLabels = append(repeatedISBNLabels, label)
 					}
-					if *v {
-						log.Printf("UofO Result: %v\n", uoforesult)
+				}
+			}
+			if isbnLabel == "" && len(repeatedISBNLabels) == 0 {
+				slog.Warn("no ISBN column, only OCLC numbers and titles can be searched for", "labels", *isbnField, "file", filename)
+			}
+			extraISBNLabels = nil
+			for _, label := range strings.Split(*extraISBNFields, ",") {
+				if label = firstColumn(header, label); label != "" && label != isbnLabel {
+					extraISBNLabels = append(extraISBNLabels, label)
+				}
+			}
+			titleLabel = firstColumn(header, *titleField)
+			authorLabel = firstColumn(header, *authorField)
+			lccnLabel = firstColumn(header, *lccnField)
+			ismnLabel = firstColumn(header, *ismnField)
+			if diff != nil {
+				key := -1
+				if label := firstColumn(header, *diffKey); label != "" {
+					for i := range header {
+						if header[i] == label {
+							key = i
+							break
+						}
 					}
 				}
+				if err := diff.writeHeader(record, key); err != nil {
+					return rows, fmt.Errorf("%v - unable to write header to %v", err, diff.path)
+				}
+			}
+			if titleLabel == "" && *inputMode != "isbn-list" {
+				slog.Warn("no title column, search links and title searches will be missing titles", "labels", *titleField, "file", filename)
+			}
 
-				if !foundInUofTCat {
-					uoftresult, err := z3950forISBN(isbn, YazTemplateISBNUofT)
-					if err != nil {
-						log.Println(err)
-						break ProcessingLoop
-					}
-					if uoftresult {
-						foundInUofTCat = true
-						isbnInUofTCat = isbn
+			duplicates = duplicateLabels(header)
+			for _, label := range sortedKeys(duplicates) {
+				slog.Warn("duplicate header, use label@column to select one", "label", label, "file", filename, "columns", duplicates[label])
+			}
+			if len(duplicates) > 0 && *duplicateHeaders == "fail" {
+				return rows, fmt.Errorf("refusing to process %v with duplicate headers", filename)
+			}
+		} else if skip > 0 {
+			// Already augmented by an earlier run.
+			skip--
+		} else if rowNumber <= resumeAfter {
+			// Recorded as written by the -state file.
+		} else {
+			recordMap := map[string]string{}
+			for i, label := range header {
+				if _, dup := duplicates[label]; dup {
+					// Duplicated labels are always reachable by position.
+					recordMap[fmt.Sprintf("%v@%v", label, i+1)] = record[i]
+					if _, seen := recordMap[label]; seen && *duplicateHeaders == "first" {
+						continue
 					}
-					if *v {
-						log.Printf("UofT Result: %v\n", uoftresult)
+				}
+				recordMap[label] = record[i]
+			}
+
+			slog.Debug("record", "fields", recordMap)
+
+			rawISBNs, title := "", ""
+			if isbnLabel != "" {
+				rawISBNs = recordMap[isbnLabel]
+			}
+			if titleLabel != "" {
+				title = recordMap[titleLabel]
+			}
+			author := ""
+			if authorLabel != "" {
+				author = recordMap[authorLabel]
+			}
+			if len(repeatedISBNLabels) > 0 {
+				values := []string{}
+				if rawISBNs != "" {
+					values = append(values, rawISBNs)
+				}
+				for _, label := range repeatedISBNLabels {
+					if value := recordMap[label]; value != "" {
+						values = append(values, value)
 					}
 				}
+				// Joined the way a repeated subfield is.
+				rawISBNs = strings.Join(values, "\";\"")
+			}
+			isbns, invalid := validISBNs(getISBNs(rawISBNs))
+			for _, isbn := range invalid {
+				slog.Warn("invalid ISBN, not searching for it", "file", base, "row", rowNumber, "isbn", isbn)
+			}
+			if len(extraISBNLabels) > 0 {
+				// Fields like 020|z hold cancelled ISBNs, so invalid
+				// ones are expected and ignored.
+				extraValues := []string{}
+				for _, label := range extraISBNLabels {
+					extraValues = append(extraValues, recordMap[label])
+				}
+				extra, _ := validISBNs(getISBNs(extraValues...))
+				isbns, _ = validISBNs(append(isbns, extra...))
+			}
+			// With -strict-isbn, rows with an invalid ISBN fail unsearched.
+			rejected := *strictISBN && len(invalid) > 0
+			// Rows whose ISBNs all have a -skip-isbn-prefixes prefix
+			// aren't searched at all.
+			skipped := false
+			if len(skipPrefixes) > 0 && len(isbns) > 0 {
+				kept := withoutSkippedPrefixes(isbns, skipPrefixes)
+				if len(kept) < len(isbns) {
+					slog.Debug("not searching ISBNs with a skipped prefix", "file", base, "row", rowNumber, "isbns", len(isbns)-len(kept))
+				}
+				skipped = len(kept) == 0 && !rejected
+				isbns = kept
+			}
+			capped := *maxISBNs > 0 && len(isbns) > *maxISBNs
+			if capped {
+				slog.Warn("record has too many ISBNs, searching only the first few", "file", base, "row", rowNumber, "isbns", len(isbns), "max", *maxISBNs)
+				isbns = isbns[:*maxISBNs]
+			}
+			oclcs := getOCLCNumbers(recordMap["035|a"])
+			lccns := []string{}
+			if lccnLabel != "" {
+				lccns = getLCCNs(recordMap[lccnLabel])
+			}
+			ismns := []string{}
+			if ismnLabel != "" {
+				ismns = getISMNs(recordMap[ismnLabel])
+			}
+			// Rows with none of these can't be searched for, or linked to.
+			searchable := len(isbns) > 0 || len(oclcs) > 0 || len(lccns) > 0 || len(ismns) > 0 || titleTerm(title) != "" || skipped
 
-				time.Sleep(500 * time.Millisecond)
+			if *dryRun {
+				dryRunReport(base, rowNumber, rawISBNs, isbns, title)
+				fileSummary.record(isbns, nil)
+				rows = append(rows, rowResult{row: rowNumber, isbns: isbns})
+				continue
 			}
 
-			newRecord := append([]string{}, record...)
-			newRecord = append(newRecord, strconv.FormatBool(foundInUofOCat))
-			if foundInUofOCat {
-				newRecord = append(newRecord, "https://orbis.uottawa.ca/search/?searchtype=i&SORT=D&searcharg="+isbnInUofOCat)
-			} else {
-				newRecord = append(newRecord, "https://orbis.uottawa.ca/search/?searchtype=t&SORT=D&searcharg="+urlReadyTitle(recordMap["title"]))
+			s := rowSearch{
+				record:     record,
+				number:     rowNumber,
+				title:      title,
+				author:     author,
+				isbns:      isbns,
+				invalid:    invalid,
+				oclcs:      oclcs,
+				lccns:      lccns,
+				ismns:      ismns,
+				rejected:   rejected,
+				skipped:    skipped,
+				capped:     capped,
+				searchable: searchable,
+			}
+			for len(inflight) >= *rowConcurrency {
+				if err := writeNext(); err != nil {
+					return rows, err
+				}
 			}
-			newRecord = append(newRecord, strconv.FormatBool(foundInUofTCat))
-			if foundInUofTCat {
-				newRecord = append(newRecord, "https://onesearch.library.utoronto.ca/onesearch/"+isbnInUofTCat+"//")
+			done := make(chan rowOutcome, 1)
+			inflight = append(inflight, done)
+			if *rowConcurrency == 1 {
+				// Searched here, so a panic is recovered by processRecovered.
+				row, err := searchRow(rowCtx, filename, base, s)
+				done <- rowOutcome{row, err}
 			} else {
-				newRecord = append(newRecord, "https://onesearch.library.utoronto.ca/onesearch/"+urlReadyTitle(recordMap["title"])+"//title")
+				go func() {
+					var outcome rowOutcome
+					defer func() { done <- outcome }()
+					defer recoverAsError(&outcome.err)
+					outcome.row, outcome.err = searchRow(rowCtx, filename, base, s)
+				}()
 			}
-			o.Write(newRecord)
 		}
-
-		// Write any buffered data to the underlying writer (standard output).
-		o.Flush()
-
-		if err := o.Error(); err != nil {
-			log.Printf("%v - unable to flush csv file %v.", err, modified)
-			break ProcessingLoop
+	}
+	for len(inflight) > 0 {
+		if err := writeNext(); err != nil {
+			return rows, err
 		}
 	}
-}
-
-func getISBNs(raw020pipeA string) []string {
-	isbns := []string{}
-	// Split on the ";" delimiter
-	for _, part := range strings.Split(strings.TrimSpace(raw020pipeA), "\";\"") {
-		isbn := strings.Trim(strings.Split(part, " ")[0], ":.")
-		if isbn != "" {
-			isbns = append(isbns, isbn)
+	if progress != nil {
+		slog.Info(progress.String())
+	}
+	if err := o.close(); err != nil {
+		return rows, fmt.Errorf("%v - unable to finish writing %v", err, modified)
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return rows, fmt.Errorf("%v - unable to finish compressing %v", err, modified)
 		}
 	}
-	return isbns
+	if sink != nil {
+		if err := sink.commit(); err != nil {
+			return rows, err
+		}
+		sink = nil
+		if state != nil && filename != "-" {
+			if err := state.save(); err != nil {
+				return rows, err
+			}
+		}
+	}
+	if redo != nil {
+		if err := redo.finish(failures); err != nil {
+			return rows, err
+		}
+	}
+	return rows, nil
 }
 
-func main() {
-
-	// Parse the command line flags.
-	flag.Parse()
-
-	if len(flag.Args()) == 0 {
-		log.Fatalln("Please provide one file to process.")
+// maxQueries returns the -concurrency, or when it's 0, one query per
+// target per row being searched, in the files processed at once. With
+// -watch there are no files yet, and up to -jobs are processed at once.
+func maxQueries(files int) int {
+	if *concurrency > 0 {
+		return *concurrency
 	}
-
-	// Check to see if we have yaz-client available to us.
-	out, err := exec.Command("yaz-client", "-V").Output()
-	if err != nil {
-		log.Fatalf("Unable to execute yaz-client: %v\n", err)
+	if files > *jobs || *watchDir != "" {
+		files = *jobs
 	}
-	if *v {
-		log.Printf("yaz-client -V\n")
-		log.Printf("%s", out)
+	return files * len(targets) * *rowConcurrency
+}
+
+// searchedFor marks results skipped for lack of an ISBN as misses,
+// before they're searched for by another access point.
+func searchedFor(results []targetResult) {
+	for i := range results {
+		if results[i].diag == "skipped:no-isbn" {
+			results[i].diag = "miss"
+		}
 	}
-	// Use this to ensure all files are processed
-	// before exiting.
-	var wg sync.WaitGroup
+}
 
-	// A context to pass to the file processing code
-	// to allow for timeouts and canceling.
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// headerKey returns the label as header labels are matched, trimmed
+// and lowercased, or only trimmed with -case-sensitive-headers.
+func headerKey(label string) string {
+	label = strings.TrimSpace(label)
+	if *caseSensitiveHeaders {
+		return label
+	}
+	return strings.ToLower(label)
+}
 
-	// Process each filename in the arguments.
-	for _, filename := range flag.Args() {
-		wg.Add(1)
-		go func(filename string) {
-			defer wg.Done()
-			process(ctx, filename)
-		}(filename)
+// firstColumn returns the first of the comma separated candidate
+// labels in the header, as headerKey gives them, or blank if there
+// are none.
+func firstColumn(header []string, candidates string) string {
+	for _, candidate := range strings.Split(candidates, ",") {
+		candidate = headerKey(candidate)
+		for _, label := range header {
+			if label == candidate {
+				return label
+			}
+		}
 	}
+	return ""
+}
 
-	// trap Ctrl+C and call cancel if received.
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt)
-	defer signal.Stop(sigs)
-	go func() {
-		select {
-		case <-sigs:
-			log.Println("Cancelling...")
-			cancel()
-			wg.Wait()
-			log.Println("Done.")
-		case <-ctx.Done():
+// trimBlankTail drops the values past the given length when they're all blank.
+func trimBlankTail(record []string, length int) []string {
+	if len(record) <= length {
+		return record
+	}
+	for _, value := range record[length:] {
+		if strings.TrimSpace(value) != "" {
+			return record
 		}
-	}()
+	}
+	return record[:length]
+}
 
-	// Wait for processing to complete.
-	wg.Wait()
+// fitRow pads the record with blank values or truncates it to the given length.
+func fitRow(record []string, length int) []string {
+	if len(record) > length {
+		return record[:length]
+	}
+	for len(record) < length {
+		record = append(record, "")
+	}
+	return record
 }
 
-func z3950forISBN(isbn string, template string) (bool, error) {
+// defaultSearchOrder searches by ISBN, then for the targets without a
+// match, by OCLC number, LCCN, ISMN and, with -title-search, title.
+const defaultSearchOrder = "isbn,oclc,lccn,ismn,title"
 
-	found := false
+// searchSteps is the parsed -search-order.
+var searchSteps = strings.Split(defaultSearchOrder, ",")
 
-	// Create command script in temporary directory
-	cmdFile, err := ioutil.TempFile("", "well-connected-gardener-yaz-command.*.txt")
-	if err != nil {
-		log.Println("unable to create new temporary command file")
-		return found, err
+// parseSearchOrder parses a -search-order, each of whose steps is the
+// name of an access point, listed once.
+func parseSearchOrder(order string) ([]string, error) {
+	known := map[string]bool{isbnAccess.name: true, oclcAccess.name: true, lccnAccess.name: true, ismnAccess.name: true, titleAccess.name: true}
+	steps := []string{}
+	for _, step := range strings.Split(order, ",") {
+		step = strings.ToLower(strings.TrimSpace(step))
+		if !known[step] {
+			return nil, fmt.Errorf("%q isn't a step, it must be isbn, oclc, lccn, ismn or title", step)
+		}
+		if hasLabel(steps, step) {
+			return nil, fmt.Errorf("the step %v is listed more than once", step)
+		}
+		steps = append(steps, step)
 	}
+	return steps, nil
+}
 
-	if *v {
-		log.Printf("Created temp command file at %v.\n", cmdFile.Name())
+// dryRunReport logs the ISBNs extracted from a data row and what
+// would be searched for it, for the -dry-run flag.
+func dryRunReport(base string, row int, rawISBNs string, isbns []string, title string) {
+	names := []string{}
+	for _, t := range targets {
+		names = append(names, t.Name)
 	}
-
-	defer os.Remove(cmdFile.Name())
-
-	_, err = cmdFile.WriteString(fmt.Sprintf(template, isbn))
-	if err != nil {
-		log.Println("unable to write to temporary command file")
-		return found, err
+	switch {
+	case len(isbns) > 0:
+		slog.Info("would search", "file", base, "row", row, "targets", strings.Join(names, ", "), "isbns", strings.Join(isbns, ", "))
+	case *titleSearch && titleTerm(title) != "":
+		slog.Info("would search by title", "file", base, "row", row, "isbns", rawISBNs, "targets", strings.Join(names, ", "), "title", titleTerm(title))
+	default:
+		slog.Info("nothing to search", "file", base, "row", row, "isbns", rawISBNs)
 	}
+}
 
-	err = cmdFile.Sync()
-	if err != nil {
-		log.Println("unable to call sync on temporary command file")
-		return found, err
+// outputPath returns where the augmented version of the input file is
+// written, following -out and -suffix. By default this is beside the input,
+// with _augmented added to its name, and gzipped if the input is or -gzip is set.
+func outputPath(absPath string) string {
+	if *outPath != "" && !outIsDir {
+		return *outPath
 	}
-
-	err = cmdFile.Close()
-	if err != nil {
-		log.Println("unable to close temporary command file")
-		return found, err
+	dir := filepath.Dir(absPath)
+	if outIsDir {
+		dir = *outPath
 	}
-
-	// The command to execute
-	cmd := exec.Command("yaz-client", "-f", cmdFile.Name())
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Println("unable to create new StdoutPipe")
-		return found, err
+	base := filepath.Base(absPath)
+	compressed := (*gzipOutput || gzipped(base)) && *format != "xlsx"
+	if gzipped(base) {
+		// The suffix goes before both extensions of list.tsv.gz.
+		base = base[:len(base)-len(".gz")]
 	}
-
-	err = cmd.Start()
-	if err != nil {
-		log.Println("error starting exec'd process")
-		return found, err
+	ext := filepath.Ext(base)
+	outExt := ext
+	if *inputMode == "isbn-list" {
+		outExt = ".tsv"
 	}
-
-	scanner := bufio.NewScanner(stdout)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "Number of hits:") {
-			count, err := strconv.Atoi(strings.TrimSuffix(strings.Fields(line)[3], ","))
-			if err == nil && count > 0 {
-				found = true
-			}
-		}
+	if *format != "tsv" {
+		outExt = "." + *format
 	}
-	err = scanner.Err()
-	if err != nil {
-		log.Println("error scanning from exec'd process")
-		return found, err
+	if compressed {
+		outExt += ".gz"
+	}
+	name := strings.TrimSuffix(base, ext)
+	if (*appendMode || *redoErrors) && strings.HasSuffix(name, *suffix) {
+		// The augmented file is replaced, along with its new columns.
+		return filepath.Join(dir, name+outExt)
 	}
+	return filepath.Join(dir, name+*suffix+outExt)
+}
 
-	err = cmd.Wait()
-	if err != nil {
-		log.Println("error waiting for exec'd command to complete")
-		return found, err
+// duplicateLabels returns the labels which appear more than
+// once in the header, with their 1-based column positions.
+func duplicateLabels(header []string) map[string][]int {
+	positions := map[string][]int{}
+	for i, label := range header {
+		positions[label] = append(positions[label], i+1)
+	}
+	for label, columns := range positions {
+		if len(columns) < 2 {
+			delete(positions, label)
+		}
 	}
+	return positions
+}
 
-	return found, nil
+// sortedKeys returns the keys of the map in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
-func urlReadyTitle(title string) string {
-	firstPart := strings.TrimSpace(strings.Split(title, "/")[0])
-	return url.QueryEscape(firstPart)
+// getISBNs extracts the ISBNs from fields like 020|a, in order. Repeated
+// subfields are exported joined by ";", with the quotes around each
+// doubled, so values look like `0306406152 (pbk.)";"9780306406157`.
+// Parenthesized qualifiers like "(pbk.)" and stray punctuation are
+// removed, then the first word of each value is the ISBN, returned
+// without hyphens, so blank or punctuation only values have none.
+// Some exports separate ISBNs with commas or spaces instead, so the
+// words after the first which are valid ISBNs are taken too.
+func getISBNs(rawFields ...string) []string {
+	isbns := []string{}
+	for _, raw := range rawFields {
+		// Split on the ";" delimiter
+		for _, part := range strings.Split(strings.TrimSpace(raw), "\";\"") {
+			words := strings.FieldsFunc(removeQualifiers(part), func(r rune) bool {
+				return r == ';' || r == ',' || unicode.IsSpace(r)
+			})
+			first := true
+			for i := 0; i < len(words); i++ {
+				isbn := cleanISBN(strings.Trim(words[i], "\":;,."))
+				// An X check digit set apart, as in "0-8044-2957 X", is the ISBN's.
+				if len(isbn) == 9 && i+1 < len(words) && strings.EqualFold(strings.Trim(words[i+1], "\":;,."), "x") {
+					isbn += "X"
+					i++
+				}
+				// Stray punctuation, like a "/" or "[]" left by the export.
+				if strings.IndexFunc(isbn, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) < 0 {
+					continue
+				}
+				wasFirst := first
+				first = false
+				// Other words, like "pbk." outside parentheses, aren't ISBNs.
+				if _, valid := normalizeISBN(isbn); !wasFirst && !valid {
+					continue
+				}
+				isbns = append(isbns, isbn)
+			}
+		}
+	}
+	return isbns
+}
+
+// removeQualifiers replaces parenthesized text, including nested
+// parentheses, with a space, so "0306406152(pbk. (v. 1))" becomes
+// "0306406152 ".
+func removeQualifiers(value string) string {
+	var b strings.Builder
+	depth := 0
+	for _, r := range value {
+		switch {
+		case r == '(':
+			if depth == 0 {
+				b.WriteRune(' ')
+			}
+			depth++
+		case r == ')':
+			if depth > 0 {
+				depth--
+			}
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func main() {
+
+	// Parse the command line flags, then set the others from the
+	// environment and the config file, in that order of precedence.
+	flag.Parse()
+	set := explicitFlags()
+	if err := applyEnvironment(set); err != nil {
+		fatal(err.Error())
+	}
+	// A config piped on stdin leaves no input there, so files must be named.
+	if *configPath == "-" {
+		for _, arg := range flag.Args() {
+			if arg == "-" {
+				fatal("stdin (-) can't be an input file when -config - reads the config from it")
+			}
+		}
+	}
+	loaded, err := loadConfig(*configPath)
+	if err != nil {
+		fatal(err.Error())
+	}
+	configLabel := *configPath
+	if configLabel == "-" {
+		configLabel = "stdin"
+	}
+	if err := applySettings(loaded.Settings, set, configLabel); err != nil {
+		fatal(err.Error())
+	}
+	targets = loaded.Targets
+
+	level := slog.LevelInfo
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fatal("invalid -log-level, must be debug, info, warn, or error", "level", *logLevel)
+	}
+	if *v && *quiet {
+		fatal("-v and -quiet can't be used together")
+	}
+	if *v {
+		level = slog.LevelDebug
+	}
+	if *quiet {
+		level = slog.LevelError
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	if *printVersion {
+		fmt.Printf("well-connected-gardener %v\n", version)
+		if out, err := execCommand(context.Background(), *yazClient, "-V").Output(); err == nil {
+			fmt.Print(string(out))
+		}
+		return
+	}
+
+	if len(flag.Args()) == 0 && !*check && !*configCheck && !*listTargetsFlag && *watchDir == "" {
+		fatal("please provide one file to process")
+	}
+	if *watchDir != "" {
+		if len(flag.Args()) > 0 {
+			fatal("-watch can't be combined with files to process")
+		}
+		if info, err := os.Stat(*watchDir); err != nil || !info.IsDir() {
+			fatal("-watch must be a directory", "dir", *watchDir)
+		}
+		if *watchInterval <= 0 {
+			fatal("-watch-interval must be more than 0")
+		}
+		if *appendMode {
+			fatal("-watch can't be used with -append")
+		}
+	} else if *moveProcessed {
+		fatal("-move-processed requires -watch")
+	}
+
+	if _, err := filepath.Match(*globPattern, ""); err != nil {
+		fatal("invalid -glob pattern", "pattern", *globPattern, "err", err)
+	}
+
+	if *parallelISBNs < 1 {
+		fatal("-parallel-isbns must be at least 1")
+	}
+	if *mergePath != "" && (*outPath != "" || *resume || *appendMode || *noClobber) {
+		fatal("-merge can't be used with -out, -resume, -append or -no-clobber")
+	}
+	if *titleAuthorFallback && !*titleSearch {
+		fatal("-title-author-fallback requires -title-search")
+	}
+	steps, err := parseSearchOrder(*searchOrder)
+	if err != nil {
+		fatal("invalid -search-order", "err", err)
+	}
+	searchSteps = steps
+	if *titleSearch && !hasLabel(searchSteps, "title") {
+		fatal("-title-search requires title in the -search-order", "value", *searchOrder)
+	}
+	if *titleAuthorFallback && *templateFile != "" {
+		fatal("-title-author-fallback can't be used with -template-file, which has a single term")
+	}
+	if *columns != "" && (*format == "json" || *appendMode) {
+		fatal("-columns can't be used with -format json, which names every column, or -append, which reads the appended columns where they were written")
+	}
+	if *stripColumns != "" && (*appendMode || *redoErrors) {
+		fatal("-strip-columns can't be used with -append or -redo-errors, which read the columns where they were written")
+	}
+	if *seedCache && (*cachePath == "" || *batchYaz || *dryRun || *benchFlag || *resume || *appendMode || *redoErrors || *statePath != "") {
+		fatal("-seed-cache requires -cache, and can't be used with -batch-yaz, which doesn't use the cache, or -dry-run, -bench, -resume, -append, -redo-errors or -state")
+	}
+	if *benchFlag && (*dryRun || *resume || *appendMode || *redoErrors || *statePath != "") {
+		fatal("-bench can't be used with -dry-run, -resume, -append, -redo-errors or -state, which need the output it doesn't write")
+	}
+	if *noFallbackURL && *bothURLs {
+		fatal("-no-fallback-url can't be used with -both-urls, which links to the not found search")
+	}
+	if *rowConcurrency < 1 {
+		fatal("-row-concurrency must be at least 1")
+	}
+	if *hitsPattern != defaultHitsPattern {
+		pattern, err := regexp.Compile(*hitsPattern)
+		if err != nil {
+			fatal("invalid -hits-pattern", "err", err)
+		}
+		if pattern.NumSubexp() != 1 {
+			fatal("-hits-pattern must have one group, capturing the count, like ([0-9]+)", "value", *hitsPattern)
+		}
+		hitsLine = pattern
+	}
+	if *proxyURL != "" {
+		proxy, err := parseProxy(*proxyURL)
+		if err != nil {
+			fatal("invalid -proxy", "err", err)
+		}
+		sruClient = newSRUClient(proxy)
+	}
+	if *rate < 0 {
+		fatal("-rate can't be negative")
+	}
+	if *cacheSinceFlag != "" {
+		if *cachePath == "" {
+			fatal("-cache-since requires -cache")
+		}
+		cacheSince, err = parseSince(*cacheSinceFlag)
+		if err != nil {
+			fatal("invalid -cache-since, it must be a date like 2024-05-01 or an RFC 3339 time", "value", *cacheSinceFlag)
+		}
+	}
+	if *maxISBNs < 0 {
+		fatal("-max-isbns can't be negative")
+	}
+	if *sample < 0 {
+		fatal("-sample can't be negative")
+	}
+	if *flushEvery < 1 {
+		fatal("-flush-every must be at least 1")
+	}
+	for _, prefix := range strings.Split(*skipISBNPrefixes, ",") {
+		if prefix = cleanISBN(strings.TrimSpace(prefix)); prefix == "" {
+			continue
+		}
+		if !allDigits(strings.TrimSuffix(prefix, "X")) {
+			fatal("invalid -skip-isbn-prefixes, prefixes must be ISBN digits", "prefix", prefix)
+		}
+		skipPrefixes = append(skipPrefixes, prefix)
+	}
+	headerMap = map[string]string{}
+	for _, pair := range strings.Split(*headerMapFlag, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		label, name, ok := strings.Cut(pair, "=")
+		label, name = headerKey(label), headerKey(name)
+		if !ok || label == "" || name == "" {
+			fatal("invalid -map, it must be comma separated label=name pairs", "pair", pair)
+		}
+		if _, seen := headerMap[label]; seen {
+			fatal("invalid -map, a label can only be mapped once", "label", label)
+		}
+		headerMap[label] = name
+	}
+	if *jobs < 1 {
+		fatal("-jobs must be at least 1")
+	}
+
+	switch *onBadRow {
+	case "skip", "pad", "fail":
+	default:
+		fatal("invalid -on-bad-row, must be skip, pad, or fail", "value", *onBadRow)
+	}
+
+	switch *duplicateHeaders {
+	case "first", "last", "fail":
+	default:
+		fatal("invalid -duplicate-headers, must be first, last, or fail", "value", *duplicateHeaders)
+	}
+
+	switch *format {
+	case "tsv", "json", "xlsx":
+	default:
+		fatal("invalid -format, must be tsv, json, or xlsx", "value", *format)
+	}
+	if *format == "xlsx" && *gzipOutput {
+		fatal("-gzip can't be used with -format xlsx, which is already compressed")
+	}
+	if *format == "xlsx" && *outputBOM {
+		fatal("-output-bom can't be used with -format xlsx")
+	}
+
+	delimiter, err = parseDelimiter(*delimiterFlag)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	if *resume && *format != "tsv" {
+		fatal("-resume can only be used with -format tsv")
+	}
+	if *statePath != "" && (*format != "tsv" || *mergePath != "" || *redoErrors) {
+		fatal("-state can only be used with -format tsv, and not with -merge or -redo-errors")
+	}
+	if *appendMode && (*format != "tsv" || *resume || *noClobber || *inputMode != "table") {
+		fatal("-append can only be used with -format tsv and -input-mode table, and not with -resume or -no-clobber")
+	}
+	if *redoErrors && (*format != "tsv" || *inputMode != "table" || *appendMode || *resume || *noClobber || *outPath != "" || *mergePath != "" || *watchDir != "" || *columns != "" || *sample > 0 || *onlyMissing || *diffFlag || *dryRun) {
+		fatal("-redo-errors can only be used with -format tsv and -input-mode table, and not with -append, -resume, -no-clobber, -out, -merge, -watch, -columns, -sample, -only-missing, -diff or -dry-run, as it replaces the files read")
+	}
+
+	switch *notFoundSearch {
+	case "title", "keyword":
+	default:
+		fatal("invalid -not-found-search, must be title or keyword", "value", *notFoundSearch)
+	}
+
+	switch *inputMode {
+	case "table", "isbn-list":
+	default:
+		fatal("invalid -input-mode, must be table or isbn-list", "value", *inputMode)
+	}
+
+	switch *backend {
+	case "yaz", "native":
+	default:
+		fatal("invalid -backend, must be yaz or native", "value", *backend)
+	}
+	if *orISBNs && (*batchYaz || *parallelISBNs > 1) {
+		fatal("-or-isbns can't be used with -batch-yaz or -parallel-isbns")
+	}
+	if *tmpDir != "" {
+		if info, err := os.Stat(*tmpDir); err != nil || !info.IsDir() {
+			fatal("-tmpdir must be a directory", "tmpdir", *tmpDir)
+		}
+	}
+	if _, err := path.Match(*isbnColumns, ""); err != nil {
+		fatal("invalid -isbn-columns pattern", "pattern", *isbnColumns, "err", err)
+	}
+	if *allMatchedISBNs && *orISBNs {
+		fatal("-all-matched-isbns can't be used with -or-isbns, which can't tell which ISBN matched")
+	}
+	if *titleMatch < 0 || *titleMatch > 1 {
+		fatal("-title-match must be from 0 to 1")
+	}
+	if *titleMatch > 0 && !*fetchTitle {
+		fatal("-title-match requires -fetch-title")
+	}
+	if *fetchTitle && *backend != "yaz" {
+		fatal("-fetch-title requires -backend yaz")
+	}
+	switch *enrich {
+	case "", "holdings":
+	default:
+		fatal("invalid -enrich, must be holdings", "value", *enrich)
+	}
+	if *enrich != "" && *backend != "yaz" {
+		fatal("-enrich requires -backend yaz")
+	}
+	if *batchYaz && *backend != "yaz" {
+		fatal("-batch-yaz requires -backend yaz")
+	}
+	if *templateFile != "" && *backend != "yaz" {
+		fatal("-template-file requires -backend yaz")
+	}
+
+	if *templateFile != "" {
+		customTemplate, err = loadYazTemplate(*templateFile)
+		if err != nil {
+			fatal(err.Error())
+		}
+	}
+	if *listTargetsFlag {
+		listTargets(os.Stdout, targets)
+		return
+	}
+	if *targetList != "" {
+		targets, err = selectTargets(targets, *targetList)
+		if err != nil {
+			fatal(err.Error())
+		}
+	}
+	for _, t := range targets {
+		if *batchYaz && t.overHTTP() {
+			fatal("-batch-yaz can't be used with SRU or worldcat targets", "target", t.Name)
+		}
+		if *fetchTitle && t.overHTTP() {
+			fatal("-fetch-title can't be used with SRU or worldcat targets", "target", t.Name)
+		}
+		if *enrich != "" && t.overHTTP() {
+			fatal("-enrich can't be used with SRU or worldcat targets", "target", t.Name)
+		}
+		if t.FoundIf != nil && (*backend != "yaz" || *batchYaz) {
+			fatal("a target with a foundIf rule requires -backend yaz, and can't be used with -batch-yaz", "target", t.Name)
+		}
+		// Rather than connecting without them.
+		if customTemplate != "" && t.yazAuth() != "" && !strings.Contains(customTemplate, "{auth}") {
+			fatal("-template-file has no {auth} for the credentials of a target", "target", t.Name)
+		}
+		if customTemplate != "" && t.Charset != "" && !strings.Contains(customTemplate, "{charset}") {
+			fatal("-template-file has no {charset} for the charset of a target", "target", t.Name)
+		}
+		if len(t.YazArgs) > 0 && (*backend != "yaz" || *batchYaz) {
+			fatal("a target with yazArgs requires -backend yaz, and can't be used with -batch-yaz, which searches every target in one yaz-client", "target", t.Name)
+		}
+	}
+	if *configCheck {
+		describeTargets(os.Stdout)
+		return
+	}
+
+	filenames, err := expandArgs(flag.Args())
+	if err != nil {
+		finishArchives()
+		fatal(err.Error())
+	}
+	if len(archives) > 0 && (*resume || *appendMode || *redoErrors || *statePath != "") {
+		finishArchives()
+		fatal("a zip archive can't be used with -resume, -append, -redo-errors or -state, as its files are extracted to a temporary directory")
+	}
+	if scheme := sinkScheme(*outPath); scheme != "" {
+		if _, ok := sinkSchemes[scheme]; !ok {
+			fatal("-out has a URL with no output sink", "out", *outPath, "scheme", scheme)
+		}
+		// Everything else written beside the output needs a local file.
+		if len(filenames) > 1 || *watchDir != "" || *resume || *appendMode || *noClobber || *statePath != "" || *errorsFile || *onlyMissing || *diffFlag || *redoErrors {
+			fatal("-out with a URL can't be used with more than one file, -watch, -resume, -append, -no-clobber, -state, -errors-file, -only-missing, -diff or -redo-errors")
+		}
+	} else if *outPath != "" {
+		*outPath, err = filepath.Abs(*outPath)
+		if err != nil {
+			fatal("unable to get absolute path of -out", "err", err)
+		}
+		info, err := os.Stat(*outPath)
+		outIsDir = err == nil && info.IsDir()
+		if !outIsDir && (len(filenames) > 1 || *watchDir != "") {
+			fatal("-out must be a directory when processing more than one file", "out", *outPath)
+		}
+	}
+	mergeAbs, _ := filepath.Abs(*mergePath)
+	for _, filename := range filenames {
+		if filename == "-" && len(filenames) > 1 {
+			fatal("stdin (-) can't be combined with other files, as their output would be interleaved on stdout")
+		}
+		if abs, _ := filepath.Abs(filename); *mergePath != "" && abs == mergeAbs {
+			fatal("-merge can't write to one of the files being processed", "file", filename)
+		}
+		if filename == "-" && *appendMode {
+			fatal("-append needs files, since their headers are read before searching")
+		}
+		if filename == "-" && *redoErrors {
+			fatal("-redo-errors needs files, since their errors files are read before searching")
+		}
+	}
+	if *appendMode && len(filenames) > 0 {
+		targets, err = missingTargets(targets, filenames)
+		if err != nil {
+			fatal(err.Error())
+		}
+		slog.Info("appending targets", "targets", targetNames(targets))
+	}
+
+	// Check to see if we have yaz-client available to us, when a target
+	// is searched with it.
+	if !*dryRun && needsYaz(targets) {
+		if _, err := exec.LookPath(*yazClient); err != nil {
+			fatal("yaz-client not found or not executable, install it or give its path with -yaz-client or YAZ_CLIENT", "path", *yazClient, "err", err)
+		}
+		out, err := execCommand(context.Background(), *yazClient, "-V").Output()
+		if err != nil {
+			fatal("unable to execute yaz-client", "path", *yazClient, "err", err)
+		}
+		slog.Debug("yaz-client -V", "version", strings.TrimSpace(string(out)))
+	}
+
+	if *check {
+		limiter = newQueryLimiter(len(targets), 0, *rate)
+		if !checkTargets(context.Background(), os.Stdout) {
+			os.Exit(exitQueryErrors)
+		}
+		return
+	}
+	if *benchFlag {
+		bench = newBenchmark()
+	}
+	if *metricsAddr != "" {
+		stats = newMetrics()
+		if err := serveMetrics(*metricsAddr, stats); err != nil {
+			fatal(err.Error())
+		}
+	}
+	if *statePath != "" {
+		state, err = loadState(*statePath)
+		if err != nil {
+			fatal(err.Error())
+		}
+	}
+	if *cachePath != "" {
+		cache, err = loadCache(*cachePath, *cacheTTL, cacheSince)
+		if err != nil {
+			fatal(err.Error())
+		}
+	} else {
+		cache = newMemoryCache()
+	}
+
+	limiter = newQueryLimiter(maxQueries(len(filenames)), *rampUp, *rate)
+
+	if *mergePath != "" && writesOutput() {
+		merged, err = newMergedOutput(*mergePath)
+		if err != nil {
+			fatal(err.Error())
+		}
+	}
+
+	// Use this to ensure all files are processed
+	// before exiting.
+	var wg sync.WaitGroup
+
+	// A context to pass to the file processing code
+	// to allow for timeouts and canceling.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *runTimeout > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeout(ctx, *runTimeout)
+		defer stop()
+	}
+
+	// trap Ctrl+C and call cancel if received,
+	// exiting immediately on a second Ctrl+C.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+	// A closed stdout fails the write, which cancels, rather than killing us.
+	signal.Ignore(syscall.SIGPIPE)
+	stdout.cancel = cancel
+	failFastStop.cancel = cancel
+	go func() {
+		select {
+		case <-sigs:
+			slog.Warn("cancelling, waiting for searches in progress to stop, press Ctrl+C again to exit immediately")
+			cancel()
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				slog.Warn("-timeout reached, waiting for searches in progress to stop", "timeout", *runTimeout)
+			}
+			return
+		}
+		<-sigs
+		slog.Error("exiting immediately, output files may be incomplete")
+		cache.sync()
+		os.Exit(exitInterrupted)
+	}()
+
+	totals = newSummary()
+	start := time.Now()
+
+	// Process each filename in the arguments.
+	var failures []fileFailure
+	if *watchDir != "" {
+		failures = watch(ctx, &wg, *watchDir)
+	} else {
+		failures = processFiles(ctx, &wg, filenames)
+		failures = retryFailures(ctx, &wg, failures)
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		totals.stopped = fmt.Sprintf("the -timeout of %v was reached", *runTimeout)
+	}
+	if stdout.broken() {
+		totals.stopped = "stdout was closed"
+	}
+	if failFastStop.stopped() {
+		totals.stopped = fmt.Sprintf("%v failed, and -fail-fast is set", failFastStop.file)
+	}
+	if merged != nil {
+		if err := merged.finish(ctx.Err() == nil); err != nil {
+			slog.Error("unable to finish the merged output", "err", err)
+			failures = append(failures, fileFailure{filename: *mergePath})
+		}
+	}
+	for _, path := range finishArchives() {
+		failures = append(failures, fileFailure{filename: path})
+	}
+	if *cachePath != "" {
+		if err := cache.save(); err != nil {
+			slog.Error("unable to save the cache", "err", err)
+		}
+	}
+	writeSummary(start)
+	if *seedCache {
+		slog.Info("seeded the cache", "file", *cachePath, "results", cache.size())
+	}
+	if bench != nil {
+		fmt.Fprintln(os.Stderr, "Benchmark:")
+		bench.write(os.Stderr, totals.rows, time.Since(start))
+	}
+	if ctx.Err() != nil && !stdout.broken() && !failFastStop.stopped() {
+		os.Exit(exitInterrupted)
+	}
+	if len(failures) > 0 {
+		names := []string{}
+		for _, f := range failures {
+			names = append(names, f.filename)
+		}
+		slog.Error("files failed", "files", strings.Join(names, ", "))
+		os.Exit(exitFileFailed)
+	}
+	if len(totals.timedOut) > 0 {
+		os.Exit(exitFileFailed)
+	}
+	if totals.errors > 0 {
+		os.Exit(exitQueryErrors)
+	}
+}
+
+// retryFailures processes files which failed before writing any rows,
+// likely because a partner was down, one more time after the
+// -retry-failed-after delay. It returns the files still failing.
+func retryFailures(ctx context.Context, wg *sync.WaitGroup, failures []fileFailure) []fileFailure {
+	retry := []string{}
+	remaining := []fileFailure{}
+	for _, f := range failures {
+		if f.written == 0 && !f.panicked && ctx.Err() == nil {
+			retry = append(retry, f.filename)
+		} else {
+			remaining = append(remaining, f)
+		}
+	}
+	if len(retry) == 0 {
+		return failures
+	}
+	if *retryFailedAfter <= 0 {
+		slog.Error("files failed before writing any rows, retry later", "files", strings.Join(retry, ", "))
+		return failures
+	}
+	slog.Warn("retrying files which failed before writing any rows", "files", len(retry), "after", *retryFailedAfter)
+	select {
+	case <-time.After(*retryFailedAfter):
+	case <-ctx.Done():
+		return failures
+	}
+	retried := processFiles(ctx, wg, retry)
+	if len(retried) > 0 {
+		slog.Error("files failed again", "files", len(retried))
+	}
+	return append(remaining, retried...)
+}
+
+// writeSummary prints the run's summary to stderr, unless -quiet is set,
+// and to the -report file.
+func writeSummary(start time.Time) {
+	elapsed := time.Since(start)
+	if !*quiet {
+		fmt.Fprintln(os.Stderr, "Summary:")
+		totals.write(os.Stderr, elapsed, useColor(os.Stderr))
+	}
+	if *reportPath == "" {
+		return
+	}
+	report, err := os.Create(*reportPath)
+	if err != nil {
+		slog.Error("unable to create report", "path", *reportPath, "err", err)
+		return
+	}
+	defer report.Close()
+	if err := totals.write(report, elapsed, false); err != nil {
+		slog.Error("unable to write report", "path", *reportPath, "err", err)
+	}
+}
+
+// defaultYazClient returns the YAZ_CLIENT environment variable,
+// or yaz-client to find it on the PATH.
+func defaultYazClient() string {
+	if path := os.Getenv("YAZ_CLIENT"); path != "" {
+		return path
+	}
+	return "yaz-client"
+}
+
+// fatal logs the error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(exitFatal)
+}
+
+// fileFailure is a file which process returned an error for.
+type fileFailure struct {
+	filename string
+	// The rows written before it failed.
+	written int
+	// Whether processing it panicked, it isn't retried if so.
+	panicked bool
+}
+
+// processRecovered runs process, turning a panic into an error after
+// logging its stack when -keep-going is set, so one bad file doesn't take
+// the run down. The goroutines process starts to search recover their
+// panics with recoverAsError, and return them as its error.
+func processRecovered(ctx context.Context, filename string) (written int, panicked bool, err error) {
+	if *keepGoing {
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("processing panicked", "file", filename, "panic", r, "stack", string(debug.Stack()))
+				panicked = true
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+	}
+	fileCtx := ctx
+	if *fileTimeout > 0 {
+		var cancel context.CancelFunc
+		fileCtx, cancel = context.WithTimeout(ctx, *fileTimeout)
+		defer cancel()
+	}
+	rows, err := process(fileCtx, filename)
+	written = len(rows)
+	var p panicError
+	if errors.As(err, &p) {
+		slog.Error("processing panicked", "file", filename, "panic", p.value, "stack", string(p.stack))
+		return written, true, p
+	}
+	if fileCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		// Searches stopped by the timeout fail, which isn't the file's fault.
+		slog.Warn("-file-timeout reached, going on to the next file", "file", filename, "timeout", *fileTimeout, "rows", written, "err", err)
+		totals.addTimedOut(filename)
+		return written, false, nil
+	}
+	return written, false, err
+}
+
+// panicError is a panic recovered by recoverAsError, with its stack.
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (p panicError) Error() string {
+	return fmt.Sprintf("panic: %v", p.value)
+}
+
+// recoverAsError is deferred by the goroutines searching for a file,
+// setting their error to a panicError when they panic with -keep-going,
+// so the file is skipped like one whose process call panicked. Without
+// -keep-going the panic exits, as it always did.
+func recoverAsError(err *error) {
+	if !*keepGoing {
+		return
+	}
+	if r := recover(); r != nil {
+		*err = panicError{value: r, stack: debug.Stack()}
+	}
+}
+
+// firstPanic returns the first of the errors which is a panicError, or nil.
+func firstPanic(errs ...error) error {
+	for _, err := range errs {
+		var p panicError
+		if errors.As(err, &p) {
+			return err
+		}
+	}
+	return nil
+}
+
+// runStopper cancels the run once a file fails, for -fail-fast, and
+// remembers which file it was.
+type runStopper struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	file   string
+}
+
+// failFastStop is set up with the run's cancel func by main.
+var failFastStop = &runStopper{}
+
+// stop cancels the run, unless another file already did.
+func (s *runStopper) stop(filename string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != "" {
+		return
+	}
+	s.file = filename
+	slog.Error("stopping the run, as -fail-fast is set", "file", filename)
+	s.cancel()
+}
+
+// stopped reports whether a file has failed and cancelled the run.
+func (s *runStopper) stopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file != ""
+}
+
+// processFiles processes the files with a pool of -jobs workers, waits
+// for them all to finish, and returns the files which failed, sorted by
+// name. Files not yet started are skipped once ctx is done.
+func processFiles(ctx context.Context, wg *sync.WaitGroup, filenames []string) []fileFailure {
+	var mu sync.Mutex
+	failed := []fileFailure{}
+
+	queue := make(chan string)
+	for i := 0; i < *jobs && i < len(filenames); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filename := range queue {
+				written, panicked, err := processRecovered(ctx, filename)
+				if err != nil && filename == "-" && stdout.broken() {
+					slog.Debug("stdout was closed", "err", err)
+					continue
+				}
+				if err != nil && failFastStop.stopped() {
+					slog.Warn("stopped, as another file failed and -fail-fast is set", "file", filename)
+					continue
+				}
+				if err != nil {
+					slog.Error("processing failed", "file", filename, "err", err)
+					mu.Lock()
+					failed = append(failed, fileFailure{filename: filename, written: written, panicked: panicked})
+					mu.Unlock()
+					if panicked {
+						totals.addPanicked(filename)
+					}
+					if *failFast {
+						failFastStop.stop(filename)
+					}
+				}
+			}
+		}()
+	}
+
+Queueing:
+	for _, filename := range filenames {
+		select {
+		case queue <- filename:
+		case <-ctx.Done():
+			break Queueing
+		}
+	}
+	close(queue)
+
+	// Wait for processing to complete.
+	wg.Wait()
+	sort.Slice(failed, func(i, j int) bool { return failed[i].filename < failed[j].filename })
+	return failed
+}
+
+// expandArgs replaces any directory arguments with the files within
+// them matching the -glob pattern, descending into subdirectories when
+// -recursive is set. Previously augmented files, with the -suffix, are skipped.
+func expandArgs(args []string) ([]string, error) {
+	filenames := []string{}
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err == nil && !info.IsDir() && isZip(arg) {
+			if _, err := os.Stat(augmentedZipPath(arg)); err == nil && *noClobber {
+				slog.Warn("output already exists, skipping", "file", arg, "output", augmentedZipPath(arg))
+				continue
+			}
+			extracted, err := extractZip(arg)
+			if err != nil {
+				return nil, err
+			}
+			filenames = append(filenames, extracted...)
+			continue
+		}
+		if err != nil || !info.IsDir() {
+			// Let process report on missing or unreadable files.
+			filenames = append(filenames, arg)
+			continue
+		}
+		err = filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if path != arg && !*recursive {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			base := filepath.Base(path)
+			// Augmented files are skipped, unless they're being appended to
+			// or searched again, and the errors, missing and diff files beside
+			// them always are.
+			if *suffix != "" && strings.Contains(base, *suffix) != (*appendMode || *redoErrors) {
+				return nil
+			}
+			if stem, _, _ := strings.Cut(base, "."); strings.HasSuffix(stem, *suffix+"_errors") || strings.HasSuffix(stem, *suffix+"_missing") || strings.HasSuffix(stem, *suffix+"_diff") {
+				return nil
+			}
+			if matched, _ := filepath.Match(*globPattern, base); matched {
+				filenames = append(filenames, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%v - unable to read directory %v", err, arg)
+		}
+	}
+	return filenames, nil
+}
+
+// searchResult is the outcome of one catalogue search.
+type searchResult struct {
+	// The number of records the catalogue reported.
+	hits int
+	// The Bib-1 diagnostic code the catalogue returned, if any.
+	diagnostic string
+	// The search term which was found, such as the other form of an ISBN.
+	matched string
+	// Whether the result came from the cache rather than the catalogue.
+	cached bool
+	// The title of the first record shown, if any were.
+	title string
+	// The fields of the records shown, as yaz line format lines.
+	records [][]string
+	// The hits needed to count as found, see target.minHits.
+	threshold int
+}
+
+func (r searchResult) found() bool {
+	return r.hits > 0 && r.hits >= r.threshold
+}
+
+// diagCode returns the DIAG column code for the result, given the code
+// from any earlier searches against the same catalogue for the record.
+// A hit always wins, and the first diagnostic is kept over a miss.
+func (r searchResult) diagCode(previous string) string {
+	switch {
+	case r.found():
+		return "hit:" + strconv.Itoa(r.hits)
+	case r.diagnostic != "" && previous == "miss":
+		return "diag:" + r.diagnostic
+	default:
+		return previous
+	}
+}
+
+// err returns a diagnosticError for a search which the catalogue
+// answered with a diagnostic rather than any records, since that
+// usually means the query is broken, not that nothing matched.
+func (r searchResult) err() error {
+	if r.diagnostic == "" || r.found() {
+		return nil
+	}
+	return diagnosticError{code: r.diagnostic}
+}
+
+// defaultHitsPattern matches yaz-client's line such as "Number of hits:
+// 12, setno 1", however it's phrased after, capturing the first number.
+const defaultHitsPattern = `^Number of hits:\D*(\d*)`
+
+// hitsLine is the compiled -hits-pattern.
+var hitsLine = regexp.MustCompile(defaultHitsPattern)
+
+// hitCount reports whether a line of yaz-client output is a search's hits
+// line, matching hitsLine, and the count its group captured, if it did.
+func hitCount(line string) (hits int, isHits bool, counted bool) {
+	match := hitsLine.FindStringSubmatch(line)
+	if match == nil {
+		return 0, false, false
+	}
+	count, err := strconv.Atoi(match[1])
+	return count, true, err == nil
+}
+
+// diagnosticCode extracts the code from a yaz diagnostic
+// line such as "    [114] Unsupported Use attribute".
+func diagnosticCode(line string) string {
+	line = strings.TrimSpace(line)
+	end := strings.Index(line, "]")
+	if !strings.HasPrefix(line, "[") || end < 2 {
+		return ""
+	}
+	return line[1:end]
+}
+
+// marcField reports whether a line of yaz-client output is a field of a
+// record shown in the line format, like "852 01 $b MAIN".
+func marcField(line string) bool {
+	return len(line) > 4 && line[3] == ' ' && allDigits(line[:3])
+}
+
+// marcTitle returns the title and remainder of title subfields from a
+// yaz line format 245 field, such as "245 10 $a The cat /$c by me.".
+func marcTitle(line string) string {
+	parts := []string{}
+	for _, subfield := range strings.Split(line, "$")[1:] {
+		if len(subfield) > 1 && (subfield[0] == 'a' || subfield[0] == 'b') {
+			parts = append(parts, strings.TrimSpace(subfield[1:]))
+		}
+	}
+	return strings.TrimRight(strings.Join(parts, " "), " /:;,.=")
+}
+
+// searchTargets concurrently searches each target which hasn't found the
+// record yet, adding the results. Searches which fail are logged and
+// recorded as errors, unless the context is done. It returns the longest
+// delay of the targets searched, which the caller should pause for.
+func searchTargets(ctx context.Context, results []targetResult, ap accessPoint, term string) (time.Duration, error) {
+	searched := make([]bool, len(targets))
+	found := make([]searchResult, len(targets))
+	errs := make([]error, len(targets))
+	took := make([]time.Duration, len(targets))
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		if results[i].found && !(*allMatchedISBNs && ap.name == isbnAccess.name) {
+			continue
+		}
+		searched[i] = true
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			defer recoverAsError(&errs[i])
+			start := time.Now()
+			found[i], errs[i] = query(ctx, t, ap, term)
+			took[i] = time.Since(start)
+		}(i, t)
+	}
+	wg.Wait()
+	if err := firstPanic(errs...); err != nil {
+		return 0, err
+	}
+
+	pause := time.Duration(0)
+	for i, t := range targets {
+		if !searched[i] {
+			continue
+		}
+		results[i].elapsed += took[i]
+		if errs[i] != nil {
+			err := fmt.Errorf("%v - unable to search %v for %v %q", errs[i], t.Name, ap.name, term)
+			if ctx.Err() != nil {
+				return pause, err
+			}
+			// Carry on with the other records, flagging this one.
+			logger(withTarget(ctx, t)).Warn("search failed", "err", err)
+			results[i].fail(ap, term, errs[i])
+			continue
+		}
+		results[i].add(ap, term, found[i])
+		if !found[i].cached && t.delay() > pause {
+			pause = t.delay()
+		}
+		logger(withTarget(ctx, t)).Debug("result", "target", t.Name, "accessPoint", ap.name, "term", term, "found", found[i].found(), "cached", found[i].cached)
+	}
+	return pause, nil
+}
+
+// searchISBNs concurrently searches each target which hasn't found the
+// record yet for the ISBNs, up to -parallel-isbns at a time, cancelling
+// a target's other searches once one of them finds the record. Results
+// are added in the order of the ISBNs. Like searchTargets, failures are
+// recorded as errors unless the context is done, and it returns the
+// longest delay of the targets searched.
+func searchISBNs(ctx context.Context, results []targetResult, isbns []string) (time.Duration, error) {
+	found := make([][]searchResult, len(targets))
+	errs := make([][]error, len(targets))
+	searched := make([]bool, len(targets))
+	took := make([]time.Duration, len(targets))
+	// Those of the targets' goroutines, apart from their searches'.
+	panics := make([]error, len(targets))
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		if results[i].found && !*allMatchedISBNs {
+			continue
+		}
+		searched[i] = true
+		found[i] = make([]searchResult, len(isbns))
+		errs[i] = make([]error, len(isbns))
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			defer recoverAsError(&panics[i])
+			start := time.Now()
+			defer func() { took[i] = time.Since(start) }()
+			targetCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			slots := make(chan struct{}, *parallelISBNs)
+			var isbnWG sync.WaitGroup
+			for j, isbn := range isbns {
+				select {
+				case slots <- struct{}{}:
+				case <-targetCtx.Done():
+				}
+				if targetCtx.Err() != nil {
+					break
+				}
+				isbnWG.Add(1)
+				go func(j int, isbn string) {
+					defer isbnWG.Done()
+					defer func() { <-slots }()
+					defer recoverAsError(&errs[i][j])
+					found[i][j], errs[i][j] = query(targetCtx, t, isbnAccess, isbn)
+					if errs[i][j] == nil && found[i][j].found() && !*allMatchedISBNs {
+						cancel()
+					}
+				}(j, isbn)
+			}
+			isbnWG.Wait()
+		}(i, t)
+	}
+	wg.Wait()
+	if err := firstPanic(panics...); err != nil {
+		return 0, err
+	}
+	for i := range errs {
+		if err := firstPanic(errs[i]...); err != nil {
+			return 0, err
+		}
+	}
+
+	pause := time.Duration(0)
+	for i, t := range targets {
+		if !searched[i] {
+			continue
+		}
+		results[i].elapsed += took[i]
+		uncached := false
+		for j, isbn := range isbns {
+			if results[i].found && !*allMatchedISBNs {
+				break
+			}
+			if errs[i][j] != nil {
+				err := fmt.Errorf("%v - unable to search %v for isbn %q", errs[i][j], t.Name, isbn)
+				if ctx.Err() != nil {
+					return pause, err
+				}
+				if errors.Is(errs[i][j], context.Canceled) {
+					// Stopped since another ISBN was found.
+					continue
+				}
+				logger(withTarget(ctx, t)).Warn("search failed", "err", err)
+				results[i].fail(isbnAccess, isbn, errs[i][j])
+				continue
+			}
+			results[i].add(isbnAccess, isbn, found[i][j])
+			uncached = uncached || !found[i][j].cached
+			logger(withTarget(ctx, t)).Debug("result", "target", t.Name, "accessPoint", isbnAccess.name, "term", isbn, "found", found[i][j].found(), "cached", found[i][j].cached)
+		}
+		if uncached && t.delay() > pause {
+			pause = t.delay()
+		}
+	}
+	return pause, nil
+}
+
+// searchAnyISBN searches each target which hasn't found the record yet
+// for any of the ISBNs, in both forms, with one query. A hit is credited
+// to the first ISBN, since the catalogue doesn't say which one matched.
+// Otherwise it works like searchTargets.
+func searchAnyISBN(ctx context.Context, results []targetResult, isbns []string) (time.Duration, error) {
+	terms := []string{}
+	for _, isbn := range isbns {
+		terms = append(terms, isbnVariants(isbn)...)
+	}
+	term := strings.Join(isbns, ", ")
+
+	searched := make([]bool, len(targets))
+	found := make([]searchResult, len(targets))
+	errs := make([]error, len(targets))
+	took := make([]time.Duration, len(targets))
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		if results[i].found {
+			continue
+		}
+		searched[i] = true
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			defer recoverAsError(&errs[i])
+			start := time.Now()
+			found[i], errs[i] = queryOr(ctx, t, isbnAccess, terms)
+			took[i] = time.Since(start)
+		}(i, t)
+	}
+	wg.Wait()
+	if err := firstPanic(errs...); err != nil {
+		return 0, err
+	}
+
+	pause := time.Duration(0)
+	for i, t := range targets {
+		if !searched[i] {
+			continue
+		}
+		results[i].elapsed += took[i]
+		if errs[i] != nil {
+			err := fmt.Errorf("%v - unable to search %v for isbns %q", errs[i], t.Name, term)
+			if ctx.Err() != nil {
+				return pause, err
+			}
+			logger(withTarget(ctx, t)).Warn("search failed", "err", err)
+			results[i].fail(isbnAccess, term, errs[i])
+			continue
+		}
+		results[i].add(isbnAccess, isbns[0], found[i])
+		if !found[i].cached && t.delay() > pause {
+			pause = t.delay()
+		}
+		logger(withTarget(ctx, t)).Debug("result", "target", t.Name, "accessPoint", isbnAccess.name, "terms", term, "found", found[i].found(), "cached", found[i].cached)
+	}
+	return pause, nil
+}
+
+// queryOr is the equivalent of query for a search for any of the terms.
+// Terms cached as found are used without a search, and since a miss
+// means none of the terms were found, each is cached as a miss.
+func queryOr(ctx context.Context, t target, ap accessPoint, terms []string) (searchResult, error) {
+	ctx = withTarget(ctx, t)
+	if cache != nil {
+		misses := 0
+		for _, term := range terms {
+			if result, ok := cache.get(t.Name, ap.cacheKey(term)); ok {
+				result.threshold = t.minHits()
+				if result.found() {
+					bench.search(true)
+					return result, nil
+				}
+				misses++
+			}
+		}
+		if misses == len(terms) {
+			bench.search(true)
+			return searchResult{cached: true}, nil
+		}
+	}
+
+	var result searchResult
+	err := withRetries(ctx, fmt.Sprintf("%v search of %v", ap.name, t.Name), func() error {
+		if err := limiter.acquireFor(ctx, t); err != nil {
+			return err
+		}
+		defer limiter.release()
+
+		ctx, cancel := queryContext(ctx)
+		defer cancel()
+
+		start := time.Now()
+		var err error
+		switch {
+		case t.Protocol == "sru":
+			result, err = sruSearchOr(ctx, terms, t, ap)
+		case t.Protocol == "worldcat":
+			result, err = worldcatSearchOr(ctx, terms, t, ap)
+		case *backend == "native":
+			result, err = z3950SearchNativeOr(ctx, terms, t, t.withAttributes(ap).attributes)
+		default:
+			result, err = z3950SearchOr(ctx, terms, t, ap)
+		}
+		result.threshold = t.minHits()
+		if err == nil {
+			err = result.err()
+		}
+		if err == nil {
+			result, err = checkFound(ctx, t, t.withAttributes(ap).pqfOr(terms), result)
+		}
+		observeQuery(t.Name, time.Since(start), result, err)
+		return err
+	})
+	if err == nil && cache != nil && !result.found() {
+		for _, term := range terms {
+			cache.put(t.Name, ap.cacheKey(term), result)
+		}
+	}
+	bench.search(false)
+	return result, err
+}
+
+// fetchTitles fetches the title of the first record found by each target
+// which found the record, searching again by the term which matched. A
+// failed fetch is logged and leaves the title blank, unless the context
+// is done.
+func fetchTitles(ctx context.Context, results []targetResult, title string) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(targets))
+	for i, t := range targets {
+		if !results[i].found {
+			continue
+		}
+		ap, term := matchedSearch(results[i], title)
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			defer recoverAsError(&errs[i])
+			results[i].matchedTitle, errs[i] = queryTitle(ctx, t, ap, term)
+		}(i, t)
+	}
+	wg.Wait()
+	if err := firstPanic(errs...); err != nil {
+		return err
+	}
+
+	for i, t := range targets {
+		if errs[i] == nil {
+			continue
+		}
+		err := fmt.Errorf("%v - unable to fetch the title of a record %v holds", errs[i], t.Name)
+		if ctx.Err() != nil {
+			return err
+		}
+		logger(withTarget(ctx, t)).Warn("title fetch failed", "err", err)
+	}
+	return nil
+}
+
+// matchedSearch returns the access point and term of the search by which
+// the target found the record, to search by again.
+func matchedSearch(result targetResult, title string) (accessPoint, string) {
+	switch result.accessPoint {
+	case isbnAccess.name:
+		return isbnAccess, result.isbn
+	case oclcAccess.name:
+		return oclcAccess, result.oclc
+	case lccnAccess.name:
+		return lccnAccess, result.lccn
+	case ismnAccess.name:
+		return ismnAccess, result.ismn
+	}
+	return titleAccess, titleTerm(title)
+}
+
+// queryTitle searches the target again with yaz-client, showing the first
+// record to return its title. Titles aren't cached.
+func queryTitle(ctx context.Context, t target, ap accessPoint, term string) (string, error) {
+	ctx = withTarget(ctx, t)
+	query := t.withAttributes(ap).pqf() + " \"" + pqfTerm(term) + "\""
+
+	var title string
+	err := withRetries(ctx, fmt.Sprintf("title fetch from %v", t.Name), func() error {
+		if err := limiter.acquireFor(ctx, t); err != nil {
+			return err
+		}
+		defer limiter.release()
+
+		ctx, cancel := queryContext(ctx)
+		defer cancel()
+
+		start := time.Now()
+		results, err := runYaz(ctx, t.YazArgs, t.yazScript(query, "format usmarc", "show 1"))
+		if err != nil {
+			observeQuery(t.Name, time.Since(start), searchResult{}, err)
+			return err
+		}
+		observeQuery(t.Name, time.Since(start), searchResult{}, nil)
+		if len(results) == 0 {
+			return errNoResults
+		}
+		title = results[0].title
+		return nil
+	})
+	return title, err
+}
+
+// queryBatch runs a batched catalogue search once the shared limiter
+// allows it, retrying transient failures.
+func queryBatch(ctx context.Context, isbns []string, templates ...string) ([][]searchResult, error) {
+	var batch [][]searchResult
+	err := withRetries(ctx, "batched search", func() error {
+		if err := limiter.acquireFor(ctx, targets...); err != nil {
+			return err
+		}
+		defer limiter.release()
+
+		ctx, cancel := queryContext(ctx)
+		defer cancel()
+		start := time.Now()
+		var err error
+		batch, err = z3950Batch(ctx, isbns, templates...)
+		// The targets were searched together, so share the time.
+		took := time.Since(start)
+		for i, t := range targets {
+			result := searchResult{threshold: t.minHits()}
+			if err == nil && i < len(batch) {
+				for _, r := range batch[i] {
+					if r.hits > result.hits {
+						result.hits = r.hits
+					}
+				}
+			}
+			observeQuery(t.Name, took, result, err)
+		}
+		return err
+	})
+	return batch, err
+}
+
+// queryContext applies the -query-timeout to a single query.
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *queryTimeout > 0 {
+		return context.WithTimeout(ctx, *queryTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// needsYaz reports whether any of the targets is searched by running
+// yaz-client, rather than over HTTP or by the native client, which need
+// nothing installed.
+func needsYaz(targets []target) bool {
+	if *backend != "yaz" {
+		return false
+	}
+	for _, t := range targets {
+		if !t.overHTTP() {
+			return true
+		}
+	}
+	return false
+}
+
+// query runs a catalogue search with the selected backend once the
+// shared limiter allows it, unless the result is already cached.
+// ISBNs are searched in both their ISBN-10 and ISBN-13 forms, and
+// transient failures are retried.
+func query(ctx context.Context, t target, ap accessPoint, term string) (searchResult, error) {
+	ctx = withTarget(ctx, t)
+	terms := []string{term}
+	if ap.name == isbnAccess.name {
+		terms = isbnVariants(term)
+	}
+
+	key := ap.cacheKey(term)
+	if cache != nil {
+		// Each form of an ISBN was searched for in both forms.
+		for _, variant := range terms {
+			if result, ok := cache.get(t.Name, ap.cacheKey(variant)); ok {
+				result.threshold = t.minHits()
+				bench.search(true)
+				return result, nil
+			}
+		}
+	}
+
+	// Identical searches in progress at once share one query, with
+	// both forms of an ISBN counted as the same search.
+	flightKey := key
+	if _, isbn13 := isbnForms(term); ap.name == isbnAccess.name && isbn13 != "" {
+		flightKey = isbn13
+	}
+	result, err := searches.do(ctx, cacheKey(t.Name, flightKey), func() (searchResult, error) {
+		return queryUncached(ctx, t, ap, terms, key)
+	})
+	bench.search(err == nil && result.cached)
+	return result, err
+}
+
+// queryUncached is query after the cache lookup, caching the result.
+func queryUncached(ctx context.Context, t target, ap accessPoint, terms []string, key string) (searchResult, error) {
+	var result searchResult
+	logger(ctx).Debug("querying", "accessPoint", ap.name, "terms", strings.Join(terms, ", "))
+	err := withRetries(ctx, fmt.Sprintf("%v search of %v", ap.name, t.Name), func() error {
+		if err := limiter.acquireFor(ctx, t); err != nil {
+			return err
+		}
+		defer limiter.release()
+
+		ctx, cancel := queryContext(ctx)
+		defer cancel()
+
+		start := time.Now()
+		var err error
+		switch {
+		case t.Protocol == "sru":
+			result, err = sruSearch(ctx, terms, t, ap)
+		case t.Protocol == "worldcat":
+			result, err = worldcatSearch(ctx, terms, t, ap)
+		case *backend == "native":
+			result, err = z3950SearchNative(ctx, terms, t, t.withAttributes(ap))
+		case ap.and != nil:
+			result, err = z3950SearchAnd(ctx, terms[0], t, t.withAttributes(ap))
+		default:
+			result, err = z3950Search(ctx, terms, t.YazArgs, t.yazTemplate(ap), t.minHits())
+		}
+		if err == nil {
+			err = result.err()
+		}
+		if err == nil {
+			term := result.matched
+			if term == "" {
+				term = terms[0]
+			}
+			result, err = checkFound(ctx, t, t.withAttributes(ap).pqfQuery(term), result)
+		}
+		observeQuery(t.Name, time.Since(start), result, err)
+		return err
+	})
+	if err == nil && cache != nil {
+		cache.put(t.Name, key, result)
+	}
+	return result, err
+}
+
+// z3950Search searches for each term in turn with yaz-client, run with
+// args, stopping at the first which the catalogue holds, with at least
+// minHits.
+func z3950Search(ctx context.Context, terms []string, args []string, template string, minHits int) (searchResult, error) {
+	found := searchResult{threshold: minHits}
+	for _, term := range terms {
+		results, err := runYaz(ctx, args, fmt.Sprintf(template, pqfTerm(term)))
+		if err != nil {
+			return found, err
+		}
+		if len(results) == 0 {
+			return found, errNoResults
+		}
+		for _, result := range results {
+			if result.hits > found.hits {
+				found.hits = result.hits
+				found.matched = term
+			}
+			if found.diagnostic == "" {
+				found.diagnostic = result.diagnostic
+			}
+		}
+		if found.found() {
+			break
+		}
+	}
+	return found, nil
+}
+
+// z3950SearchAnd searches with yaz-client by an access point which
+// ANDs two searches, like titleAuthorAccess, in a single find.
+func z3950SearchAnd(ctx context.Context, term string, t target, ap accessPoint) (searchResult, error) {
+	results, err := runYaz(ctx, t.YazArgs, t.yazScript(ap.pqfQuery(term)))
+	if err != nil {
+		return searchResult{}, err
+	}
+	if len(results) == 0 {
+		return searchResult{}, errNoResults
+	}
+	result := results[0]
+	result.threshold = t.minHits()
+	if result.found() {
+		result.matched = term
+	}
+	return result, nil
+}
+
+// z3950SearchOr searches for any of the terms with a single
+// yaz-client find, ORing them together.
+func z3950SearchOr(ctx context.Context, terms []string, t target, ap accessPoint) (searchResult, error) {
+	results, err := runYaz(ctx, t.YazArgs, t.yazScript(t.withAttributes(ap).pqfOr(terms)))
+	if err != nil {
+		return searchResult{}, err
+	}
+	if len(results) == 0 {
+		return searchResult{}, errNoResults
+	}
+	return results[0], nil
+}
+
+// z3950Batch runs every ISBN against every template in a single yaz-client
+// session, returning the results indexed by template then ISBN.
+func z3950Batch(ctx context.Context, isbns []string, templates ...string) ([][]searchResult, error) {
+	script := batchScript(isbns, templates...)
+	slog.Debug("batched yaz script", "script", script)
+
+	results, err := runYaz(ctx, nil, script)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != len(isbns)*len(templates) {
+		return nil, fmt.Errorf("batched yaz session reported %v results for %v searches", len(results), len(isbns)*len(templates))
+	}
+
+	batch := [][]searchResult{}
+	for i := range templates {
+		batch = append(batch, results[i*len(isbns):(i+1)*len(isbns)])
+	}
+	return batch, nil
+}
+
+// batchScript combines the templates into one yaz command script, repeating
+// each template's find command once per ISBN within that target's session.
+func batchScript(isbns []string, templates ...string) string {
+	var script strings.Builder
+	for _, template := range templates {
+		for _, line := range strings.SplitAfter(template, "\n") {
+			switch strings.TrimSpace(line) {
+			case "", "close", "quit":
+				continue
+			}
+			if !strings.Contains(line, "%v") {
+				script.WriteString(line)
+				continue
+			}
+			for _, isbn := range isbns {
+				fmt.Fprintf(&script, line, isbn)
+			}
+		}
+		script.WriteString("close\n")
+	}
+	script.WriteString("quit\n")
+	return script.String()
+}
+
+// pqfTerm escapes a search term for use inside a quoted PQF term.
+func pqfTerm(term string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(term)
+}
+
+// yazCommandFile writes the command script to a temporary file
+// for yaz-client's -f, returning its path.
+func yazCommandFile(script string) (string, error) {
+	cmdFile, err := ioutil.TempFile(*tmpDir, "well-connected-gardener-yaz-command.*.txt")
+	if err != nil {
+		slog.Error("unable to create new temporary command file", "err", err)
+		return "", err
+	}
+
+	slog.Debug("created temp command file", "path", cmdFile.Name())
+
+	_, err = cmdFile.WriteString(script)
+	if err == nil {
+		err = cmdFile.Sync()
+	}
+	if closeErr := cmdFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		slog.Error("unable to write to temporary command file", "err", err)
+		os.Remove(cmdFile.Name())
+		return "", err
+	}
+	return cmdFile.Name(), nil
+}
+
+// runYaz runs a yaz-client command script, returning a result for
+// each hits line, like "Number of hits:", in its output, in order. The
+// yaz-client process is killed if the context is done before it finishes.
+func runYaz(ctx context.Context, args []string, script string) ([]searchResult, error) {
+
+	results := []searchResult{}
+
+	// yaz-client reads commands from stdin when it isn't a terminal.
+	cmd := execCommand(ctx, *yazClient, args...)
+	cmd.Stdin = strings.NewReader(script)
+	if *yazScriptFile {
+		cmdFile, err := yazCommandFile(script)
+		if err != nil {
+			return results, err
+		}
+		defer os.Remove(cmdFile)
+		cmd = execCommand(ctx, *yazClient, append(append([]string{}, args...), "-f", cmdFile)...)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		logger(ctx).Error("unable to create new StdoutPipe", "err", err)
+		return results, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		logger(ctx).Error("error starting exec'd process", "err", err)
+		return results, err
+	}
+
+	// Read in a goroutine, so that a slow target can't keep us
+	// reading after the context is done. Lines are read whole however
+	// long they are, like those of a record with many fields, rather
+	// than with a bufio.Scanner, which fails on lines over 64KB.
+	lines := make(chan string)
+	scanned := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(stdout)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				select {
+				case lines <- strings.TrimRight(line, "\r\n"):
+				case <-ctx.Done():
+					scanned <- ctx.Err()
+					return
+				}
+			}
+			if err == io.EOF {
+				scanned <- nil
+				return
+			}
+			if err != nil {
+				scanned <- err
+				return
+			}
+		}
+	}()
+
+	inDiagnostics := false
+	for {
+		var line string
+		var ok bool
+		select {
+		case line, ok = <-lines:
+		case <-ctx.Done():
+			cmd.Process.Kill()
+			cmd.Wait()
+			return results, fmt.Errorf("yaz-client search stopped: %w", ctx.Err())
+		}
+		if !ok {
+			break
+		}
+		if hits, isHits, counted := hitCount(line); isHits {
+			result := searchResult{hits: hits}
+			if !counted {
+				// Cut off before the count, which isn't taken to be 0.
+				logger(ctx).Debug("ignoring hits line without a count", "line", line)
+				continue
+			}
+			results = append(results, result)
+			inDiagnostics = false
+			continue
+		}
+		if strings.Contains(line, "Record type:") && len(results) > 0 {
+			// Each record shown starts with its database and type.
+			last := &results[len(results)-1]
+			last.records = append(last.records, []string{})
+			continue
+		}
+		if marcField(line) && len(results) > 0 {
+			last := &results[len(results)-1]
+			if len(last.records) == 0 {
+				last.records = append(last.records, []string{})
+			}
+			last.records[len(last.records)-1] = append(last.records[len(last.records)-1], line)
+		}
+		if strings.HasPrefix(line, "245 ") && len(results) > 0 && results[len(results)-1].title == "" {
+			results[len(results)-1].title = marcTitle(line)
+			continue
+		}
+		if strings.HasPrefix(line, "Diagnostic message") {
+			inDiagnostics = true
+			continue
+		}
+		// Diagnostics follow the hits line of the search they belong to,
+		// though a refused first search may not have one.
+		if inDiagnostics && len(results) == 0 {
+			if code := diagnosticCode(line); code != "" {
+				results = append(results, searchResult{diagnostic: code})
+			}
+			continue
+		}
+		if inDiagnostics && len(results) > 0 && results[len(results)-1].diagnostic == "" {
+			results[len(results)-1].diagnostic = diagnosticCode(line)
+		}
+	}
+	err = <-scanned
+	if err != nil && ctx.Err() == nil {
+		logger(ctx).Error("error scanning from exec'd process", "err", err)
+		return results, err
+	}
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return results, fmt.Errorf("yaz-client search stopped: %w", ctx.Err())
+	}
+	if err != nil {
+		logger(ctx).Warn("error waiting for exec'd command to complete", "err", err)
+		return results, err
+	}
+	if searches := findCommands(script); len(results) < searches {
+		return results, fmt.Errorf("%w, %v of %v searches reported", errIncompleteSession, len(results), searches)
+	}
+
+	return results, nil
+}
+
+// findCommands returns the number of searches a yaz-client script runs.
+func findCommands(script string) int {
+	finds := 0
+	for _, line := range strings.Split(script, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "find ") {
+			finds++
+		}
+	}
+	return finds
+}
+
+// recommendation maps the number of partners holding a title
+// to a weeding recommendation label.
+func recommendation(held int) string {
+	switch {
+	case held >= *discardThreshold:
+		return *discardLabel
+	case held >= *reviewThreshold:
+		return *reviewLabel
+	default:
+		return *keepLabel
+	}
+}
+
+// authorTerm returns the author's surname, the first part of a heading
+// like "Smith, John, 1950-", for searching with the title.
+func authorTerm(author string) string {
+	surname, _, _ := strings.Cut(author, ",")
+	return strings.TrimSpace(strings.TrimRight(strings.TrimSpace(surname), " :;,."))
+}
+
+// titleTerm returns the title proper, dropping the statement of
+// responsibility and trailing punctuation, for use as a search term.
+func titleTerm(title string) string {
+	firstPart := strings.TrimSpace(strings.Split(title, "/")[0])
+	return strings.TrimSpace(strings.TrimRight(firstPart, " :;,."))
+}
+
+// urlReadyTitle returns the title escaped for a search link, as the
+// title proper without any leading article. Query escaping leaves no
+// tab, quote or line break in the link, so its cell is never quoted,
+// and a % or & in the title is escaped rather than read as an escape
+// or the start of another parameter.
+func urlReadyTitle(title string) string {
+	if *rawLinkTitle {
+		firstPart := strings.TrimSpace(strings.Split(title, "/")[0])
+		return url.QueryEscape(firstPart)
+	}
+	return url.QueryEscape(canonicalTitle(title))
+}
+
+// canonicalTitle reduces a 245 title to the title proper, ending it at
+// the first ISBD separator before a subtitle, parallel title or statement
+// of responsibility, then dropping a leading article and extra spaces.
+func canonicalTitle(title string) string {
+	if i := strings.IndexAny(title, "/:;="); i >= 0 {
+		title = title[:i]
+	}
+	words := strings.Fields(strings.TrimRight(strings.TrimSpace(title), " .,"))
+	if len(words) > 1 {
+		switch strings.ToLower(words[0]) {
+		case "the", "a", "an":
+			words = words[1:]
+		}
+	}
+	return strings.Join(words, " ")
 }
@@ -0,0 +1,819 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeYaz replaces execCommand with one which runs this test binary as
+// yaz-client, printing the transcript to stdout and exiting with the
+// status. The scripts and arguments it's run with are appended to the
+// returned log file, each script followed by a line of ---.
+func fakeYaz(t *testing.T, transcript string, status int) string {
+	t.Helper()
+	dir := t.TempDir()
+	log := dir + "/yaz.log"
+	// In a file, as it may be longer than an environment variable can be.
+	transcriptFile := dir + "/transcript"
+	if err := os.WriteFile(transcriptFile, []byte(transcript), 0666); err != nil {
+		t.Fatal(err)
+	}
+	previous := execCommand
+	t.Cleanup(func() { execCommand = previous })
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, os.Args[0], append([]string{"-test.run=^TestHelperYazClient$", "--"}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"FAKE_YAZ=1",
+			"FAKE_YAZ_TRANSCRIPT="+transcriptFile,
+			"FAKE_YAZ_STATUS="+strconv.Itoa(status),
+			"FAKE_YAZ_LOG="+log,
+			// Built with -race, it would otherwise wait a second to exit.
+			"GORACE=atexit_sleep_ms=0",
+		)
+		return cmd
+	}
+	return log
+}
+
+// TestHelperYazClient is the fake yaz-client run by fakeYaz, not a test.
+func TestHelperYazClient(t *testing.T) {
+	if os.Getenv("FAKE_YAZ") != "1" {
+		return
+	}
+	script, _ := io.ReadAll(os.Stdin)
+	args := []string{}
+	for i, arg := range os.Args {
+		if arg == "--" {
+			args = os.Args[i+1:]
+			break
+		}
+	}
+	if log, err := os.OpenFile(os.Getenv("FAKE_YAZ_LOG"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666); err == nil {
+		fmt.Fprintf(log, "args: %v\n%s---\n", strings.Join(args, " "), script)
+		log.Close()
+	}
+	transcript, _ := os.ReadFile(os.Getenv("FAKE_YAZ_TRANSCRIPT"))
+	os.Stdout.Write(transcript)
+	status, _ := strconv.Atoi(os.Getenv("FAKE_YAZ_STATUS"))
+	os.Exit(status)
+}
+
+// setFlag sets a command line flag for the test, restoring it after.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("no flag -%v", name)
+	}
+	previous := f.Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("unable to set -%v to %q: %v", name, value, err)
+	}
+	t.Cleanup(func() { flag.Set(name, previous) })
+}
+
+// Transcripts of a yaz-client session searching once.
+const (
+	zeroHits = "Connecting...OK.\nSent searchRequest.\nReceived SearchResponse.\nSearch was a success.\nNumber of hits: 0, setno 1\n"
+	manyHits = "Connecting...OK.\nSent searchRequest.\nReceived SearchResponse.\nSearch was a success.\nNumber of hits: 12, setno 1\nrecords returned: 0\n"
+	// A session which fell over before reporting the search.
+	malformed = "Connecting...OK.\nSent searchRequest.\nNumber of h@#!~ garbled\nConnection closed by peer\n"
+)
+
+func TestRunYaz(t *testing.T) {
+	tests := []struct {
+		name       string
+		transcript string
+		status     int
+		hits       int
+		err        error
+		failed     bool
+	}{
+		{name: "zero hits", transcript: zeroHits, hits: 0},
+		{name: "multiple hits", transcript: manyHits, hits: 12},
+		{name: "malformed output", transcript: malformed, err: errIncompleteSession},
+		{name: "process failure", transcript: "yaz-client: unable to connect\n", status: 1, failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeYaz(t, tt.transcript, tt.status)
+			results, err := runYaz(context.Background(), nil, "open host:210\nfind @attr 1=7 \"0306406152\"\nclose\nquit\n")
+			switch {
+			case tt.err != nil:
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("runYaz error = %v, want %v", err, tt.err)
+				}
+				return
+			case tt.failed:
+				if err == nil {
+					t.Fatalf("runYaz gave results %+v for a failed yaz-client, want an error", results)
+				}
+				return
+			case err != nil:
+				t.Fatalf("runYaz error = %v", err)
+			}
+			if len(results) != 1 || results[0].hits != tt.hits {
+				t.Fatalf("runYaz results = %+v, want one with %v hits", results, tt.hits)
+			}
+		})
+	}
+}
+
+func TestZ3950Search(t *testing.T) {
+	target := target{Name: "T", Host: "host:210"}
+	terms := []string{"0306406152", "9780306406157"}
+	tests := []struct {
+		name       string
+		transcript string
+		status     int
+		found      bool
+		matched    string
+		searches   int
+		failed     bool
+	}{
+		// Nothing found by the first term, so the second is searched too.
+		{name: "zero hits", transcript: zeroHits, searches: 2},
+		{name: "multiple hits", transcript: manyHits, found: true, matched: "0306406152", searches: 1},
+		{name: "malformed output", transcript: malformed, failed: true, searches: 1},
+		{name: "process failure", transcript: "", status: 1, failed: true, searches: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := fakeYaz(t, tt.transcript, tt.status)
+			result, err := z3950Search(context.Background(), terms, nil, target.yazTemplate(isbnAccess), target.minHits())
+			if tt.failed != (err != nil) {
+				t.Fatalf("z3950Search error = %v, want failed %v", err, tt.failed)
+			}
+			if !tt.failed && (result.found() != tt.found || result.matched != tt.matched) {
+				t.Errorf("z3950Search = %+v, want found %v matching %q", result, tt.found, tt.matched)
+			}
+			sent, _ := os.ReadFile(log)
+			if searches := strings.Count(string(sent), "\nfind "); searches != tt.searches {
+				t.Errorf("yaz-client ran %v searches, want %v:\n%s", searches, tt.searches, sent)
+			}
+		})
+	}
+}
+
+// useTargets sets up the globals main does for a run searching the
+// targets without pausing between searches or logging, restoring them
+// after.
+func useTargets(t *testing.T, ts ...target) {
+	t.Helper()
+	previousTargets, previousHeaderMap := targets, headerMap
+	previousCache, previousLimiter, previousTotals := cache, limiter, totals
+	previousLogger := slog.Default()
+	t.Cleanup(func() {
+		targets, headerMap = previousTargets, previousHeaderMap
+		cache, limiter, totals = previousCache, previousLimiter, previousTotals
+		slog.SetDefault(previousLogger)
+	})
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	setFlag(t, "delay", "0")
+	targets = ts
+	headerMap = map[string]string{}
+	cache = newMemoryCache()
+	limiter = newQueryLimiter(len(ts), 0, 0)
+	totals = newSummary()
+}
+
+// processInput processes the input as a file, returning its augmented
+// output and the results of the rows written.
+func processInput(t *testing.T, input string) (string, []rowResult, error) {
+	t.Helper()
+	filename := t.TempDir() + "/input.tsv"
+	if err := os.WriteFile(filename, []byte(input), 0666); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := process(context.Background(), filename)
+	output, _ := os.ReadFile(outputPath(filename))
+	return string(output), rows, err
+}
+
+func TestProcessAliasedHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		isbnField  string
+		header     string
+		wantHeader string
+	}{
+		{name: "mixed case", header: "Title\t020|A", wantHeader: "Title\t020|A"},
+		{name: "padded", header: " TITLE \t 020|a ", wantHeader: "\" TITLE \"\t\" 020|a \""},
+		{name: "alternate label", isbnField: "isbn,020|a", header: "Title\tISBN ", wantHeader: "Title\tISBN "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.isbnField != "" {
+				setFlag(t, "isbn-field", tt.isbnField)
+			}
+			fakeYaz(t, manyHits, 0)
+			useTargets(t, target{Name: "T", Host: "host:210", FoundURLTemplate: "https://t.example/search?q={isbn}"})
+			output, _, err := processInput(t, tt.header+"\nA book\t0306406152\n")
+			if err != nil {
+				t.Fatalf("process error = %v", err)
+			}
+			// The labels are written as they were, not as they're matched.
+			want := tt.wantHeader + "\tFOUND IN T CATALOGUE\tT CATALOGUE SEARCH\n" +
+				"A book\t0306406152\ttrue\thttps://t.example/search?q=0306406152\n"
+			if output != want {
+				t.Errorf("output = %q, want %q", output, want)
+			}
+		})
+	}
+}
+
+func TestGetISBNs(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		want  []string
+	}{
+		{"single", "0306406152", []string{"0306406152"}},
+		{"qualifier", "9780306406157 (pbk.)", []string{"9780306406157"}},
+		{"qualifier without a space", "0306406152(pbk. : alk. paper)", []string{"0306406152"}},
+		{"qualifier outside parentheses", "9780306406157 pbk.", []string{"9780306406157"}},
+		{"hyphenated ISBN-10", "0-306-40615-2", []string{"0306406152"}},
+		{"hyphenated ISBN-13", "978-0-306-40615-7 (hbk.)", []string{"9780306406157"}},
+		{"followed by a colon", "0306406152 :", []string{"0306406152"}},
+		{"colon without a space", "0306406152:", []string{"0306406152"}},
+		{"trailing period", "9780306406157.", []string{"9780306406157"}},
+		{"repeated subfields", "0306406152 (pbk.)\";\"9780804429573 (hbk.)", []string{"0306406152", "9780804429573"}},
+		{"leading and trailing junk", "  \"0306406152\" / ", []string{"0306406152"}},
+		{"X check digit", "080442957x (v. 1)", []string{"080442957X"}},
+		{"bad check digit", "0306406153 (pbk.)", []string{"0306406153"}},
+		{"blank", "", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getISBNs(tt.field); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getISBNs(%q) = %q, want %q", tt.field, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidISBNs(t *testing.T) {
+	isbns, invalid := validISBNs([]string{"0306406152", "0306406153", "9780306406157", "978030640615"})
+	// 9780306406157 is 0306406152 again, so it's dropped.
+	if want := []string{"0306406152"}; !reflect.DeepEqual(isbns, want) {
+		t.Errorf("valid ISBNs = %q, want %q", isbns, want)
+	}
+	if want := []string{"0306406153", "978030640615"}; !reflect.DeepEqual(invalid, want) {
+		t.Errorf("invalid ISBNs = %q, want %q", invalid, want)
+	}
+}
+
+func TestProcessExcelExport(t *testing.T) {
+	fakeYaz(t, manyHits, 0)
+	useTargets(t, target{Name: "T", Host: "host:210", FoundURLTemplate: "https://t.example/search?q={isbn}"})
+	// Excel puts a byte order mark before the first label, and ends lines with CRLF.
+	output, _, err := processInput(t, "\ufeff020|a\tTitle\r\n0306406152\tA book\r\n9780804429573\tAnother\r\n")
+	if err != nil {
+		t.Fatalf("process error = %v", err)
+	}
+	// The ISBNs were found by 020|a, and the output has LF line endings throughout.
+	want := "020|a\tTitle\tFOUND IN T CATALOGUE\tT CATALOGUE SEARCH\n" +
+		"0306406152\tA book\ttrue\thttps://t.example/search?q=0306406152\n" +
+		"9780804429573\tAnother\ttrue\thttps://t.example/search?q=9780804429573\n"
+	if output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
+
+func TestProcessRaggedRows(t *testing.T) {
+	input := "020|a\tTitle\n" +
+		"0306406152\tA book\t\t\n" +
+		"9780804429573\tToo long\textra\n" +
+		"097522980X\n"
+	found := "\ttrue\thttps://t.example/search?q="
+	header := "020|a\tTitle\tFOUND IN T CATALOGUE\tT CATALOGUE SEARCH\n"
+	tests := []struct {
+		onBadRow string
+		want     string
+		failed   bool
+	}{
+		// A trailing tab isn't a ragged row, but the other two are.
+		{"skip", header + "0306406152\tA book" + found + "0306406152\n", false},
+		{"pad", header + "0306406152\tA book" + found + "0306406152\n" +
+			"9780804429573\tToo long" + found + "9780804429573\n" +
+			"097522980X\t" + found + "097522980X\n", false},
+		{"fail", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.onBadRow, func(t *testing.T) {
+			setFlag(t, "on-bad-row", tt.onBadRow)
+			fakeYaz(t, manyHits, 0)
+			useTargets(t, target{Name: "T", Host: "host:210", FoundURLTemplate: "https://t.example/search?q={isbn}"})
+			output, _, err := processInput(t, input)
+			if tt.failed {
+				if err == nil || !strings.Contains(err.Error(), "row 2 of") {
+					t.Fatalf("process error = %v, want one for row 2", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("process error = %v", err)
+			}
+			// The appended columns line up with the header whatever the row's length.
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalTitle(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"The hobbit, or, There and back again / by J.R.R. Tolkien.", "hobbit, or, There and back again"},
+		{"A history of the Eastern Roman Empire : from the fall of Irene to the accession of Basil I (A.D. 802-867) / by J.B. Bury.", "history of the Eastern Roman Empire"},
+		{"An introduction to Old Norse.", "introduction to Old Norse"},
+		{"Les misérables = The wretched / Victor Hugo.", "Les misérables"},
+		{"Moby-Dick; or, The whale.", "Moby-Dick"},
+		{"  The   great  Gatsby  /  F. Scott Fitzgerald.", "great Gatsby"},
+		// Only a whole word is an article, and a title of one is kept.
+		{"Theories of reading :", "Theories of reading"},
+		{"A.", "A"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := canonicalTitle(tt.title); got != tt.want {
+			t.Errorf("canonicalTitle(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestURLReadyTitle(t *testing.T) {
+	title := "The hobbit : or, There and back again / by J.R.R. Tolkien."
+	if got, want := urlReadyTitle(title), "hobbit"; got != want {
+		t.Errorf("urlReadyTitle(%q) = %q, want %q", title, got, want)
+	}
+	// -raw-link-title keeps everything before the statement of responsibility.
+	setFlag(t, "raw-link-title", "true")
+	if got, want := urlReadyTitle(title), "The+hobbit+%3A+or%2C+There+and+back+again"; got != want {
+		t.Errorf("urlReadyTitle(%q) with -raw-link-title = %q, want %q", title, got, want)
+	}
+}
+
+func TestHitCount(t *testing.T) {
+	tests := []struct {
+		line    string
+		hits    int
+		isHits  bool
+		counted bool
+	}{
+		// yaz 4 and 5.
+		{"Number of hits: 0, setno 1", 0, true, true},
+		{"Number of hits: 12, setno 1", 12, true, true},
+		// yaz 3, with no result set number.
+		{"Number of hits: 3", 3, true, true},
+		{"Number of hits:42", 42, true, true},
+		{"Number of hits: 1234567, setno 12\r", 1234567, true, true},
+		// A hits line without a count isn't a count of 0.
+		{"Number of hits: unknown", 0, true, false},
+		{"Sent searchRequest.", 0, false, false},
+		{"records returned: 0", 0, false, false},
+	}
+	for _, tt := range tests {
+		hits, isHits, counted := hitCount(tt.line)
+		if hits != tt.hits || isHits != tt.isHits || counted != tt.counted {
+			t.Errorf("hitCount(%q) = %v, %v, %v, want %v, %v, %v", tt.line, hits, isHits, counted, tt.hits, tt.isHits, tt.counted)
+		}
+	}
+}
+
+func TestMaxQueries(t *testing.T) {
+	useTargets(t, target{Name: "A"}, target{Name: "B"})
+	setFlag(t, "jobs", "2")
+	setFlag(t, "row-concurrency", "3")
+	tests := []struct {
+		name        string
+		concurrency string
+		watch       string
+		files       int
+		want        int
+	}{
+		{name: "one file", files: 1, want: 6},
+		{name: "more files than -jobs", files: 5, want: 12},
+		// The files aren't known until they appear.
+		{name: "-watch", watch: t.TempDir(), want: 12},
+		{name: "-concurrency", concurrency: "4", files: 5, want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.concurrency != "" {
+				setFlag(t, "concurrency", tt.concurrency)
+			}
+			if tt.watch != "" {
+				setFlag(t, "watch", tt.watch)
+			}
+			if got := maxQueries(tt.files); got != tt.want {
+				t.Errorf("maxQueries(%v) = %v, want %v", tt.files, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessRecoveredPanics(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags map[string]string
+	}{
+		{name: "searching in process", flags: map[string]string{}},
+		{name: "searching rows concurrently", flags: map[string]string{"row-concurrency": "2"}},
+		{name: "searching ISBNs concurrently", flags: map[string]string{"parallel-isbns": "2"}},
+		{name: "searching for any ISBN", flags: map[string]string{"or-isbns": "true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, "keep-going", "true")
+			for name, value := range tt.flags {
+				setFlag(t, name, value)
+			}
+			useTargets(t, target{Name: "T", Host: "host:210"}, target{Name: "U", Host: "host:210"})
+			previous := execCommand
+			t.Cleanup(func() { execCommand = previous })
+			execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+				panic("boom")
+			}
+			filename := t.TempDir() + "/input.tsv"
+			os.WriteFile(filename, []byte("020|a\n0306406152\";\"9780804429573\n097522980X\n"), 0666)
+			_, panicked, err := processRecovered(context.Background(), filename)
+			if !panicked || err == nil || err.Error() != "panic: boom" {
+				t.Errorf("processRecovered = panicked %v, error %v, want the panic", panicked, err)
+			}
+		})
+	}
+}
+
+func TestProcessResults(t *testing.T) {
+	fakeYaz(t, manyHits, 0)
+	useTargets(t,
+		target{Name: "T", Host: "host:210", FoundURLTemplate: "https://t.example/search?q={isbn}"},
+		target{Name: "U", Host: "host:210", FoundURLTemplate: "https://u.example/isbn/{isbn}"},
+	)
+	_, rows, err := processInput(t, "020|a\tTitle\n0-306-40615-2 (pbk.)\tA book\n\t\n")
+	if err != nil {
+		t.Fatalf("process error = %v", err)
+	}
+	want := []rowResult{
+		{row: 1, isbns: []string{"0306406152"}, targets: []targetOutcome{
+			{name: "T", found: true, url: "https://t.example/search?q=0306406152"},
+			{name: "U", found: true, url: "https://u.example/isbn/0306406152"},
+		}},
+		// Nothing to search for, or link to.
+		{row: 2, isbns: []string{}, targets: []targetOutcome{{name: "T"}, {name: "U"}}},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("process rows = %+v, want %+v", rows, want)
+	}
+}
+
+func TestProcessDryRunResults(t *testing.T) {
+	setFlag(t, "dry-run", "true")
+	log := fakeYaz(t, manyHits, 0)
+	useTargets(t, target{Name: "T", Host: "host:210"})
+	_, rows, err := processInput(t, "020|a\n0306406152\n9780804429573\n")
+	if err != nil {
+		t.Fatalf("process error = %v", err)
+	}
+	// The rows aren't searched, so they have no targets' results.
+	want := []rowResult{{row: 1, isbns: []string{"0306406152"}}, {row: 2, isbns: []string{"9780804429573"}}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("process rows = %+v, want %+v", rows, want)
+	}
+	if _, err := os.Stat(log); err == nil {
+		t.Error("yaz-client was run for a -dry-run")
+	}
+}
+
+func TestTruncatedSession(t *testing.T) {
+	const twoSearches = "open host:210\nfind @attr 1=7 \"0306406152\"\nfind @attr 1=7 \"9780306406157\"\nclose\nquit\n"
+	tests := []struct {
+		name       string
+		transcript string
+		status     int
+		script     string
+	}{
+		{name: "connection closed before the hits", transcript: "Connecting...OK.\nSent searchRequest.\nConnection closed by peer\n"},
+		{name: "no output", transcript: ""},
+		{name: "one of two searches reported", transcript: zeroHits + "Sent searchRequest.\n", script: twoSearches},
+		{name: "exited after some output", transcript: "Connecting...OK.\nSent searchRequest.\n", status: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeYaz(t, tt.transcript, tt.status)
+			script := tt.script
+			if script == "" {
+				script = "open host:210\nfind @attr 1=7 \"0306406152\"\nclose\nquit\n"
+			}
+			results, err := runYaz(context.Background(), nil, script)
+			if err == nil {
+				t.Fatalf("runYaz gave results %+v for a truncated session, want an error", results)
+			}
+			if !transient(err) {
+				t.Errorf("runYaz error %v isn't retried", err)
+			}
+		})
+	}
+
+	// A search whose sessions keep being cut short is retried, then fails
+	// rather than finding nothing.
+	setFlag(t, "retries", "2")
+	setFlag(t, "retry-backoff", "1ms")
+	log := fakeYaz(t, "Connecting...OK.\nSent searchRequest.\n", 0)
+	useTargets(t, target{Name: "T", Host: "host:210"})
+	result, err := query(context.Background(), targets[0], isbnAccess, "0306406152")
+	if err == nil {
+		t.Fatalf("query = %+v for truncated sessions, want an error", result)
+	}
+	sent, _ := os.ReadFile(log)
+	if sessions := strings.Count(string(sent), "---\n"); sessions != 3 {
+		t.Errorf("yaz-client ran %v times, want 3", sessions)
+	}
+}
+
+func TestGetISBNsSeparated(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		want  []string
+	}{
+		{"spaces", "0306406152 9780804429573", []string{"0306406152", "9780804429573"}},
+		{"commas", "0306406152,9780804429573, 097522980X", []string{"0306406152", "9780804429573", "097522980X"}},
+		{"semicolons", "0306406152 ; 9780804429573", []string{"0306406152", "9780804429573"}},
+		{"qualified", "0306406152 (pbk.) 9780804429573 (hbk.)", []string{"0306406152", "9780804429573"}},
+		{"hyphenated", "0-306-40615-2 978-0-8044-2957-3", []string{"0306406152", "9780804429573"}},
+		// Words after the first are only taken when they're ISBNs.
+		{"other words", "0306406152 pbk 2nd ed. 9780804429573", []string{"0306406152", "9780804429573"}},
+		{"repeated subfields too", "0306406152 9780804429573\";\"097522980X", []string{"0306406152", "9780804429573", "097522980X"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getISBNs(tt.field); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getISBNs(%q) = %q, want %q", tt.field, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetISBNsEmpty(t *testing.T) {
+	fields := []string{
+		"",
+		" ",
+		"\t \n",
+		"\";\"",
+		"\";\"\";\"",
+		" \" ; \" ",
+		":.",
+		" : . ; , ",
+		"()",
+		"(pbk.)",
+		"\"\"",
+		"/ []",
+	}
+	for _, field := range fields {
+		if got := getISBNs(field); len(got) != 0 {
+			t.Errorf("getISBNs(%q) = %q, want none", field, got)
+		}
+	}
+	// Several empty fields at once, as with -extra-isbn-fields.
+	if got := getISBNs(fields...); len(got) != 0 {
+		t.Errorf("getISBNs of the empty fields = %q, want none", got)
+	}
+	if got := getISBNs(); got == nil || len(got) != 0 {
+		t.Errorf("getISBNs() = %#v, want an empty slice", got)
+	}
+}
+
+func TestProcessHeaderOrder(t *testing.T) {
+	setFlag(t, "diag", "true")
+	setFlag(t, "hits", "true")
+	fakeYaz(t, manyHits, 0)
+	// Listed out of alphabetical order, with their columns in maps.
+	configFile := t.TempDir() + "/targets.json"
+	os.WriteFile(configFile, []byte(`{"targets": [
+		{"name": "zeta", "host": "z.example:210", "foundURLTemplate": "https://z.example/{isbn}", "columns": {"hits": "Z HITS", "diag": "Z DIAG"}},
+		{"name": "alpha", "host": "a.example:210", "foundURLTemplate": "https://a.example/{isbn}", "columns": {"diag": "A DIAG", "hits": "A HITS"}},
+		{"name": "mu", "host": "m.example:210", "foundURLTemplate": "https://m.example/{isbn}"}
+	]}`), 0666)
+	loaded, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "020|a\tFOUND IN ZETA CATALOGUE\tZETA CATALOGUE SEARCH\tFOUND IN ALPHA CATALOGUE\tALPHA CATALOGUE SEARCH\tFOUND IN MU CATALOGUE\tMU CATALOGUE SEARCH" +
+		"\tZ DIAG\tA DIAG\tMU DIAG\tZ HITS\tA HITS\tMU HITS\n"
+	for run := 1; run <= 2; run++ {
+		useTargets(t, loaded.Targets...)
+		output, _, err := processInput(t, "020|a\n0306406152\n")
+		if err != nil {
+			t.Fatalf("run %v: process error = %v", run, err)
+		}
+		// The header is the same, in the config's order, every run.
+		header, _, _ := strings.Cut(output, "\n")
+		if header+"\n" != want {
+			t.Errorf("run %v header = %q, want %q", run, header, want)
+		}
+	}
+}
+
+func TestRunYazLongLines(t *testing.T) {
+	// A record with a field far longer than a bufio.Scanner's 64KB lines.
+	long := "505 0  $a " + strings.Repeat("Chapter -- ", 200000)
+	fakeYaz(t, "Connecting...OK.\nSent searchRequest.\nNumber of hits: 2, setno 1\n"+long+"\n852 01 $a OCU $b MAIN\n", 0)
+	results, err := runYaz(context.Background(), nil, "open host:210\nfind @attr 1=7 \"0306406152\"\nformat usmarc\nshow 1\nclose\nquit\n")
+	if err != nil {
+		t.Fatalf("runYaz error = %v", err)
+	}
+	if len(results) != 1 || results[0].hits != 2 || len(results[0].records) != 1 {
+		t.Fatalf("runYaz results have %v results, want one with 2 hits and a record", len(results))
+	}
+	record := results[0].records[0]
+	if len(record) != 2 || record[0] != long || record[1] != "852 01 $a OCU $b MAIN" {
+		t.Errorf("runYaz read the record's fields with lengths %v, want the long field whole and the 852 after it", len(record))
+	}
+}
+
+func TestISBNListLongLines(t *testing.T) {
+	list := "0306406152\n" + strings.Repeat("9", 100000) + "\n9780804429573\n"
+	r := csv.NewReader(isbnListReader(strings.NewReader(list)))
+	r.Comma = '\t'
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatalf("isbnListReader error = %v", err)
+	}
+	if len(records) != 4 || records[1][0] != "0306406152" || len(records[2][0]) != 100000 || records[3][0] != "9780804429573" {
+		t.Errorf("isbnListReader read %v lines, want the header and the three ISBNs", len(records))
+	}
+}
+
+func TestRunYazFrenchHits(t *testing.T) {
+	previous := hitsLine
+	t.Cleanup(func() { hitsLine = previous })
+	// As -hits-pattern sets it for a French build of yaz-client.
+	hitsLine = regexp.MustCompile(`^Nombre de résultats\s*:\D*([0-9]+)`)
+
+	tests := []struct {
+		name       string
+		transcript string
+		hits       int
+		err        error
+	}{
+		{name: "French", transcript: "Connexion...OK.\nRequête de recherche envoyée.\nNombre de résultats : 7, setno 1\n", hits: 7},
+		{name: "French with no space", transcript: "Nombre de résultats: 0\n", hits: 0},
+		// The English line isn't the configured one, so the search is unreported.
+		{name: "English", transcript: zeroHits, err: errIncompleteSession},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeYaz(t, tt.transcript, 0)
+			results, err := runYaz(context.Background(), nil, "open host:210\nfind @attr 1=7 \"0306406152\"\nclose\nquit\n")
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("runYaz error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("runYaz error = %v", err)
+			}
+			if len(results) != 1 || results[0].hits != tt.hits {
+				t.Errorf("runYaz results = %+v, want one with %v hits", results, tt.hits)
+			}
+		})
+	}
+}
+
+func TestProcessFilesFailFast(t *testing.T) {
+	tests := []struct {
+		name     string
+		failFast bool
+		failed   []string
+		outputs  []string
+	}{
+		// Failed searches are recorded in the rows, and every file is finished.
+		{name: "default", outputs: []string{"a.tsv", "b.tsv"}},
+		// The first failed search fails its file, and stops the run.
+		{name: "-fail-fast", failFast: true, failed: []string{"a.tsv"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, "fail-fast", strconv.FormatBool(tt.failFast))
+			setFlag(t, "retries", "0")
+			setFlag(t, "jobs", "1")
+			setFlag(t, "diag", "true")
+			fakeYaz(t, "yaz-client: unable to connect\n", 1)
+			useTargets(t, target{Name: "T", Host: "host:210"})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			previous := failFastStop
+			t.Cleanup(func() { failFastStop = previous })
+			failFastStop = &runStopper{cancel: cancel}
+
+			dir := t.TempDir()
+			filenames := []string{dir + "/a.tsv", dir + "/b.tsv"}
+			for _, filename := range filenames {
+				os.WriteFile(filename, []byte("020|a\n0306406152\n"), 0666)
+			}
+			var wg sync.WaitGroup
+			failures := processFiles(ctx, &wg, filenames)
+
+			failed := []string{}
+			for _, f := range failures {
+				failed = append(failed, strings.TrimPrefix(f.filename, dir+"/"))
+			}
+			if len(failed) != len(tt.failed) || (len(failed) > 0 && !reflect.DeepEqual(failed, tt.failed)) {
+				t.Errorf("failed files = %v, want %v", failed, tt.failed)
+			}
+			if failFastStop.stopped() != tt.failFast || (ctx.Err() != nil) != tt.failFast {
+				t.Errorf("run stopped %v, cancelled %v, want %v", failFastStop.stopped(), ctx.Err() != nil, tt.failFast)
+			}
+			outputs := []string{}
+			for _, filename := range filenames {
+				if output, err := os.ReadFile(outputPath(filename)); err == nil {
+					outputs = append(outputs, strings.TrimPrefix(filename, dir+"/"))
+					if !strings.HasSuffix(string(output), "\terror\n") {
+						t.Errorf("%v = %q, want the row's search recorded as an error", outputPath(filename), output)
+					}
+				}
+			}
+			if len(outputs) != len(tt.outputs) || (len(outputs) > 0 && !reflect.DeepEqual(outputs, tt.outputs)) {
+				t.Errorf("augmented files = %v, want %v", outputs, tt.outputs)
+			}
+		})
+	}
+}
+
+func TestProcessShortRow(t *testing.T) {
+	savedTargets, savedTotals, savedBadRow := targets, totals, *onBadRow
+	savedLogger := slog.Default()
+	t.Cleanup(func() {
+		targets, totals, *onBadRow = savedTargets, savedTotals, savedBadRow
+		slog.SetDefault(savedLogger)
+	})
+	// With no targets the rows are written as they're read.
+	targets, totals = nil, newSummary()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	input := "020|a\tTitle\tNote\n" +
+		"0306406152\tA book\tfine\n" +
+		"9780804429573\tShort\n" +
+		"097522980X\tAnother\tfine\n"
+	tests := []struct {
+		onBadRow string
+		want     string
+		rows     []int
+	}{
+		{"skip", "020|a\tTitle\tNote\n" +
+			"0306406152\tA book\tfine\n" +
+			"097522980X\tAnother\tfine\n", []int{1, 3}},
+		{"pad", "020|a\tTitle\tNote\n" +
+			"0306406152\tA book\tfine\n" +
+			"9780804429573\tShort\t\n" +
+			"097522980X\tAnother\tfine\n", []int{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.onBadRow, func(t *testing.T) {
+			*onBadRow = tt.onBadRow
+			filename := t.TempDir() + "/input.tsv"
+			if err := os.WriteFile(filename, []byte(input), 0666); err != nil {
+				t.Fatal(err)
+			}
+			results, err := process(context.Background(), filename)
+			if err != nil {
+				t.Fatalf("process error = %v", err)
+			}
+			// The rows after the short one are still read and written,
+			// keeping their numbers.
+			rows := []int{}
+			for _, result := range results {
+				rows = append(rows, result.row)
+			}
+			if !reflect.DeepEqual(rows, tt.rows) {
+				t.Errorf("rows written = %v, want %v", rows, tt.rows)
+			}
+			output, err := os.ReadFile(outputPath(filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output) != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
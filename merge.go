@@ -0,0 +1,125 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// mergedOutput is the -merge file, which the augmented rows of every
+// input are written to under a single header. Rows are written whole,
+// one at a time, so those of files processed at once are interleaved
+// but never mixed within a line.
+type mergedOutput struct {
+	path    string
+	partial string
+
+	mu         sync.Mutex
+	file       *os.File
+	compressor *gzip.Writer
+	output     io.Writer
+	w          rowWriter
+	// The augmented header written, and the file it was from.
+	header []string
+	source string
+}
+
+// merged is the -merge output, nil when each file has its own.
+var merged *mergedOutput
+
+// newMergedOutput creates the merged file, written beside path
+// and renamed to it once finished, like each file's output.
+func newMergedOutput(path string) (*mergedOutput, error) {
+	m := &mergedOutput{path: path, partial: path + ".partial"}
+	file, err := os.Create(m.partial)
+	if err != nil {
+		return nil, fmt.Errorf("%v - unable to open file %v for writing", err, m.partial)
+	}
+	m.file, m.output = file, file
+	if (*gzipOutput || gzipped(path)) && *format != "xlsx" {
+		m.compressor = gzip.NewWriter(file)
+		m.output = m.compressor
+	}
+	if *outputBOM {
+		if _, err := io.WriteString(m.output, "\ufeff"); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%v - unable to write byte order mark to %v", err, m.partial)
+		}
+	}
+	return m, nil
+}
+
+// writer returns the rowWriter for one input file's rows.
+func (m *mergedOutput) writer(filename string, comma rune) rowWriter {
+	return &mergeWriter{m: m, filename: filename, comma: comma}
+}
+
+// finish closes the merged file, renaming it into place when complete
+// is set. Otherwise the .partial file is kept only with -keep-partial.
+func (m *mergedOutput) finish(complete bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var err error
+	if m.w != nil {
+		err = m.w.close()
+	}
+	if m.compressor != nil {
+		if closeErr := m.compressor.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%v - unable to finish writing %v", err, m.partial)
+	}
+	if !complete {
+		if !*keepPartial {
+			os.Remove(m.partial)
+		}
+		return nil
+	}
+	if err := os.Rename(m.partial, m.path); err != nil {
+		return fmt.Errorf("%v - unable to rename %v to %v", err, m.partial, m.path)
+	}
+	return nil
+}
+
+// mergeWriter writes one input file's rows to the merged output.
+type mergeWriter struct {
+	m        *mergedOutput
+	filename string
+	comma    rune
+}
+
+// writeHeader writes the header if it's the first file's, the delimiter
+// of which is used throughout, or otherwise checks it matches.
+func (w *mergeWriter) writeHeader(header []string) error {
+	m := w.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	augmented := augmentedHeader(header)
+	if m.w == nil {
+		m.w = newRowWriter(m.output, w.comma)
+		m.header, m.source = augmented, w.filename
+		return m.w.writeHeader(header)
+	}
+	if !sameHeader(m.header, augmented) {
+		return fmt.Errorf("the header of %v doesn't match that of %v, which was merged first", w.filename, m.source)
+	}
+	return nil
+}
+
+func (w *mergeWriter) writeRow(row augmentedRow) error {
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	return w.m.w.writeRow(row)
+}
+
+// close does nothing, the merged output is finished once every file is.
+func (w *mergeWriter) close() error {
+	return nil
+}
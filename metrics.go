@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the query
+// latency histogram's buckets.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metrics counts catalogue queries by target, for -metrics-addr to
+// serve in the Prometheus text format. A nil *metrics counts nothing.
+type metrics struct {
+	mu      sync.Mutex
+	queries map[string]int
+	hits    map[string]int
+	errors  map[string]int
+	latency map[string]*histogram
+}
+
+// histogram counts observations into latencyBuckets.
+type histogram struct {
+	counts []int
+	sum    float64
+	count  int
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		queries: map[string]int{},
+		hits:    map[string]int{},
+		errors:  map[string]int{},
+		latency: map[string]*histogram{},
+	}
+}
+
+// observe records one query of the target which took elapsed.
+func (m *metrics) observe(target string, elapsed time.Duration, result searchResult, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries[target]++
+	switch {
+	case err != nil:
+		m.errors[target]++
+	case result.found():
+		m.hits[target]++
+	}
+	h, ok := m.latency[target]
+	if !ok {
+		h = &histogram{counts: make([]int, len(latencyBuckets))}
+		m.latency[target] = h
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// write prints the metrics in the Prometheus text exposition format.
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counters := []struct {
+		name, help string
+		values     map[string]int
+	}{
+		{"wcg_queries_total", "Catalogue queries made.", m.queries},
+		{"wcg_query_hits_total", "Catalogue queries which found the record.", m.hits},
+		{"wcg_query_errors_total", "Catalogue queries which failed.", m.errors},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", c.name, c.help, c.name)
+		for _, target := range sortedTargets(m.queries) {
+			fmt.Fprintf(w, "%v{target=%q} %v\n", c.name, target, c.values[target])
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP wcg_query_seconds How long catalogue queries took.\n# TYPE wcg_query_seconds histogram\n")
+	for _, target := range sortedTargets(m.queries) {
+		h := m.latency[target]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "wcg_query_seconds_bucket{target=%q,le=\"%v\"} %v\n", target, bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "wcg_query_seconds_bucket{target=%q,le=\"+Inf\"} %v\n", target, h.count)
+		fmt.Fprintf(w, "wcg_query_seconds_sum{target=%q} %v\n", target, h.sum)
+		fmt.Fprintf(w, "wcg_query_seconds_count{target=%q} %v\n", target, h.count)
+	}
+}
+
+// sortedTargets returns the targets counted, in order.
+func sortedTargets(counts map[string]int) []string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// serveMetrics listens on the address, serving the metrics at /metrics
+// until the program exits. Only failing to listen is returned, so a
+// mistyped address stops the run before it starts.
+func serveMetrics(addr string, m *metrics) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("%v - unable to listen on %v for metrics", err, addr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w)
+	})
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			slog.Error("metrics server stopped", "err", err)
+		}
+	}()
+	slog.Info("serving metrics", "address", listener.Addr().String()+"/metrics")
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// missingLog lists the input rows no target held, in their original
+// columns, for -only-missing. Weeding decisions mostly start from those.
+type missingLog struct {
+	path string
+	file *os.File
+	w    *csv.Writer
+}
+
+// missingPath returns the name of the -only-missing file for an augmented
+// file, with the input's extension, so list_augmented.tsv has
+// list_augmented_missing.tsv.
+func missingPath(modified string, input string) string {
+	base := filepath.Base(modified)
+	stem := base
+	if i := strings.Index(base, "."); i > 0 {
+		stem = base[:i]
+	}
+	ext := filepath.Ext(strings.TrimSuffix(input, ".gz"))
+	return filepath.Join(filepath.Dir(modified), stem+"_missing"+ext)
+}
+
+// newMissingLog creates the file, or appends to it when resuming.
+func newMissingLog(path string, comma rune, resuming bool) (*missingLog, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resuming {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(path, flags, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("%v - unable to open file %v for writing", err, path)
+	}
+	w := csv.NewWriter(file)
+	w.Comma = comma
+	return &missingLog{path: path, file: file, w: w}, nil
+}
+
+// writeHeader writes the input's header, unless the file already has one.
+func (l *missingLog) writeHeader(header []string) error {
+	if info, err := l.file.Stat(); err == nil && info.Size() > 0 {
+		return nil
+	}
+	l.w.Write(header)
+	l.w.Flush()
+	return l.w.Error()
+}
+
+// write adds the record if it was searched for and no target held it.
+// Rows with a failed search aren't known to be missing, and are left
+// out, as are rows with nothing searched for them.
+func (l *missingLog) write(record []string, results []targetResult) error {
+	for _, result := range results {
+		if result.found || result.failed || result.unsearchable || result.diag == "skipped:no-isbn" {
+			return nil
+		}
+	}
+	l.w.Write(record)
+	l.w.Flush()
+	if err := l.w.Error(); err != nil {
+		return fmt.Errorf("%v - unable to write to %v", err, l.path)
+	}
+	return nil
+}
+
+func (l *missingLog) close() error {
+	return l.file.Close()
+}
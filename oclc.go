@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+)
+
+// getOCLCNumbers extracts the OCLC numbers from a 035|a field, which
+// holds system control numbers like "(OCoLC)ocm01234567". Numbers from
+// other systems are ignored.
+func getOCLCNumbers(raw035pipeA string) []string {
+	numbers := []string{}
+	for _, part := range strings.Split(strings.TrimSpace(raw035pipeA), "\";\"") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "(OCoLC)") {
+			continue
+		}
+		number := strings.TrimPrefix(part, "(OCoLC)")
+		for _, prefix := range []string{"ocm", "ocn", "on"} {
+			number = strings.TrimPrefix(number, prefix)
+		}
+		number = strings.TrimLeft(number, "0")
+		if number != "" && allDigits(number) {
+			numbers = append(numbers, number)
+		}
+	}
+	return numbers
+}
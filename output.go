@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// augmentedRow is an input record with what was learned by searching for it.
+type augmentedRow struct {
+	// The row's number among the file's data rows, from 1.
+	row    int
+	record []string
+	// The ISBNs taken from the record to search for.
+	isbns          []string
+	results        []targetResult
+	isbn10         string
+	isbn13         string
+	recommendation string
+	sourceFile     string
+	// Whether the record had an ISBN, OCLC number or title to search for.
+	searchable bool
+	// The row as read, written as it is, for a row -redo-errors
+	// doesn't search again.
+	kept []string
+	// The -columns order of the written columns, as indexes of the
+	// augmented record, or nil to write them all in that order.
+	columns []int
+}
+
+// rowResult is what process learned of a row it wrote, returned so it
+// can be checked without parsing the output.
+type rowResult struct {
+	// The row's number among the file's data rows, from 1.
+	row int
+	// The ISBNs taken from the record to search for.
+	isbns []string
+	// Each target's result, in the order of targets, or none for a row
+	// which wasn't searched, with -dry-run or not searched again by
+	// -redo-errors.
+	targets []targetOutcome
+}
+
+// targetOutcome is whether a target found a row's record, and the
+// link written for it.
+type targetOutcome struct {
+	name  string
+	found bool
+	url   string
+}
+
+// result returns what was learned of the row.
+func (row augmentedRow) result() rowResult {
+	result := rowResult{row: row.row, isbns: row.isbns}
+	for i, t := range targets {
+		result.targets = append(result.targets, targetOutcome{name: t.Name, found: row.results[i].found, url: row.results[i].url})
+	}
+	return result
+}
+
+// rowWriter writes the augmented header and rows in one output format.
+type rowWriter interface {
+	// writeHeader is passed the input file's header as read.
+	writeHeader(header []string) error
+	writeRow(row augmentedRow) error
+	// close finishes the output, it doesn't close the underlying writer.
+	close() error
+}
+
+// newRowWriter returns the rowWriter for the -format flag,
+// delimited text files are written using the input's delimiter. The
+// csv.Writer quotes any field with the delimiter, a quote or a line
+// break in it, so fields read leniently with LazyQuotes, like a bare
+// quote mid-field, are written in a form that re-parses strictly to
+// the same values.
+func newRowWriter(w io.Writer, comma rune) rowWriter {
+	switch *format {
+	case "json":
+		return &jsonWriter{w: w}
+	case "xlsx":
+		return newXLSXWriter(w)
+	}
+	o := csv.NewWriter(w)
+	o.Comma = comma
+	return &tsvWriter{o: o}
+}
+
+// tsvWriter appends the results as extra columns of a TSV file.
+type tsvWriter struct {
+	o *csv.Writer
+	// Rows written since the last flush, and when that was.
+	pending   int
+	lastFlush time.Time
+}
+
+// flushInterval is the longest rows wait to be flushed when
+// -flush-every buffers them, so progress stays visible.
+const flushInterval = time.Second
+
+// accessPointColumn reports whether an ACCESS POINT column telling which
+// step found the record is appended per catalogue, with -title-search or
+// a -search-order other than the default.
+func accessPointColumn() bool {
+	return *titleSearch || *searchOrder != defaultSearchOrder
+}
+
+// augmentedHeader returns the input header with the appended columns.
+func augmentedHeader(header []string) []string {
+	newHeader := append([]string{}, header...)
+	for _, t := range targets {
+		newHeader = append(newHeader, t.column("found"), t.column("search"))
+	}
+	if *bothURLs {
+		for _, t := range targets {
+			newHeader = append(newHeader, t.column("fallback"))
+		}
+	}
+	if *isbnFormsFlag {
+		newHeader = append(newHeader, "ISBN10", "ISBN13")
+	}
+	if *recommend {
+		newHeader = append(newHeader, "RECOMMENDATION")
+	}
+	if *diag {
+		for _, t := range targets {
+			newHeader = append(newHeader, t.column("diag"))
+		}
+	}
+	if accessPointColumn() {
+		for _, t := range targets {
+			newHeader = append(newHeader, t.column("accessPoint"))
+		}
+	}
+	if *hitsColumn {
+		for _, t := range targets {
+			newHeader = append(newHeader, t.column("hits"))
+		}
+	}
+	if *allMatchedISBNs {
+		for _, t := range targets {
+			newHeader = append(newHeader, t.column("matchedISBNs"))
+		}
+	}
+	if *fetchTitle {
+		for _, t := range targets {
+			newHeader = append(newHeader, t.column("matchedTitle"))
+		}
+	}
+	if *titleMatch > 0 {
+		for _, t := range targets {
+			newHeader = append(newHeader, t.column("titleMatch"))
+		}
+	}
+	if *enrich == "holdings" {
+		for _, t := range targets {
+			newHeader = append(newHeader, t.column("holdings"))
+		}
+	}
+	if *timings {
+		for _, t := range targets {
+			newHeader = append(newHeader, t.column("ms"))
+		}
+	}
+	if *sourceFileColumn {
+		newHeader = append(newHeader, "SOURCE FILE")
+	}
+	return newHeader
+}
+
+// columnOrder returns the indexes in the augmented header of the -columns
+// labels, matched ignoring case, without the -strip-columns, or nil if
+// neither is set.
+func columnOrder(augmented []string) ([]int, error) {
+	if *stripColumns != "" {
+		for _, name := range strings.Split(*stripColumns, ",") {
+			if !hasLabel(augmented, strings.TrimSpace(name)) {
+				return nil, fmt.Errorf("no column is labelled %q", strings.TrimSpace(name))
+			}
+		}
+	}
+	if *columns == "" && *stripColumns == "" {
+		return nil, nil
+	}
+	order := []int{}
+	if *columns == "" {
+		for i, label := range augmented {
+			if !stripped(label) {
+				order = append(order, i)
+			}
+		}
+		return order, nil
+	}
+	for _, name := range strings.Split(*columns, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for i, label := range augmented {
+			if strings.EqualFold(strings.TrimSpace(label), name) {
+				if !stripped(label) {
+					order = append(order, i)
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no column is labelled %q", name)
+		}
+	}
+	return order, nil
+}
+
+// hasLabel reports whether a column is labelled name, ignoring case.
+func hasLabel(header []string, name string) bool {
+	for _, label := range header {
+		if strings.EqualFold(strings.TrimSpace(label), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripped reports whether the column is one of the -strip-columns,
+// which are read but never written.
+func stripped(label string) bool {
+	if *stripColumns == "" {
+		return false
+	}
+	for _, name := range strings.Split(*stripColumns, ",") {
+		if strings.EqualFold(strings.TrimSpace(label), strings.TrimSpace(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectColumns returns the values in the order, or all of them if it's nil.
+func selectColumns(values []string, order []int) []string {
+	if order == nil {
+		return values
+	}
+	selected := make([]string, 0, len(order))
+	for _, i := range order {
+		selected = append(selected, values[i])
+	}
+	return selected
+}
+
+// outputHeader returns the augmented header as written, in the -columns
+// order, which process has already checked the header has.
+func outputHeader(header []string) []string {
+	augmented := augmentedHeader(header)
+	order, _ := columnOrder(augmented)
+	return selectColumns(augmented, order)
+}
+
+func (t *tsvWriter) writeHeader(header []string) error {
+	t.o.Write(outputHeader(header))
+	return t.flush()
+}
+
+func (t *tsvWriter) writeRow(row augmentedRow) error {
+	if row.kept != nil {
+		t.o.Write(row.kept)
+	} else {
+		t.o.Write(selectColumns(augmentedRecord(row), row.columns))
+	}
+	t.pending++
+	if t.pending < *flushEvery && time.Since(t.lastFlush) < flushInterval {
+		return t.o.Error()
+	}
+	return t.flush()
+}
+
+// augmentedRecord returns the input record with the appended
+// columns, matching augmentedHeader.
+func augmentedRecord(row augmentedRow) []string {
+	newRecord := append([]string{}, row.record...)
+	for _, result := range row.results {
+		newRecord = append(newRecord, result.foundCell(), result.url)
+	}
+	if *bothURLs {
+		for _, result := range row.results {
+			newRecord = append(newRecord, result.fallbackURL)
+		}
+	}
+	if *isbnFormsFlag {
+		newRecord = append(newRecord, row.isbn10, row.isbn13)
+	}
+	if *recommend {
+		newRecord = append(newRecord, row.recommendation)
+	}
+	if *diag {
+		for _, result := range row.results {
+			newRecord = append(newRecord, result.diag)
+		}
+	}
+	if accessPointColumn() {
+		for _, result := range row.results {
+			newRecord = append(newRecord, result.accessPoint)
+		}
+	}
+	if *hitsColumn {
+		for _, result := range row.results {
+			newRecord = append(newRecord, strconv.Itoa(result.hits))
+		}
+	}
+	if *allMatchedISBNs {
+		for _, result := range row.results {
+			newRecord = append(newRecord, strings.Join(result.matchedISBNs, ", "))
+		}
+	}
+	if *fetchTitle {
+		for _, result := range row.results {
+			newRecord = append(newRecord, result.matchedTitle)
+		}
+	}
+	if *titleMatch > 0 {
+		for _, result := range row.results {
+			newRecord = append(newRecord, result.titleMatch)
+		}
+	}
+	if *enrich == "holdings" {
+		for _, result := range row.results {
+			newRecord = append(newRecord, strings.Join(result.holdings, "; "))
+		}
+	}
+	if *timings {
+		for _, result := range row.results {
+			newRecord = append(newRecord, strconv.FormatInt(result.elapsed.Milliseconds(), 10))
+		}
+	}
+	if *sourceFileColumn {
+		newRecord = append(newRecord, row.sourceFile)
+	}
+	return newRecord
+}
+
+func (t *tsvWriter) close() error {
+	return t.flush()
+}
+
+// flush writes any buffered data to the underlying writer.
+func (t *tsvWriter) flush() error {
+	t.o.Flush()
+	t.pending, t.lastFlush = 0, time.Now()
+	return t.o.Error()
+}
+
+// jsonWriter streams the rows as a JSON array of objects,
+// encoding one row at a time.
+type jsonWriter struct {
+	w      io.Writer
+	header []string
+	rows   int
+	opened bool
+	closed bool
+}
+
+type jsonTarget struct {
+	Name         string   `json:"name"`
+	Found        bool     `json:"found"`
+	Error        bool     `json:"error,omitempty"`
+	Skipped      bool     `json:"skipped,omitempty"`
+	SearchURL    string   `json:"searchURL"`
+	FallbackURL  string   `json:"fallbackURL,omitempty"`
+	Hits         *int     `json:"hits,omitempty"`
+	MatchedISBNs []string `json:"matchedISBNs,omitempty"`
+	Diag         string   `json:"diag,omitempty"`
+	AccessPoint  string   `json:"accessPoint,omitempty"`
+	MatchedTitle string   `json:"matchedTitle,omitempty"`
+	TitleMatch   *bool    `json:"titleMatch,omitempty"`
+	Holdings     []string `json:"holdings,omitempty"`
+	MS           *int64   `json:"ms,omitempty"`
+}
+
+type jsonRow struct {
+	Record         map[string]string `json:"record"`
+	Targets        []jsonTarget      `json:"targets"`
+	Searchable     bool              `json:"searchable"`
+	ISBN10         string            `json:"isbn10,omitempty"`
+	ISBN13         string            `json:"isbn13,omitempty"`
+	Recommendation string            `json:"recommendation,omitempty"`
+	SourceFile     string            `json:"sourceFile,omitempty"`
+}
+
+func (j *jsonWriter) open() error {
+	if j.opened {
+		return nil
+	}
+	j.opened = true
+	_, err := io.WriteString(j.w, "[")
+	return err
+}
+
+func (j *jsonWriter) writeHeader(header []string) error {
+	j.header = append([]string{}, header...)
+	return j.open()
+}
+
+func (j *jsonWriter) writeRow(row augmentedRow) error {
+	out := jsonRow{
+		Record:         map[string]string{},
+		Searchable:     row.searchable,
+		ISBN10:         row.isbn10,
+		ISBN13:         row.isbn13,
+		Recommendation: row.recommendation,
+		SourceFile:     row.sourceFile,
+	}
+	for i, label := range j.header {
+		if !stripped(label) {
+			out.Record[label] = row.record[i]
+		}
+	}
+	for i, result := range row.results {
+		target := jsonTarget{Name: targets[i].Name, Found: result.found, Error: !result.found && result.failed, Skipped: result.skipped, SearchURL: result.url, FallbackURL: result.fallbackURL, AccessPoint: result.accessPoint, MatchedTitle: result.matchedTitle}
+		if *diag {
+			target.Diag = result.diag
+		}
+		if *hitsColumn {
+			hits := result.hits
+			target.Hits = &hits
+		}
+		if *allMatchedISBNs {
+			target.MatchedISBNs = result.matchedISBNs
+		}
+		if result.titleMatch != "" {
+			match := result.titleMatch == "true"
+			target.TitleMatch = &match
+		}
+		if *enrich == "holdings" {
+			target.Holdings = result.holdings
+		}
+		if *timings {
+			ms := result.elapsed.Milliseconds()
+			target.MS = &ms
+		}
+		out.Targets = append(out.Targets, target)
+	}
+
+	encoded, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	separator := "\n"
+	if j.rows > 0 {
+		separator = ",\n"
+	}
+	if _, err := io.WriteString(j.w, separator); err != nil {
+		return err
+	}
+	j.rows++
+	_, err = j.w.Write(encoded)
+	return err
+}
+
+// close ends the array, and is safe to call more than once so
+// a partially processed file still produces valid JSON.
+func (j *jsonWriter) close() error {
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+	if err := j.open(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(j.w, "\n]\n")
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRowWriterRoundTrip(t *testing.T) {
+	saved := targets
+	targets = []target{{Name: "T"}}
+	t.Cleanup(func() { targets = saved })
+
+	// Read leniently, as process reads its input, a bare quote mid-field
+	// is kept as it is.
+	input := "020|a\tTitle\tNote\n" +
+		"0306406152\tA \"bare\" quote\twith a \"\"doubled\"\" one\n" +
+		"9780804429573\t\"Two\nlines\"\t\"with\ta tab\"\n" +
+		"097522980X\t\"\"\"\"\t\n"
+	want := [][]string{
+		{"020|a", "Title", "Note"},
+		{"0306406152", "A \"bare\" quote", "with a \"\"doubled\"\" one"},
+		{"9780804429573", "Two\nlines", "with\ta tab"},
+		{"097522980X", "\"", ""},
+	}
+	r := csv.NewReader(strings.NewReader(input))
+	r.Comma = '\t'
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil || !reflect.DeepEqual(records, want) {
+		t.Fatalf("the input reads as %q, %v, want %q", records, err, want)
+	}
+
+	var output strings.Builder
+	w := newRowWriter(&output, '\t')
+	if err := w.writeHeader(records[0]); err != nil {
+		t.Fatalf("writeHeader error = %v", err)
+	}
+	for _, record := range records[1:] {
+		row := augmentedRow{record: record, results: []targetResult{{found: true, url: "https://t.example/?q=1&a=2"}}}
+		if err := w.writeRow(row); err != nil {
+			t.Fatalf("writeRow error = %v", err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatalf("close error = %v", err)
+	}
+
+	// The augmented file re-parses strictly to the input and the
+	// appended columns.
+	r = csv.NewReader(strings.NewReader(output.String()))
+	r.Comma = '\t'
+	augmented, err := r.ReadAll()
+	if err != nil {
+		t.Fatalf("the augmented file doesn't parse: %v\n%s", err, output.String())
+	}
+	if len(augmented) != len(records) {
+		t.Fatalf("the augmented file has %v records, want %v:\n%s", len(augmented), len(records), output.String())
+	}
+	appended := []string{"true", "https://t.example/?q=1&a=2"}
+	if !reflect.DeepEqual(augmented[0][:3], records[0]) {
+		t.Errorf("header = %q, want %q with the appended columns", augmented[0], records[0])
+	}
+	for i, record := range augmented[1:] {
+		if !reflect.DeepEqual(record, append(append([]string{}, records[i+1]...), appended...)) {
+			t.Errorf("record %v = %q, want %q with %q", i+1, record, records[i+1], appended)
+		}
+	}
+}
+
+func TestLinkCellRoundTrip(t *testing.T) {
+	saved := targets
+	targets = []target{{Name: "T", NotFoundURLTemplate: "https://t.example/search/?searchtype=t&searcharg={title}&SORT=D"}}
+	t.Cleanup(func() { targets = saved })
+
+	tests := []struct {
+		title string
+		// The link's searcharg, as a browser would pass it on.
+		searched string
+	}{
+		{"100% pure : a memoir / by Ann Smith.", "100% pure"},
+		{"Salt & pepper : recipes.", "Salt & pepper"},
+		{"Rock %26 roll?", "Rock %26 roll?"},
+		{"The \"tab\tand quote\" book", "\"tab and quote\" book"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			link := targets[0].searchURL(targetResult{}, tt.title)
+			var output strings.Builder
+			w := newRowWriter(&output, '\t')
+			w.writeHeader([]string{"020|a", "Title"})
+			w.writeRow(augmentedRow{record: []string{"0306406152", tt.title}, results: []targetResult{{url: link}}})
+			if err := w.close(); err != nil {
+				t.Fatalf("close error = %v", err)
+			}
+			r := csv.NewReader(strings.NewReader(output.String()))
+			r.Comma = '\t'
+			records, err := r.ReadAll()
+			if err != nil || len(records) != 2 || len(records[1]) != 4 {
+				t.Fatalf("the augmented file doesn't parse to two rows of four columns: %v\n%s", err, output.String())
+			}
+			if records[1][1] != tt.title || records[1][3] != link {
+				t.Errorf("the row was written as %q, want the title %q and link %q", records[1], tt.title, link)
+			}
+			// The link isn't quoted, and has only the parameters of the template.
+			if strings.ContainsAny(link, "\t\"\n") || strings.Contains(output.String(), "\""+link) {
+				t.Errorf("the link %q needs quoting", link)
+			}
+			u, err := url.Parse(link)
+			if err != nil {
+				t.Fatalf("the link %q doesn't parse: %v", link, err)
+			}
+			query := u.Query()
+			if len(query) != 3 || query.Get("searcharg") != tt.searched || query.Get("SORT") != "D" {
+				t.Errorf("the link %q searches %q, want %q", link, query, tt.searched)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// stdout is where a filename of "-" is written.
+var stdout = &pipeWriter{w: os.Stdout, cancel: func() {}}
+
+// pipeWriter cancels the run once a write fails because the reader of
+// the pipe, like head, has closed it, so the rows left aren't searched
+// for output nobody reads. SIGPIPE must be ignored for the write to fail
+// rather than kill the program.
+type pipeWriter struct {
+	w      io.Writer
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (p *pipeWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if errors.Is(err, syscall.EPIPE) {
+		p.mu.Lock()
+		p.closed = true
+		p.mu.Unlock()
+		p.cancel()
+	}
+	return n, err
+}
+
+// broken reports whether the reader closed the pipe.
+func (p *pipeWriter) broken() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
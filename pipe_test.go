@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// failingWriter fails every write with its error.
+type failingWriter struct {
+	err error
+}
+
+func (w failingWriter) Write(b []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestProcessClosedStdout(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		broken bool
+	}{
+		// As when head has read all it wants.
+		{name: "closed pipe", err: syscall.EPIPE, broken: true},
+		{name: "failing writer", err: errors.New("disk full")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeYaz(t, manyHits, 0)
+			useTargets(t, target{Name: "T", Host: "host:210"})
+			input := t.TempDir() + "/input.tsv"
+			os.WriteFile(input, []byte("020|a\n0306406152\n9780804429573\n"), 0666)
+			file, err := os.Open(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			previousStdin, previousStdout := os.Stdin, stdout
+			t.Cleanup(func() { os.Stdin, stdout = previousStdin, previousStdout })
+			os.Stdin = file
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stdout = &pipeWriter{w: failingWriter{tt.err}, cancel: cancel}
+
+			rows, err := process(ctx, "-")
+			if err == nil || !strings.Contains(err.Error(), tt.err.Error()) {
+				t.Fatalf("process error = %v, want one for %v", err, tt.err)
+			}
+			// Nothing reached stdout, so no rows were written.
+			if len(rows) > 0 {
+				t.Errorf("process reported %v rows written to a failed stdout", len(rows))
+			}
+			if stdout.broken() != tt.broken || (ctx.Err() != nil) != tt.broken {
+				t.Errorf("stdout broken %v, run cancelled %v, want %v", stdout.broken(), ctx.Err() != nil, tt.broken)
+			}
+		})
+	}
+}
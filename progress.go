@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// progressReport periodically logs how far through a file processing is.
+type progressReport struct {
+	name     string
+	interval time.Duration
+	// The number of data rows in the file, or 0 when unknown.
+	total int
+	rows  int
+	found []int
+	start time.Time
+	last  time.Time
+}
+
+// newProgressReport starts timing the file, reporting every interval.
+func newProgressReport(name string, total int, interval time.Duration) *progressReport {
+	now := time.Now()
+	return &progressReport{
+		name:     name,
+		interval: interval,
+		total:    total,
+		found:    make([]int, len(targets)),
+		start:    now,
+		last:     now,
+	}
+}
+
+// record counts a processed row, logging progress when the interval has passed.
+func (p *progressReport) record(results []targetResult) {
+	p.rows++
+	for i, result := range results {
+		if result.found {
+			p.found[i]++
+		}
+	}
+	// The last row is reported when the file is finished.
+	if p.rows != p.total && time.Since(p.last) >= p.interval {
+		p.last = time.Now()
+		slog.Info(p.String())
+	}
+}
+
+func (p *progressReport) String() string {
+	elapsed := time.Since(p.start)
+	parts := []string{fmt.Sprintf("%v: row %v", p.name, p.rows)}
+	if p.total > 0 {
+		parts[0] += fmt.Sprintf(" of %v", p.total)
+	}
+	for i, t := range targets {
+		parts = append(parts, fmt.Sprintf("found in %v: %v", t.Name, p.found[i]))
+	}
+	parts = append(parts, fmt.Sprintf("elapsed %v", elapsed.Round(time.Second)))
+	if p.total > 0 && p.rows > 0 && p.rows < p.total {
+		eta := elapsed / time.Duration(p.rows) * time.Duration(p.total-p.rows)
+		parts = append(parts, fmt.Sprintf("ETA %v", eta.Round(time.Second)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// countRows returns the number of data rows in the file, so progress can
+// be reported against a total. It returns 0 if the file can't be read.
+func countRows(path string, comma rune) int {
+	file, err := openInput(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.Comma = comma
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	rows := 0
+	for {
+		if _, err := r.Read(); err != nil {
+			break
+		}
+		rows++
+	}
+	if rows == 0 {
+		return 0
+	}
+	// Don't count the header.
+	return rows - 1
+}
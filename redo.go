@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// redoRows are the rows of an augmented file with a failed search, as
+// listed by their ROW in its errors file, for -redo-errors. They're
+// searched again in every target and the file rewritten with their new
+// results, while its other rows are kept as they were.
+type redoRows struct {
+	errorsPath string
+	rows       map[int]bool
+	// The number of columns appended to the input's, which are
+	// dropped from the rows searched again.
+	appended int
+}
+
+// readRedoRows reads the rows listed in the errors file.
+func readRedoRows(errorsPath string) (*redoRows, error) {
+	file, err := os.Open(errorsPath)
+	if err != nil {
+		return nil, fmt.Errorf("%v - unable to open errors file %v", err, errorsPath)
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.Comma = '\t'
+	r.FieldsPerRecord = -1
+	redo := &redoRows{errorsPath: errorsPath, rows: map[int]bool{}}
+	line := 0
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v - unable to read errors file %v", err, errorsPath)
+		}
+		line++
+		if line == 1 {
+			// The header.
+			continue
+		}
+		row, err := strconv.Atoi(record[0])
+		if err != nil || row < 1 {
+			return nil, fmt.Errorf("line %v of errors file %v has ROW %q, it must be a row number", line, errorsPath, record[0])
+		}
+		redo.rows[row] = true
+	}
+	return redo, nil
+}
+
+// inputHeader returns the input's columns of the augmented file's
+// header, which must have the columns this run appends, so rows keep
+// the same columns when they're searched again.
+func (r *redoRows) inputHeader(header []string, filename string) ([]string, error) {
+	r.appended = len(augmentedHeader(nil))
+	if len(header) < r.appended || !sameHeader(header, augmentedHeader(header[:len(header)-r.appended])) {
+		return nil, fmt.Errorf("the header of %v doesn't have the columns this run would append, use the flags and config it was augmented with", filename)
+	}
+	return header[:len(header)-r.appended], nil
+}
+
+// finish replaces the errors file with the failures of the rows searched
+// again, or removes it if none of them failed.
+func (r *redoRows) finish(failures *errorLog) error {
+	if err := failures.close(); err != nil {
+		return fmt.Errorf("%v - unable to close %v", err, failures.path)
+	}
+	if failures.file == nil {
+		if err := os.Remove(r.errorsPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("%v - unable to remove %v", err, r.errorsPath)
+		}
+		return nil
+	}
+	if err := os.Rename(failures.path, r.errorsPath); err != nil {
+		return fmt.Errorf("%v - unable to rename %v to %v", err, failures.path, r.errorsPath)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// readAugmented returns the header and number of data rows
+// of an existing augmented file, so a run can resume after them.
+func readAugmented(path string, comma rune) ([]string, int, error) {
+	file, err := openInput(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%v - unable to open existing output %v", err, path)
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.Comma = comma
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%v - unable to read existing output %v", err, path)
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+
+	rows := 0
+	for {
+		_, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("%v - unable to read existing output %v", err, path)
+		}
+		rows++
+	}
+	return header, rows, nil
+}
+
+// sameHeader reports whether two headers have the same labels in the same order.
+func sameHeader(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
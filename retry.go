@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"time"
+)
+
+// errNoResults is returned when yaz-client finishes without reporting
+// the results of a search, usually because it couldn't connect.
+var errNoResults = errors.New("yaz-client reported no search results")
+
+// errIncompleteSession is returned when yaz-client's output ends before
+// reporting the results of every search its script ran, as when the
+// connection drops mid-session, so the searches unreported aren't
+// taken to have found nothing.
+var errIncompleteSession = errors.New("yaz-client session ended before reporting every search")
+
+// diagnosticError is a search the catalogue refused with a Bib-1 or SRU
+// diagnostic, such as 114 for an unsupported use attribute. Retrying
+// won't help, the target's attributes or index likely need fixing.
+type diagnosticError struct {
+	code string
+}
+
+func (e diagnosticError) Error() string {
+	return "catalogue returned diagnostic " + e.code
+}
+
+// transient reports whether a failed search is worth trying again.
+func transient(err error) bool {
+	var netErr net.Error
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, context.DeadlineExceeded):
+		// A -query-timeout expired.
+		return true
+	case errors.Is(err, errNoResults), errors.Is(err, errIncompleteSession), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &netErr), errors.As(err, &exitErr):
+		return true
+	}
+	return false
+}
+
+// timedOut reports whether a failed search ran out of time, its
+// -query-timeout expiring or its connection timing out.
+func timedOut(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// withRetries calls attempt until it succeeds, retrying transient errors up
+// to -retries times, doubling the pause from -retry-backoff before each.
+func withRetries(ctx context.Context, description string, attempt func() error) error {
+	backoff := *retryBackoff
+	for retry := 0; ; retry++ {
+		err := attempt()
+		if err == nil || retry >= *retries || ctx.Err() != nil || !transient(err) {
+			return err
+		}
+		logger(ctx).Debug("retrying", "search", description, "after", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rowSearch is what was taken from a row of a file to search for it.
+type rowSearch struct {
+	record []string
+	// The row's number among the file's data rows, from 1.
+	number int
+	title  string
+	author string
+	isbns  []string
+	// The invalid ISBNs, which fail the row with -strict-isbn.
+	invalid []string
+	oclcs   []string
+	lccns   []string
+	ismns   []string
+	// Whether the row fails unsearched for an invalid ISBN, isn't
+	// searched as its ISBNs all have a -skip-isbn-prefixes prefix, or
+	// had more than -max-isbns ISBNs.
+	rejected, skipped, capped bool
+	// Whether the record had an ISBN, OCLC number or title to search for.
+	searchable bool
+}
+
+// rowOutcome is a searched row, or the error which stopped its search.
+type rowOutcome struct {
+	row augmentedRow
+	err error
+}
+
+// searchRow searches the targets for a row of the file, by its ISBNs,
+// then OCLC numbers, LCCNs, ISMNs and title, or in the -search-order,
+// returning the row to write. Rows may be searched at the same time, up
+// to -row-concurrency of them.
+func searchRow(ctx context.Context, filename, base string, s rowSearch) (augmentedRow, error) {
+	record, title := s.record, s.title
+	isbns, invalid, oclcs, lccns, ismns := s.isbns, s.invalid, s.oclcs, s.lccns, s.ismns
+	rejected, skipped, capped, searchable := s.rejected, s.skipped, s.capped, s.searchable
+	ctx = withRow(ctx, base, s.number)
+
+	results := make([]targetResult, len(targets))
+	for i := range results {
+		results[i].diag = "miss"
+		if len(isbns) == 0 {
+			results[i].diag = "skipped:no-isbn"
+		}
+		if !searchable {
+			results[i].unsearchable = true
+			results[i].diag = "skipped:no-data"
+		}
+		if rejected {
+			results[i].unsearchable = false
+			results[i].fail(isbnAccess, strings.Join(invalid, ", "), errInvalidISBN)
+		}
+		if skipped {
+			results[i].skipped = true
+			results[i].diag = "skipped:prefix"
+		}
+	}
+	// Each step of -search-order searches the targets without a match yet.
+	steps := map[string]func() error{
+		"isbn": func() error {
+			return searchByISBN(ctx, filename, results, isbns)
+		},
+		"oclc": func() error {
+			// Fall back to any OCLC numbers for the targets without a match.
+			return searchEach(ctx, filename, results, oclcAccess, oclcs)
+		},
+		"lccn": func() error {
+			// Any LCCNs are often the best match for government documents.
+			return searchEach(ctx, filename, results, lccnAccess, lccns)
+		},
+		"ismn": func() error {
+			// ISMNs are the ISBNs of printed music.
+			return searchEach(ctx, filename, results, ismnAccess, ismns)
+		},
+		"title": func() error {
+			if !*titleSearch {
+				return nil
+			}
+			term := titleTerm(title)
+			if term == "" {
+				return nil
+			}
+			ap := titleAccess
+			if author := authorTerm(s.author); *titleAuthorFallback && author != "" {
+				ap, term = titleAuthorAccess, titleAuthorTerm(term, author)
+			}
+			return searchEach(ctx, filename, results, ap, []string{term})
+		},
+	}
+	// Rejected and skipped rows aren't searched at all, by OCLC number,
+	// LCCN or title either.
+	if !rejected && !skipped {
+		for _, step := range searchSteps {
+			if err := steps[step](); err != nil {
+				return augmentedRow{}, err
+			}
+		}
+	}
+
+	if capped {
+		for i := range results {
+			if results[i].diag == "miss" {
+				results[i].diag = "miss:capped"
+			}
+		}
+	}
+
+	if *fetchTitle {
+		if err := fetchTitles(ctx, results, title); err != nil {
+			return augmentedRow{}, fmt.Errorf("%w from %v", err, filename)
+		}
+	}
+	if *enrich == "holdings" {
+		if err := fetchHoldings(ctx, results, title); err != nil {
+			return augmentedRow{}, fmt.Errorf("%w from %v", err, filename)
+		}
+	}
+	if *titleMatch > 0 {
+		for i := range results {
+			if results[i].matchedTitle == "" || title == "" {
+				continue
+			}
+			similarity := titleSimilarity(title, results[i].matchedTitle)
+			logger(withTarget(ctx, targets[i])).Debug("title similarity", "target", targets[i].Name, "title", title, "matched", results[i].matchedTitle, "similarity", similarity)
+			results[i].titleMatch = strconv.FormatBool(similarity >= *titleMatch)
+		}
+	}
+
+	row := augmentedRow{row: s.number, record: record, isbns: isbns, results: results, searchable: searchable}
+	for i, t := range targets {
+		if !searchable {
+			continue
+		}
+		row.results[i].url = t.searchURL(results[i], title)
+		if *noFallbackURL && !results[i].found {
+			row.results[i].url = ""
+		}
+		if *bothURLs {
+			// Link by the record's own ISBN, OCLC number, LCCN or
+			// ISMN when the target didn't hold it, or not at all.
+			linked := results[i]
+			if linked.isbn == "" && linked.oclc == "" && linked.lccn == "" && linked.ismn == "" {
+				switch {
+				case len(isbns) > 0:
+					linked.isbn = isbns[0]
+				case len(oclcs) > 0:
+					linked.oclc = oclcs[0]
+				case len(lccns) > 0:
+					linked.lccn = lccns[0]
+				case len(ismns) > 0:
+					linked.ismn = ismns[0]
+				}
+			}
+			row.results[i].url = ""
+			if linked.isbn != "" || linked.oclc != "" || linked.lccn != "" || linked.ismn != "" {
+				row.results[i].url = t.searchURL(linked, title)
+			}
+			row.results[i].fallbackURL = t.fallbackURL(title)
+		}
+	}
+	if *isbnFormsFlag {
+		row.isbn10, row.isbn13 = firstISBNForms(isbns)
+	}
+	if *recommend {
+		held := 0
+		for _, result := range results {
+			if result.found {
+				held++
+			}
+		}
+		row.recommendation = recommendation(held)
+	}
+	if *sourceFileColumn {
+		row.sourceFile = base
+	}
+	return row, nil
+}
+
+// searchEach searches the targets without a match yet for each of the
+// terms in turn, by the access point.
+func searchEach(ctx context.Context, filename string, results []targetResult, ap accessPoint, terms []string) error {
+	for _, term := range terms {
+		searchedFor(results)
+		pause, err := searchTargets(ctx, results, ap, term)
+		if err != nil {
+			return fmt.Errorf("%w from %v", err, filename)
+		}
+		if err := sleep(ctx, pause); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchByISBN searches the targets for the row's ISBNs, together with
+// -batch-yaz or -or-isbns, several at once with -parallel-isbns, or
+// otherwise one after another.
+func searchByISBN(ctx context.Context, filename string, results []targetResult, isbns []string) error {
+	if *batchYaz && len(isbns) > 0 {
+		templates := []string{}
+		for _, t := range targets {
+			templates = append(templates, t.yazTemplate(isbnAccess))
+		}
+		variants := []string{}
+		for _, isbn := range isbns {
+			variants = append(variants, isbnVariants(isbn)...)
+		}
+		start := time.Now()
+		batch, batchErr := queryBatch(ctx, variants, templates...)
+		// The targets were searched together, so share the time.
+		took := time.Since(start)
+		if batchErr != nil {
+			err := fmt.Errorf("%v - unable to search for %v from %v", batchErr, strings.Join(variants, ", "), filename)
+			if ctx.Err() != nil {
+				return err
+			}
+			logger(ctx).Warn("batched search failed", "err", err)
+		}
+		pause := time.Duration(0)
+		for i, t := range targets {
+			results[i].elapsed += took
+			if batch == nil {
+				results[i].fail(isbnAccess, strings.Join(variants, ", "), batchErr)
+				continue
+			}
+			for j, variant := range variants {
+				batch[i][j].threshold = t.minHits()
+				if err := batch[i][j].err(); err != nil {
+					logger(withTarget(ctx, t)).Warn("batched search failed", "target", t.Name, "isbn", variant, "err", err)
+					results[i].fail(isbnAccess, variant, err)
+					continue
+				}
+				results[i].add(isbnAccess, variant, batch[i][j])
+			}
+			logger(withTarget(ctx, t)).Debug("batched result", "target", t.Name, "found", results[i].found)
+			if t.delay() > pause {
+				pause = t.delay()
+			}
+		}
+		if err := sleep(ctx, pause); err != nil {
+			return err
+		}
+	} else if *orISBNs && len(isbns) > 1 {
+		pause, err := searchAnyISBN(ctx, results, isbns)
+		if err != nil {
+			return fmt.Errorf("%w from %v", err, filename)
+		}
+		if err := sleep(ctx, pause); err != nil {
+			return err
+		}
+	} else if *parallelISBNs > 1 && len(isbns) > 1 {
+		pause, err := searchISBNs(ctx, results, isbns)
+		if err != nil {
+			return fmt.Errorf("%w from %v", err, filename)
+		}
+		if err := sleep(ctx, pause); err != nil {
+			return err
+		}
+	} else {
+		for _, isbn := range isbns {
+
+			logger(ctx).Debug("searching", "isbn", isbn)
+
+			pause, err := searchTargets(ctx, results, isbnAccess, isbn)
+			if err != nil {
+				return fmt.Errorf("%w from %v", err, filename)
+			}
+
+			if err := sleep(ctx, pause); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sleep pauses for the targets' delay between searches, returning early
+// with the context's error once it's done, so a cancelled row stops.
+func sleep(ctx context.Context, pause time.Duration) error {
+	select {
+	case <-time.After(pause):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
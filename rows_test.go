@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearchEachCancelledPause(t *testing.T) {
+	fakeYaz(t, zeroHits, 0)
+	useTargets(t, target{Name: "T", Host: "host:210"})
+	setFlag(t, "delay", "1m")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Long after the fake yaz-client has answered, even under -race, and
+	// long before the pause is over.
+	time.AfterFunc(time.Second, cancel)
+
+	start := time.Now()
+	results := make([]targetResult, len(targets))
+	err := searchEach(ctx, "input.tsv", results, titleAccess, []string{"A book", "Another"})
+	// Stopped in the pause after the first search, rather than a minute later.
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("searchEach error = %v, want it cancelled", err)
+	}
+	if took := time.Since(start); took > 10*time.Second {
+		t.Errorf("searchEach took %v to stop once cancelled", took)
+	}
+}
+
+func TestSearchRowOrder(t *testing.T) {
+	tests := []struct {
+		order string
+		// The first term searched, and whether the ISBN was.
+		first      string
+		searchISBN bool
+	}{
+		{"isbn,oclc,lccn,ismn,title", "0306406152", true},
+		{"title,isbn", "A book", true},
+		// A row with an ISBN is searched by title when isbn is left out.
+		{"oclc,title", "A book", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			log := fakeYaz(t, zeroHits, 0)
+			useTargets(t, target{Name: "T", Host: "host:210"})
+			setFlag(t, "title-search", "true")
+			steps, err := parseSearchOrder(tt.order)
+			if err != nil {
+				t.Fatal(err)
+			}
+			previous := searchSteps
+			searchSteps = steps
+			t.Cleanup(func() { searchSteps = previous })
+
+			s := rowSearch{record: []string{"0306406152", "A book"}, number: 1, title: "A book", isbns: []string{"0306406152"}, searchable: true}
+			if _, err := searchRow(context.Background(), "input.tsv", "input.tsv", s); err != nil {
+				t.Fatalf("searchRow error = %v", err)
+			}
+			scripts, _ := os.ReadFile(log)
+			terms := []string{}
+			for _, line := range strings.Split(string(scripts), "\n") {
+				if strings.HasPrefix(line, "find ") {
+					terms = append(terms, line[strings.Index(line, "\"")+1:len(line)-1])
+				}
+			}
+			if len(terms) == 0 || terms[0] != tt.first || !hasLabel(terms, "A book") {
+				t.Errorf("searched %q, want %q first and the title searched", terms, tt.first)
+			}
+			if hasLabel(terms, "0306406152") != tt.searchISBN {
+				t.Errorf("searched %q, want the ISBN searched %v", terms, tt.searchISBN)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Every flag can also be set by an environment variable or in the
+// config file's settings. A flag given on the command line takes
+// precedence over its environment variable, which takes precedence over
+// the config file, which takes precedence over the flag's default.
+
+// envPrefix starts the environment variable of each flag.
+const envPrefix = "WCG_"
+
+// envName returns the environment variable setting the flag,
+// like WCG_RETRY_BACKOFF for -retry-backoff.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// explicitFlags returns the names of the flags given on the command line.
+func explicitFlags() map[string]bool {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// applyEnvironment sets each flag not given on the command line from its
+// environment variable, if set, adding it to the flags already set.
+func applyEnvironment(set map[string]bool) error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%v - invalid value %q of %v for -%v", setErr, value, envName(f.Name), f.Name)
+			return
+		}
+		set[f.Name] = true
+	})
+	return err
+}
+
+// applySettings sets each flag not given on the command line or in the
+// environment from the config file's settings, keyed by flag name.
+// The config file can't name itself, or -version.
+func applySettings(settings map[string]any, set map[string]bool, path string) error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if flag.Lookup(name) == nil || name == "config" || name == "version" {
+			return fmt.Errorf("config file %v has a setting %q which isn't a flag it can set", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		value := fmt.Sprint(settings[name])
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%v - invalid value %q of setting %v in config file %v", err, value, name, path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// outputSink is where a file's augmented rows are written. Once they all
+// are, commit makes the output appear under its name, while abort, for a
+// file which failed or was interrupted, discards what was written.
+type outputSink interface {
+	Write(p []byte) (int, error)
+	commit() error
+	abort()
+}
+
+// sinkSchemes open the outputs named by a URL with the scheme, like
+// s3://bucket/list_augmented.tsv, given by -out. None are built in, as
+// each needs its provider's SDK. To add one, register a function which
+// returns an outputSink that uploads what's written when it's committed,
+// in an init function in a file of its own, built with a tag so others
+// needn't fetch the SDK:
+//
+//	//go:build s3
+//
+//	func init() {
+//		sinkSchemes["s3"] = newS3Sink
+//	}
+var sinkSchemes = map[string]func(location string) (outputSink, error){}
+
+// sinkScheme returns the scheme of an output named by a URL, or ""
+// for a local path.
+func sinkScheme(location string) string {
+	scheme, _, ok := strings.Cut(location, "://")
+	if !ok || len(scheme) < 2 || strings.ContainsAny(scheme, `/\`) {
+		// Not a URL, or a Windows path like C://data.
+		return ""
+	}
+	return scheme
+}
+
+// openSink opens the output named modified, written to partial when it's
+// a local file. flags are passed to os.OpenFile, to append when resuming.
+func openSink(modified, partial string, flags int) (outputSink, error) {
+	if scheme := sinkScheme(modified); scheme != "" {
+		open, ok := sinkSchemes[scheme]
+		if !ok {
+			return nil, fmt.Errorf("unable to write %v, there's no output sink for %v:// URLs", modified, scheme)
+		}
+		return open(modified)
+	}
+	file, err := os.OpenFile(partial, flags, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("%v - unable to open file %v for writing", err, partial)
+	}
+	return &fileSink{File: file, partial: partial, path: modified}, nil
+}
+
+// fileSink writes a local file beside the finished one, and renames it
+// once it's complete, so it's never seen half written.
+type fileSink struct {
+	*os.File
+	partial, path string
+}
+
+func (f *fileSink) commit() error {
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%v - unable to close %v", err, f.partial)
+	}
+	if err := os.Rename(f.partial, f.path); err != nil {
+		return fmt.Errorf("%v - unable to rename %v to %v", err, f.partial, f.path)
+	}
+	return nil
+}
+
+// abort leaves the partial file for -resume to finish, unless
+// -keep-partial is off.
+func (f *fileSink) abort() {
+	f.Close()
+	if !*keepPartial {
+		os.Remove(f.partial)
+	}
+}
+
+// stdoutSink writes to stdout, where the output is finished as it's
+// written, so there's nothing to commit or discard.
+type stdoutSink struct{}
+
+func (stdoutSink) Write(p []byte) (int, error) {
+	return stdout.Write(p)
+}
+
+func (stdoutSink) commit() error {
+	return nil
+}
+
+func (stdoutSink) abort() {}
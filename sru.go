@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sruClient is shared by all SRU searches.
+var sruClient = newSRUClient(nil)
+
+// newSRUClient returns a client for SRU searches sent through the proxy,
+// or when it's nil, the one HTTP_PROXY, HTTPS_PROXY and NO_PROXY give.
+func newSRUClient(proxy *url.URL) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return &http.Client{Transport: transport, Timeout: 60 * time.Second}
+}
+
+// parseProxy parses the -proxy URL, which must be http, https or socks5.
+func parseProxy(value string) (*url.URL, error) {
+	proxy, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("%v - unable to parse proxy %v", err, value)
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("proxy %v must be an http, https or socks5 URL", value)
+	}
+	if proxy.Host == "" {
+		return nil, fmt.Errorf("proxy %v has no host", value)
+	}
+	return proxy, nil
+}
+
+// sruSearch is the SRU equivalent of z3950Search, searching the target's
+// base URL for each term in turn with a CQL query on the access point's index.
+func sruSearch(ctx context.Context, terms []string, t target, ap accessPoint) (searchResult, error) {
+	found := searchResult{threshold: t.minHits()}
+	for _, term := range terms {
+		result, err := sruQuery(ctx, t, ap.cqlQuery(term))
+		if err != nil {
+			return found, err
+		}
+		result.threshold = found.threshold
+		if found.diagnostic == "" {
+			found.diagnostic = result.diagnostic
+		}
+		if result.found() {
+			found.hits = result.hits
+			found.matched = term
+			break
+		}
+	}
+	return found, nil
+}
+
+// sruSearchOr is the SRU equivalent of z3950SearchOr.
+func sruSearchOr(ctx context.Context, terms []string, t target, ap accessPoint) (searchResult, error) {
+	return sruQuery(ctx, t, ap.cqlOr(terms))
+}
+
+// sruQuery runs one searchRetrieve request, asking for no records, just the
+// count. The target's credentials, if any, are sent with basic authentication.
+func sruQuery(ctx context.Context, t target, query string) (searchResult, error) {
+	found := searchResult{}
+
+	u, err := url.Parse(t.Host)
+	if err != nil {
+		return found, fmt.Errorf("%v - unable to parse SRU URL %v", err, t.Host)
+	}
+	values := u.Query()
+	values.Set("operation", "searchRetrieve")
+	values.Set("version", "1.2")
+	values.Set("query", query)
+	values.Set("maximumRecords", "0")
+	u.RawQuery = values.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return found, err
+	}
+	for name, value := range t.Headers {
+		request.Header.Set(name, value)
+	}
+	request.Header.Set("User-Agent", t.userAgent())
+	if t.User != "" || t.Password != "" {
+		request.SetBasicAuth(t.User, t.Password)
+	}
+	response, err := sruClient.Do(request)
+	if err != nil {
+		return found, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return found, fmt.Errorf("SRU server %v returned %v", u.Host, response.Status)
+	}
+	return parseSRU(response.Body)
+}
+
+// parseSRU reads the numberOfRecords and the first diagnostic's
+// number from an SRU searchRetrieveResponse.
+func parseSRU(r io.Reader) (searchResult, error) {
+	found := searchResult{}
+	sawCount := false
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return found, fmt.Errorf("%v - unable to parse SRU response", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "numberOfRecords":
+			var count string
+			if err := decoder.DecodeElement(&count, &start); err != nil {
+				return found, fmt.Errorf("%v - unable to parse SRU response", err)
+			}
+			found.hits, _ = strconv.Atoi(strings.TrimSpace(count))
+			sawCount = true
+		case "uri":
+			// Diagnostics are identified like info:srw/diagnostic/1/16.
+			var uri string
+			if err := decoder.DecodeElement(&uri, &start); err != nil {
+				return found, fmt.Errorf("%v - unable to parse SRU response", err)
+			}
+			if found.diagnostic == "" && strings.Contains(uri, "diagnostic") {
+				found.diagnostic = path.Base(strings.TrimSpace(uri))
+			}
+		}
+	}
+	if !sawCount && found.diagnostic == "" {
+		return found, errNoResults
+	}
+	return found, nil
+}
+
+// cqlTerm quotes a search term for a CQL query.
+func cqlTerm(term string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(term) + `"`
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSRUProxy(t *testing.T) {
+	// The proxy answers every request itself, as the target's host doesn't exist.
+	proxied := []string{}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte(`<searchRetrieveResponse xmlns="http://www.loc.gov/zing/srw/"><version>1.2</version><numberOfRecords>3</numberOfRecords></searchRetrieveResponse>`))
+	}))
+	defer proxy.Close()
+	proxyURL, err := parseProxy(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := sruClient
+	t.Cleanup(func() { sruClient = previous })
+	sruClient = newSRUClient(proxyURL)
+
+	target := target{Name: "S", Protocol: "sru", Host: "http://sru.example.invalid/sru"}
+	result, err := sruSearch(context.Background(), []string{"0306406152"}, target, isbnAccess)
+	if err != nil {
+		t.Fatalf("sruSearch through the proxy error = %v", err)
+	}
+	if !result.found() || result.hits != 3 {
+		t.Errorf("sruSearch = %+v, want 3 hits", result)
+	}
+	if len(proxied) != 1 {
+		t.Fatalf("the proxy was sent %v requests, want 1", len(proxied))
+	}
+	u, _ := url.Parse(proxied[0])
+	if u.Host != "sru.example.invalid" || u.Path != "/sru" || u.Query().Get("operation") != "searchRetrieve" {
+		t.Errorf("the proxy was sent %v, want the target's searchRetrieve", proxied[0])
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	tests := []struct {
+		value string
+		err   string
+	}{
+		{"http://proxy.example.org:3128", ""},
+		{"socks5://127.0.0.1:1080", ""},
+		{"ftp://proxy.example.org", "must be an http, https or socks5 URL"},
+		{"http://", "has no host"},
+		{"proxy.example.org:3128", "must be an http, https or socks5 URL"},
+	}
+	for _, tt := range tests {
+		_, err := parseProxy(tt.value)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("parseProxy(%q) error = %v, want %q", tt.value, err, tt.err)
+		}
+	}
+}
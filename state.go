@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// runState is the -state file, which records how many of each input
+// file's data rows have been written, as a checkpoint -resume can skip
+// to without counting the rows of the output, which may have been moved
+// to another system.
+type runState struct {
+	path string
+
+	mu sync.Mutex
+	// The rows written, by the input file's absolute path.
+	files     map[string]int
+	lastWrite time.Time
+}
+
+// stateInterval is how often the state file is rewritten as rows are.
+const stateInterval = time.Second
+
+// loadState reads the state file at path, which needn't exist yet.
+func loadState(path string) (*runState, error) {
+	s := &runState{path: path, files: map[string]int{}, lastWrite: time.Now()}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v - unable to read state file %v", err, path)
+	}
+	if err := json.Unmarshal(data, &s.files); err != nil {
+		return nil, fmt.Errorf("%v - unable to parse state file %v", err, path)
+	}
+	return s, nil
+}
+
+// rows returns the number of the file's rows written, if it's recorded.
+func (s *runState) rows(filename string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, ok := s.files[filename]
+	return rows, ok
+}
+
+// record notes the file's rows up to row have been written. The state
+// file is rewritten at most every stateInterval, once flush has written
+// the output's buffered rows, so it never counts rows the output lacks.
+func (s *runState) record(filename string, row int, flush func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[filename] = row
+	if time.Since(s.lastWrite) < stateInterval {
+		return nil
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return s.writeLocked()
+}
+
+// save rewrites the state file, once a file's output is finished.
+func (s *runState) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeLocked()
+}
+
+// forget drops the file, whose output was removed, and rewrites the
+// state file.
+func (s *runState) forget(filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, filename)
+	return s.writeLocked()
+}
+
+// writeLocked replaces the state file, writing beside it and renaming
+// so it's never seen half written. The caller holds mu.
+func (s *runState) writeLocked() error {
+	data, err := json.MarshalIndent(s.files, "", "  ")
+	if err != nil {
+		return err
+	}
+	partial := s.path + ".partial"
+	if err := os.WriteFile(partial, append(data, '\n'), 0666); err != nil {
+		return fmt.Errorf("%v - unable to write state file %v", err, partial)
+	}
+	if err := os.Rename(partial, s.path); err != nil {
+		return fmt.Errorf("%v - unable to rename %v to %v", err, partial, s.path)
+	}
+	s.lastWrite = time.Now()
+	return nil
+}
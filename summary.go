@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// summary counts what happened to the rows of one file, or of the whole run.
+type summary struct {
+	mu       sync.Mutex
+	rows     int
+	withISBN int
+	// Rows found in each target, in the order of targets.
+	found    []int
+	notFound int
+	errors   int
+	// Rows not searched as their ISBNs all had a -skip-isbn-prefixes prefix.
+	skipped int
+	// How long each target took per row, in the order of targets.
+	timings []timing
+	// Why the run was cut short, if it was.
+	stopped string
+	// Files skipped as processing them panicked.
+	panicked []string
+	// Files stopped by the -file-timeout.
+	timedOut []string
+}
+
+func newSummary() *summary {
+	return &summary{found: make([]int, len(targets)), timings: make([]timing, len(targets))}
+}
+
+// timing aggregates how long a target's searches took for each row.
+type timing struct {
+	rows     int
+	total    time.Duration
+	min, max time.Duration
+}
+
+func (t *timing) add(rows int, total, min, max time.Duration) {
+	if rows == 0 {
+		return
+	}
+	if t.rows == 0 || min < t.min {
+		t.min = min
+	}
+	if max > t.max {
+		t.max = max
+	}
+	t.rows += rows
+	t.total += total
+}
+
+// record counts a row, its results are nil for -dry-run.
+func (s *summary) record(isbns []string, results []targetResult) {
+	s.rows++
+	if len(isbns) > 0 {
+		s.withISBN++
+	}
+	if results == nil {
+		return
+	}
+	if len(results) > 0 && results[0].skipped {
+		s.skipped++
+		return
+	}
+	held := false
+	for i, result := range results {
+		if result.found {
+			s.found[i]++
+			held = true
+		}
+		if result.failed && !result.found {
+			s.errors++
+		}
+		if result.elapsed > 0 {
+			s.timings[i].add(1, result.elapsed, result.elapsed, result.elapsed)
+		}
+	}
+	if !held {
+		s.notFound++
+	}
+}
+
+// merge adds a file's counts to the run's.
+func (s *summary) merge(file *summary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rows += file.rows
+	s.withISBN += file.withISBN
+	for i := range file.found {
+		s.found[i] += file.found[i]
+	}
+	s.notFound += file.notFound
+	s.errors += file.errors
+	s.skipped += file.skipped
+	for i, t := range file.timings {
+		s.timings[i].add(t.rows, t.total, t.min, t.max)
+	}
+}
+
+// addPanicked counts a file which processing panicked on.
+func (s *summary) addPanicked(filename string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.panicked = append(s.panicked, filename)
+}
+
+// addTimedOut counts a file the -file-timeout stopped.
+func (s *summary) addTimedOut(filename string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timedOut = append(s.timedOut, filename)
+}
+
+// percentOf returns n as a percentage of total, or 0 if there are none.
+func percentOf(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// ANSI escape codes for the summary's colours.
+const (
+	ansiGreen = "\x1b[32m"
+	ansiRed   = "\x1b[31m"
+	ansiReset = "\x1b[0m"
+)
+
+// useColor reports whether to colour what's written to f, a terminal,
+// unless the NO_COLOR environment variable is set.
+func useColor(f *os.File) bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// write prints the summary of a run which took elapsed, with found
+// counts in green and error counts in red when color is set.
+func (s *summary) write(w io.Writer, elapsed time.Duration, color bool) error {
+	paint := func(code string, n int) string {
+		if !color {
+			return strconv.Itoa(n)
+		}
+		return code + strconv.Itoa(n) + ansiReset
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "rows: %v\n", s.rows)
+	fmt.Fprintf(&b, "rows with an ISBN: %v\n", s.withISBN)
+	// Those which could only be searched by title, if at all, a
+	// measure of how much of the source data needs cleaning up.
+	without := s.rows - s.withISBN
+	fmt.Fprintf(&b, "rows without ISBN: %v (%.1f%%)\n", without, percentOf(without, s.rows))
+	for i, t := range targets {
+		fmt.Fprintf(&b, "found in %v: %v\n", t.Name, paint(ansiGreen, s.found[i]))
+	}
+	fmt.Fprintf(&b, "not found anywhere: %v\n", s.notFound)
+	if s.skipped > 0 {
+		fmt.Fprintf(&b, "skipped by ISBN prefix: %v\n", s.skipped)
+	}
+	fmt.Fprintf(&b, "query errors: %v\n", paint(ansiRed, s.errors))
+	if *timings {
+		for i, t := range targets {
+			timing := s.timings[i]
+			if timing.rows == 0 {
+				continue
+			}
+			average := timing.total / time.Duration(timing.rows)
+			fmt.Fprintf(&b, "search time in %v: min %v, avg %v, max %v\n", t.Name, timing.min.Round(time.Millisecond), average.Round(time.Millisecond), timing.max.Round(time.Millisecond))
+		}
+	}
+	if len(s.panicked) > 0 {
+		sort.Strings(s.panicked)
+		fmt.Fprintf(&b, "files which panicked: %v\n", paint(ansiRed, len(s.panicked)))
+		for _, filename := range s.panicked {
+			fmt.Fprintf(&b, "  %v\n", filename)
+		}
+	}
+	if len(s.timedOut) > 0 {
+		sort.Strings(s.timedOut)
+		fmt.Fprintf(&b, "files which timed out: %v\n", paint(ansiRed, len(s.timedOut)))
+		for _, filename := range s.timedOut {
+			fmt.Fprintf(&b, "  %v\n", filename)
+		}
+	}
+	fmt.Fprintf(&b, "elapsed: %v\n", elapsed.Round(time.Millisecond))
+	if s.stopped != "" {
+		fmt.Fprintf(&b, "stopped early: %v\n", s.stopped)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,907 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// target is a library catalogue searched over Z39.50.
+type target struct {
+	// Name identifies the target in logs and column headers.
+	Name string `json:"name"`
+	// Protocol is z3950, the default, sru, or worldcat for the WorldCat
+	// Search API or a union catalogue serving it.
+	Protocol string `json:"protocol,omitempty"`
+	// Host is the Z39.50 server, as host:port, the SRU base URL, or the
+	// WorldCat Search API's, like
+	// https://americas.discovery.api.oclc.org/worldcat/search/v2.
+	Host string `json:"host"`
+	// Database is the optional database name on the server, or Databases
+	// several of them, searched together so a record in any is found.
+	Database  string   `json:"database,omitempty"`
+	Databases []string `json:"databases,omitempty"`
+	// Optional credentials, which may reference environment variables
+	// like "${UOFT_PASSWORD}" to keep them out of the config file. Only
+	// the braced form is expanded, so a bare $ in a password is kept.
+	User     string `json:"user,omitempty"`
+	Group    string `json:"group,omitempty"`
+	Password string `json:"password,omitempty"`
+	// APIKey and APISecret are a worldcat target's WSKey, exchanged for
+	// access tokens. They may reference environment variables too.
+	APIKey    string `json:"apiKey,omitempty"`
+	APISecret string `json:"apiSecret,omitempty"`
+	// Charset, such as utf-8 or marc8, is passed to yaz-client's charset
+	// command so the records' text, like fetched titles, isn't garbled.
+	Charset string `json:"charset,omitempty"`
+	// YazArgs are extra yaz-client command line options, like
+	// ["-p", "proxy.example.org:210"], passed when searching the target,
+	// see yazOptions. Values may reference environment variables.
+	YazArgs []string `json:"yazArgs,omitempty"`
+	// UserAgent replaces the User-Agent sent to an SRU or worldcat
+	// target, and Headers are sent as well, for endpoints which block or
+	// limit unidentified clients. Header values may reference environment
+	// variables, like the credentials.
+	UserAgent string            `json:"userAgent,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	// FoundColumn and SearchColumn label the two appended columns, and
+	// Columns the others, by kind. Each may use {name} for the target's
+	// name in capitals, see defaultColumns.
+	FoundColumn  string            `json:"foundColumn,omitempty"`
+	SearchColumn string            `json:"searchColumn,omitempty"`
+	Columns      map[string]string `json:"columns,omitempty"`
+	// MinHits is how many records a search must find to count as found,
+	// 1 by default, for catalogues which report loose matches.
+	MinHits int `json:"minHits,omitempty"`
+	// FoundIf is a rule one of the records found must meet too, see
+	// recordRule, for catalogues whose hits aren't all holdings.
+	FoundIf *recordRule `json:"foundIf,omitempty"`
+	// Delay overrides -delay, the pause after searching the target.
+	Delay *duration `json:"delay,omitempty"`
+	// Rate limits the queries started each second against the target,
+	// within the -rate limit of the whole run.
+	Rate      float64 `json:"rate,omitempty"`
+	rateLimit *rateLimiter
+	// ISBNAttributes and TitleAttributes override the bib-1 attributes
+	// of each kind of search, for example "@attr 1=7 @attr 4=1".
+	ISBNAttributes  attributes `json:"isbnAttributes,omitempty"`
+	TitleAttributes attributes `json:"titleAttributes,omitempty"`
+	OCLCAttributes  attributes `json:"oclcAttributes,omitempty"`
+	LCCNAttributes  attributes `json:"lccnAttributes,omitempty"`
+	ISMNAttributes  attributes `json:"ismnAttributes,omitempty"`
+	// AuthorAttributes are ANDed with the title's, see -title-author-fallback.
+	AuthorAttributes attributes `json:"authorAttributes,omitempty"`
+
+	// Catalogue search links, with {isbn}, {oclc}, {lccn}, {ismn} or
+	// {title} replaced. Found links are used when the target held the
+	// ISBN, OCLC number, LCCN or ISMN, otherwise the not found link,
+	// usually a title search.
+	FoundURLTemplate    string `json:"foundURLTemplate,omitempty"`
+	OCLCURLTemplate     string `json:"oclcURLTemplate,omitempty"`
+	LCCNURLTemplate     string `json:"lccnURLTemplate,omitempty"`
+	ISMNURLTemplate     string `json:"ismnURLTemplate,omitempty"`
+	NotFoundURLTemplate string `json:"notFoundURLTemplate,omitempty"`
+	// NoFallbackURL leaves the not found link blank, like -no-fallback-url
+	// for just this target, for catalogues without a usable title search.
+	NoFallbackURL bool `json:"noFallbackURL,omitempty"`
+	// SearchTypes are the catalogue's tokens for each kind of search,
+	// isbn, oclc, lccn, ismn, title and keyword, replacing {searchType}
+	// in the links.
+	// The not found link uses the -not-found-search kind.
+	SearchTypes map[string]string `json:"searchTypes,omitempty"`
+}
+
+// duration is a time.Duration written as a string like "250ms" in the config.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// attributes are bib-1 attribute type and value pairs, written in
+// the config in yaz's prefix query format, like "@attr 1=7 @attr 4=1".
+type attributes [][2]int
+
+func (a *attributes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := parseAttributes(s)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+func (a attributes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(accessPoint{attributes: a}.pqf())
+}
+
+// parseAttributes parses a list of "@attr type=value" pairs.
+func parseAttributes(s string) (attributes, error) {
+	parsed := attributes{}
+	fields := strings.Fields(s)
+	for i := 0; i < len(fields); i += 2 {
+		if fields[i] != "@attr" || i+1 == len(fields) {
+			return nil, fmt.Errorf("invalid attributes %q, expected a list of @attr type=value", s)
+		}
+		var attribute [2]int
+		if _, err := fmt.Sscanf(fields[i+1], "%d=%d", &attribute[0], &attribute[1]); err != nil {
+			return nil, fmt.Errorf("invalid attribute %q in %q, expected type=value", fields[i+1], s)
+		}
+		parsed = append(parsed, attribute)
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("invalid attributes %q, at least one is needed", s)
+	}
+	return parsed, nil
+}
+
+// config is the structure of the file passed to -config.
+type config struct {
+	// Targets is a list rather than an object keyed by name so their
+	// columns are appended in the order listed, and every run over
+	// the same file writes the same header.
+	Targets []target `json:"targets"`
+	// Settings set flags by name, like "delay": "1s", unless they're
+	// given on the command line or in the environment.
+	Settings map[string]any `json:"settings,omitempty"`
+}
+
+// builtinTargets are searched when no -config file is given.
+func builtinTargets() []target {
+	return []target{
+		{
+			Name:                "UofO",
+			Host:                "orbis.uottawa.ca:210",
+			Database:            "INNOPAC",
+			FoundURLTemplate:    "https://orbis.uottawa.ca/search/?searchtype={searchType}&SORT=D&searcharg={isbn}",
+			OCLCURLTemplate:     "https://orbis.uottawa.ca/search/?searchtype={searchType}&SORT=D&searcharg={oclc}",
+			NotFoundURLTemplate: "https://orbis.uottawa.ca/search/?searchtype={searchType}&SORT=D&searcharg={title}",
+			SearchTypes:         map[string]string{"isbn": "i", "oclc": "o", "title": "t", "keyword": "X"},
+		},
+		{
+			Name:                "UofT",
+			Host:                "sirsi.library.utoronto.ca:2200",
+			FoundURLTemplate:    "https://onesearch.library.utoronto.ca/onesearch/{isbn}//",
+			OCLCURLTemplate:     "https://onesearch.library.utoronto.ca/onesearch/{oclc}//",
+			NotFoundURLTemplate: "https://onesearch.library.utoronto.ca/onesearch/{title}//{searchType}",
+			SearchTypes:         map[string]string{"title": "title", "keyword": ""},
+		},
+	}
+}
+
+// envReference matches a ${VAR} reference to an environment variable.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${VAR} references in a config value with the
+// environment variables' values. Unlike os.ExpandEnv, a $ which isn't
+// one, like in the password pa$$word, is kept as it is.
+func expandEnv(value string) string {
+	return envReference.ReplaceAllStringFunc(value, func(reference string) string {
+		return os.Getenv(envReference.FindStringSubmatch(reference)[1])
+	})
+}
+
+// loadConfig reads a JSON config file, or from stdin if path is "-",
+// or returns the built-in targets if path is empty. YAML isn't read, as
+// the standard library has no parser for it, so a .yaml or .yml file is
+// refused rather than failing to parse as JSON.
+func loadConfig(path string) (config, error) {
+	if path == "" {
+		return config{Targets: builtinTargets()}, nil
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		return config{}, fmt.Errorf("config file %v is YAML, which isn't supported, write it as JSON", path)
+	}
+
+	var file io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return config{}, fmt.Errorf("%v - unable to open config file %v", err, path)
+		}
+		defer f.Close()
+		file = f
+	} else {
+		path = "stdin"
+	}
+
+	c := config{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	// Settings' numbers are kept as written, so 1000000 isn't 1e+06.
+	decoder.UseNumber()
+	if err := decoder.Decode(&c); err != nil {
+		return config{}, fmt.Errorf("%v - unable to parse config file %v", err, path)
+	}
+
+	if len(c.Targets) == 0 {
+		return config{}, fmt.Errorf("config file %v has no targets", path)
+	}
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		if t.Name == "" || t.Host == "" {
+			return config{}, fmt.Errorf("target %v in config file %v needs a name and host", i+1, path)
+		}
+		switch t.Protocol {
+		case "", "z3950", "sru", "worldcat":
+		default:
+			return config{}, fmt.Errorf("target %v in config file %v has protocol %q, it must be z3950, sru or worldcat", t.Name, path, t.Protocol)
+		}
+		t.User = expandEnv(t.User)
+		t.Group = expandEnv(t.Group)
+		t.Password = expandEnv(t.Password)
+		t.APIKey = expandEnv(t.APIKey)
+		t.APISecret = expandEnv(t.APISecret)
+		if t.Protocol == "worldcat" && (t.APIKey == "" || t.APISecret == "") {
+			return config{}, fmt.Errorf("target %v in config file %v needs an apiKey and apiSecret to search WorldCat", t.Name, path)
+		}
+		if t.Protocol != "worldcat" && (t.APIKey != "" || t.APISecret != "") {
+			return config{}, fmt.Errorf("target %v in config file %v has an apiKey or apiSecret, which are only used by worldcat targets", t.Name, path)
+		}
+		if t.overHTTP() && len(t.YazArgs) > 0 {
+			return config{}, fmt.Errorf("target %v in config file %v has yazArgs, which are only passed to yaz-client for Z39.50 targets", t.Name, path)
+		}
+		for j, arg := range t.YazArgs {
+			t.YazArgs[j] = expandEnv(arg)
+		}
+		if err := checkYazArgs(t.YazArgs); err != nil {
+			return config{}, fmt.Errorf("%v - target %v in config file %v has invalid yazArgs", err, t.Name, path)
+		}
+		if !t.overHTTP() && (t.UserAgent != "" || len(t.Headers) > 0) {
+			return config{}, fmt.Errorf("target %v in config file %v has a userAgent or headers, which are only sent to SRU and worldcat targets", t.Name, path)
+		}
+		for name, value := range t.Headers {
+			value = expandEnv(value)
+			if name == "" || strings.ContainsAny(name, ": \t\r\n") || strings.ContainsAny(value, "\r\n") {
+				return config{}, fmt.Errorf("target %v in config file %v has an invalid header %q", t.Name, path, name)
+			}
+			t.Headers[name] = value
+		}
+		if strings.ContainsAny(t.UserAgent, "\r\n") {
+			return config{}, fmt.Errorf("target %v in config file %v has a userAgent with a line break", t.Name, path)
+		}
+		if t.Rate < 0 {
+			return config{}, fmt.Errorf("target %v in config file %v has a negative rate", t.Name, path)
+		}
+		t.rateLimit = newRateLimiter(t.Rate)
+		if t.FoundIf != nil && t.Protocol != "" && t.Protocol != "z3950" {
+			return config{}, fmt.Errorf("target %v in config file %v has a foundIf rule, which only Z39.50 targets can check", t.Name, path)
+		}
+		if t.MinHits < 0 {
+			return config{}, fmt.Errorf("target %v in config file %v has a negative minHits", t.Name, path)
+		}
+		if t.Database != "" && len(t.Databases) > 0 {
+			return config{}, fmt.Errorf("target %v in config file %v has both a database and databases, list them all in databases", t.Name, path)
+		}
+		for _, database := range t.Databases {
+			if database == "" || strings.ContainsAny(database, "+/ ") {
+				return config{}, fmt.Errorf("target %v in config file %v has a database named %q, names can't be blank or have a +, / or space", t.Name, path, database)
+			}
+		}
+		for kind := range t.Columns {
+			if _, ok := defaultColumns[kind]; !ok || kind == "found" || kind == "search" {
+				return config{}, fmt.Errorf("target %v in config file %v has a column %q, it must be fallback, diag, accessPoint, hits, matchedISBNs, matchedTitle, titleMatch, holdings or ms", t.Name, path, kind)
+			}
+		}
+		for _, template := range []string{t.FoundURLTemplate, t.OCLCURLTemplate, t.LCCNURLTemplate, t.ISMNURLTemplate, t.NotFoundURLTemplate} {
+			for _, placeholder := range placeholders(template) {
+				if !knownPlaceholders[placeholder] {
+					return config{}, fmt.Errorf("target %v in config file %v has an unknown placeholder %v in the link %q", t.Name, path, placeholder, template)
+				}
+			}
+		}
+	}
+	if err := checkCollisions(c.Targets); err != nil {
+		return config{}, fmt.Errorf("%v in config file %v", err, path)
+	}
+	return c, nil
+}
+
+// knownPlaceholders are those searchURL replaces in a target's links.
+var knownPlaceholders = map[string]bool{"{isbn}": true, "{oclc}": true, "{lccn}": true, "{ismn}": true, "{title}": true, "{searchType}": true}
+
+// placeholders returns the {placeholders} in a link template.
+func placeholders(template string) []string {
+	found := []string{}
+	for {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			return found
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			return append(found, template[start:])
+		}
+		found = append(found, template[start:start+end+1])
+		template = template[start+end+1:]
+	}
+}
+
+// checkCollisions reports targets sharing a name, which -targets
+// couldn't tell apart, or an appended column label, which would
+// make the output ambiguous.
+func checkCollisions(targets []target) error {
+	names := map[string]string{}
+	labels := map[string]string{"ISBN10": "", "ISBN13": "", "RECOMMENDATION": "", "SOURCE FILE": ""}
+	for _, t := range targets {
+		if other, ok := names[strings.ToLower(t.Name)]; ok {
+			return fmt.Errorf("targets %v and %v have the same name", other, t.Name)
+		}
+		names[strings.ToLower(t.Name)] = t.Name
+		for _, kind := range columnKinds {
+			label := t.column(kind)
+			if other, ok := labels[label]; ok {
+				if other == "" {
+					return fmt.Errorf("target %v has a column labelled %v, like another appended column", t.Name, label)
+				}
+				return fmt.Errorf("targets %v and %v both have a column labelled %v", other, t.Name, label)
+			}
+			labels[label] = t.Name
+		}
+	}
+	return nil
+}
+
+// selectTargets returns the named targets, in the order given
+// in the comma separated list.
+func selectTargets(all []target, list string) ([]target, error) {
+	selected := []target{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		for _, t := range selected {
+			if strings.EqualFold(t.Name, name) {
+				return nil, fmt.Errorf("target %q is listed twice", name)
+			}
+		}
+		found := false
+		for _, t := range all {
+			if strings.EqualFold(t.Name, name) {
+				selected = append(selected, t)
+				found = true
+				break
+			}
+		}
+		if !found {
+			available := []string{}
+			for _, t := range all {
+				available = append(available, t.Name)
+			}
+			return nil, fmt.Errorf("no target named %q, the targets are %v", name, strings.Join(available, ", "))
+		}
+	}
+	return selected, nil
+}
+
+// accessPoint is a kind of search, selected by its bib-1 use
+// attribute, or its CQL index for SRU targets.
+type accessPoint struct {
+	name       string
+	attributes attributes
+	cql        string
+	// and is searched for too, with the second part of the term.
+	and *accessPoint
+}
+
+var (
+	isbnAccess  = accessPoint{name: "isbn", attributes: attributes{{1, 7}}, cql: "bath.isbn"}
+	titleAccess = accessPoint{name: "title", attributes: attributes{{1, 4}}, cql: "dc.title"}
+	// The system control number, searched for OCLC numbers.
+	oclcAccess = accessPoint{name: "oclc", attributes: attributes{{1, 12}}, cql: "rec.id"}
+	lccnAccess = accessPoint{name: "lccn", attributes: attributes{{1, 9}}, cql: "bath.lccn"}
+	// Any standard identifier, as bib-1 has none for the ISMN.
+	ismnAccess = accessPoint{name: "ismn", attributes: attributes{{1, 1007}}, cql: "bath.standardIdentifier"}
+	// The author's name, ANDed with the title, since common titles
+	// alone match other books. Its terms are from titleAuthorTerm.
+	authorAccess      = accessPoint{name: "author", attributes: attributes{{1, 1003}}, cql: "dc.creator"}
+	titleAuthorAccess = accessPoint{name: "title+author", attributes: titleAccess.attributes, cql: titleAccess.cql, and: &authorAccess}
+)
+
+// titleAuthorTerm joins a title and author into a term of
+// titleAuthorAccess, as in "The cat / Smith".
+func titleAuthorTerm(title, author string) string {
+	return title + " / " + author
+}
+
+// clauses returns the term of each search the access point makes, the
+// title and the author for titleAuthorAccess.
+func (a accessPoint) clauses(term string) []string {
+	if a.and == nil {
+		return []string{term}
+	}
+	title, author, _ := strings.Cut(term, " / ")
+	return []string{title, author}
+}
+
+// pqfQuery returns the PQF query for the term, like @attr 1=7 "term",
+// ANDing the searches of an access point which makes two.
+func (a accessPoint) pqfQuery(term string) string {
+	clauses := a.clauses(term)
+	query := a.pqf() + " \"" + pqfTerm(clauses[0]) + "\""
+	if a.and != nil {
+		query = "@and " + query + " " + a.and.pqf() + " \"" + pqfTerm(clauses[1]) + "\""
+	}
+	return query
+}
+
+// cqlQuery returns the CQL query for the term, like bath.isbn=term.
+func (a accessPoint) cqlQuery(term string) string {
+	clauses := a.clauses(term)
+	query := a.cql + "=" + cqlTerm(clauses[0])
+	if a.and != nil {
+		query += " and " + a.and.cql + "=" + cqlTerm(clauses[1])
+	}
+	return query
+}
+
+// pqf returns the attributes in yaz's prefix query format.
+func (a accessPoint) pqf() string {
+	parts := []string{}
+	for _, attribute := range a.attributes {
+		parts = append(parts, fmt.Sprintf("@attr %v=%v", attribute[0], attribute[1]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// pqfOr returns a PQF query matching any of the terms by the access point,
+// such as @or @attr 1=7 "a" @attr 1=7 "b".
+func (a accessPoint) pqfOr(terms []string) string {
+	query := strings.Repeat("@or ", len(terms)-1)
+	for i, term := range terms {
+		if i > 0 {
+			query += " "
+		}
+		query += a.pqf() + " \"" + pqfTerm(term) + "\""
+	}
+	return query
+}
+
+// cqlOr returns a CQL query matching any of the terms by the access point.
+func (a accessPoint) cqlOr(terms []string) string {
+	clauses := []string{}
+	for _, term := range terms {
+		clauses = append(clauses, a.cql+"="+cqlTerm(term))
+	}
+	return strings.Join(clauses, " or ")
+}
+
+// cacheKey identifies a search term in the result cache. ISBNs
+// are unprefixed so existing cache files stay valid.
+func (a accessPoint) cacheKey(term string) string {
+	if a.name == isbnAccess.name {
+		return term
+	}
+	return a.name + ":" + term
+}
+
+// defaultColumns label each kind of appended column,
+// with {name} replaced by the target's name in capitals.
+var defaultColumns = map[string]string{
+	"found":        "FOUND IN {name} CATALOGUE",
+	"search":       "{name} CATALOGUE SEARCH",
+	"fallback":     "{name} FALLBACK SEARCH",
+	"diag":         "{name} DIAG",
+	"accessPoint":  "{name} ACCESS POINT",
+	"hits":         "{name} HITS",
+	"matchedISBNs": "{name} MATCHED ISBNS",
+	"matchedTitle": "{name} MATCHED TITLE",
+	"titleMatch":   "{name} TITLE MATCH",
+	"holdings":     "{name} HOLDINGS",
+	"ms":           "{name} MS",
+}
+
+// columnKinds are the kinds of appended column, in the order they're checked.
+var columnKinds = []string{"found", "search", "fallback", "diag", "accessPoint", "hits", "matchedISBNs", "matchedTitle", "titleMatch", "holdings", "ms"}
+
+// column returns the label of the target's appended column of the kind.
+func (t target) column(kind string) string {
+	label := t.Columns[kind]
+	switch kind {
+	case "found":
+		label = t.FoundColumn
+	case "search":
+		label = t.SearchColumn
+	}
+	if label == "" {
+		label = defaultColumns[kind]
+	}
+	return strings.ReplaceAll(label, "{name}", strings.ToUpper(t.Name))
+}
+
+// withAttributes returns the access point with the
+// target's attributes for it, if the config sets any.
+func (t target) withAttributes(ap accessPoint) accessPoint {
+	switch {
+	case ap.name == isbnAccess.name && t.ISBNAttributes != nil:
+		ap.attributes = t.ISBNAttributes
+	case ap.name == titleAccess.name && t.TitleAttributes != nil:
+		ap.attributes = t.TitleAttributes
+	case ap.name == oclcAccess.name && t.OCLCAttributes != nil:
+		ap.attributes = t.OCLCAttributes
+	case ap.name == lccnAccess.name && t.LCCNAttributes != nil:
+		ap.attributes = t.LCCNAttributes
+	case ap.name == ismnAccess.name && t.ISMNAttributes != nil:
+		ap.attributes = t.ISMNAttributes
+	case ap.name == authorAccess.name && t.AuthorAttributes != nil:
+		ap.attributes = t.AuthorAttributes
+	case ap.name == titleAuthorAccess.name:
+		if t.TitleAttributes != nil {
+			ap.attributes = t.TitleAttributes
+		}
+		author := t.withAttributes(*ap.and)
+		ap.and = &author
+	}
+	return ap
+}
+
+// yazTemplate returns the yaz-client command script searching the
+// target by the access point, with a %v placeholder for the term.
+// The -template-file is used instead of the built-in script if given.
+// It's a format string, so a % in the target's credentials, charset or
+// address is doubled.
+func (t target) yazTemplate(ap accessPoint) string {
+	escape := func(s string) string { return strings.ReplaceAll(s, "%", "%%") }
+	if customTemplate != "" {
+		return strings.NewReplacer(
+			"{auth}", escape(strings.TrimSuffix(t.yazAuth(), "\n")),
+			"{charset}", escape(strings.TrimSuffix(t.yazCharset(), "\n")),
+			"{address}", escape(t.yazAddress()),
+			"{attributes}", escape(t.withAttributes(ap).pqf()),
+		).Replace(customTemplate)
+	}
+	return escape(t.yazOpen()) + yazCommands(escape(t.withAttributes(ap).pqf())+" \"%v\"")
+}
+
+// yazScript returns the yaz-client command script running the
+// PQF query against the target, followed by any other commands.
+func (t target) yazScript(query string, commands ...string) string {
+	return t.yazOpen() + yazCommands(query, commands...)
+}
+
+// yazOpen returns the yaz-client commands connecting to the target.
+func (t target) yazOpen() string {
+	return t.yazAuth() + t.yazCharset() + "open " + t.yazAddress() + "\n"
+}
+
+// yazCommands returns the yaz-client commands running the PQF query,
+// followed by the others, then closing the connection.
+func yazCommands(query string, commands ...string) string {
+	commands = append(commands, "close", "quit")
+	return "find " + query + "\n" + strings.Join(commands, "\n") + "\n"
+}
+
+// yazAddress returns the target's host, with its databases if it has
+// any, joined by + as yaz-client's open command takes several.
+func (t target) yazAddress() string {
+	if databases := t.databases(); len(databases) > 0 {
+		return t.Host + "/" + strings.Join(databases, "+")
+	}
+	return t.Host
+}
+
+// databases returns the names of the databases to search, none
+// meaning the server's default.
+func (t target) databases() []string {
+	if len(t.Databases) > 0 {
+		return t.Databases
+	}
+	if t.Database != "" {
+		return []string{t.Database}
+	}
+	return nil
+}
+
+// customTemplate is the -template-file, with %v for the term.
+var customTemplate string
+
+// loadYazTemplate reads a -template-file, a yaz-client command script
+// with {term} where the search term goes, within quotes like
+// find {attributes} "{term}", or %v as in the built-in scripts. Each
+// target's {address}, its host and database, and the search's bib-1
+// {attributes} are filled in, as are {auth} and {charset}, the target's
+// auth and charset commands, blank if it has none. It returns the
+// script with %v for the term, which must appear exactly once.
+func loadYazTemplate(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%v - unable to read template file %v", err, path)
+	}
+	template := string(data)
+	terms := strings.Count(template, "{term}")
+	if terms == 0 {
+		terms = strings.Count(template, "%v")
+		if strings.Count(template, "%") != terms {
+			return "", fmt.Errorf("template file %v has a %% other than its %%v placeholder", path)
+		}
+	} else {
+		template = strings.ReplaceAll(strings.ReplaceAll(template, "%", "%%"), "{term}", "%v")
+	}
+	if terms != 1 {
+		return "", fmt.Errorf("template file %v has %v placeholders for the term, it needs exactly one {term} or %%v", path, terms)
+	}
+	return template, nil
+}
+
+// yazCharset returns the yaz-client charset command for the target,
+// which must come before open since it's negotiated when connecting.
+func (t target) yazCharset() string {
+	if t.Charset == "" {
+		return ""
+	}
+	return "charset " + t.Charset + "\n"
+}
+
+// yazAuth returns the yaz-client auth command for the target's
+// credentials, or nothing if it has none.
+func (t target) yazAuth() string {
+	switch {
+	case t.User == "" && t.Password == "":
+		return ""
+	case t.Group != "":
+		return fmt.Sprintf("auth idPass %v %v %v\n", t.User, t.Group, t.Password)
+	}
+	return fmt.Sprintf("auth open %v/%v\n", t.User, t.Password)
+}
+
+// yazOptions are the yaz-client options a target's yazArgs may pass, each
+// followed by its value as a separate argument. They're passed to
+// yaz-client directly rather than through a shell, and anything else is
+// refused, so a stray argument can't be taken for the server to open, and
+// -f, which replaces the commands sent on stdin, and options which write
+// to stdout, where the results are read, can't be passed.
+var yazOptions = map[string]bool{
+	"-a": true, // APDU log file
+	"-b": true, // BER dump file
+	"-c": true, // CCL field definitions file
+	"-d": true, // record dump file prefix
+	"-k": true, // message size in kilobytes
+	"-m": true, // MARC log file
+	"-p": true, // proxy address
+	"-q": true, // CQL to RPN mapping file
+	"-t": true, // display character set
+	"-u": true, // authentication, like user/password
+	"-v": true, // log level
+}
+
+// checkYazArgs returns an error unless the args are options from
+// yazOptions, each with a value.
+func checkYazArgs(args []string) error {
+	for i := 0; i < len(args); i += 2 {
+		if !yazOptions[args[i]] {
+			return fmt.Errorf("%q isn't a yaz-client option which can be passed, it must be one of %v", args[i], strings.Join(sortedKeys(yazOptions), ", "))
+		}
+		if i+1 == len(args) {
+			return fmt.Errorf("yaz-client option %v needs a value after it", args[i])
+		}
+		if strings.ContainsRune(args[i+1], 0) {
+			return fmt.Errorf("the value of yaz-client option %v has a NUL character", args[i])
+		}
+	}
+	return nil
+}
+
+// minHits returns the hits a search of the target needs to count as found.
+func (t target) minHits() int {
+	if t.MinHits < 1 {
+		return 1
+	}
+	return t.MinHits
+}
+
+// userAgent returns the User-Agent sent to the SRU or worldcat target, which
+// identifies the program and its version unless the config replaces it.
+func (t target) userAgent() string {
+	if t.UserAgent != "" {
+		return t.UserAgent
+	}
+	return "well-connected-gardener/" + version
+}
+
+// overHTTP reports whether the target is searched over HTTP, by SRU or
+// the WorldCat Search API, rather than Z39.50.
+func (t target) overHTTP() bool {
+	return t.Protocol == "sru" || t.Protocol == "worldcat"
+}
+
+// delay returns how long to pause after searching the target.
+func (t target) delay() time.Duration {
+	if t.Delay != nil {
+		return t.Delay.Duration
+	}
+	return *delay
+}
+
+// searchURL returns the catalogue search link for the record's result,
+// linking to the ISBN, OCLC number, LCCN or ISMN when one was found or
+// a title search otherwise. It's blank when the target has no template for it,
+// or it didn't hold the record and has NoFallbackURL set.
+func (t target) searchURL(result targetResult, title string) string {
+	template, kind := t.NotFoundURLTemplate, *notFoundSearch
+	switch {
+	case result.isbn != "":
+		template, kind = t.FoundURLTemplate, "isbn"
+	case result.oclc != "":
+		template, kind = t.OCLCURLTemplate, "oclc"
+	case result.lccn != "":
+		template, kind = t.LCCNURLTemplate, "lccn"
+	case result.ismn != "":
+		template, kind = t.ISMNURLTemplate, "ismn"
+	case t.NoFallbackURL && !result.found:
+		return ""
+	}
+	return t.link(template, kind, result, title)
+}
+
+// fallbackURL returns the not found link, usually a title search,
+// whether or not the target held the record, for -both-urls.
+func (t target) fallbackURL(title string) string {
+	if t.NoFallbackURL {
+		return ""
+	}
+	return t.link(t.NotFoundURLTemplate, *notFoundSearch, targetResult{}, title)
+}
+
+// link fills in the template's placeholders, with the kind of search's
+// token for {searchType}.
+func (t target) link(template, kind string, result targetResult, title string) string {
+	replacer := strings.NewReplacer(
+		"{isbn}", result.isbn,
+		"{oclc}", result.oclc,
+		"{lccn}", result.lccn,
+		"{ismn}", result.ismn,
+		"{title}", urlReadyTitle(title),
+		"{searchType}", t.SearchTypes[kind],
+	)
+	return replacer.Replace(template)
+}
+
+// targetResult accumulates a record's search results for one target.
+type targetResult struct {
+	found bool
+	// The access point which produced the match.
+	accessPoint string
+	// The first ISBN the target held.
+	isbn string
+	// Every ISBN the target held, with -all-matched-isbns.
+	matchedISBNs []string
+	// The OCLC number the target held, when found that way.
+	oclc string
+	// The LCCN the target held, when found that way.
+	lccn string
+	// The ISMN the target held, when found that way.
+	ismn string
+	// The number of records found by the matching search.
+	hits int
+	// The DIAG column code.
+	diag string
+	// The catalogue search link.
+	url string
+	// The not found link, with -both-urls.
+	fallbackURL string
+	// Whether a search failed, so not finding the record means nothing.
+	failed bool
+	// The searches which failed.
+	failures []failure
+	// Whether the record had nothing to search for.
+	unsearchable bool
+	// Whether the record's ISBNs all had a -skip-isbn-prefixes prefix.
+	skipped bool
+	// The title of the first record found, with -fetch-title.
+	matchedTitle string
+	// Whether the matched title is like the record's, see -title-match.
+	titleMatch string
+	// The holdings of the records found, with -enrich holdings.
+	holdings []string
+	// How long the target's searches for the record took.
+	elapsed time.Duration
+}
+
+// addMatchedISBN notes the target held the ISBN, unless it's another
+// form of one already noted, as the batched search finds both forms.
+func (r *targetResult) addMatchedISBN(isbn string) {
+	_, isbn13 := isbnForms(isbn)
+	for _, matched := range r.matchedISBNs {
+		if _, matched13 := isbnForms(matched); matched == isbn || (isbn13 != "" && matched13 == isbn13) {
+			return
+		}
+	}
+	r.matchedISBNs = append(r.matchedISBNs, isbn)
+}
+
+// failure is a search which failed even after retrying.
+type failure struct {
+	accessPoint string
+	term        string
+	err         error
+}
+
+// fail records a search of the target which failed even after retrying.
+func (r *targetResult) fail(ap accessPoint, term string, err error) {
+	if r.found {
+		return
+	}
+	r.failed = true
+	r.diag = "error"
+	var diagnostic diagnosticError
+	switch {
+	case errors.As(err, &diagnostic):
+		r.diag = "diag:" + diagnostic.code
+	case timedOut(err):
+		r.diag = "timeout"
+	}
+	r.failures = append(r.failures, failure{accessPoint: ap.name, term: term, err: err})
+}
+
+// foundCell returns the FOUND column value, which is error rather
+// than false when a search failed and nothing else was found, and
+// n/a when the record had nothing to search for.
+func (r targetResult) foundCell() string {
+	if r.unsearchable {
+		return "n/a"
+	}
+	if r.skipped {
+		return "skipped"
+	}
+	if !r.found && r.failed {
+		return "error"
+	}
+	return strconv.FormatBool(r.found)
+}
+
+// add records the result of searching the target by the access point.
+// Once something is found, later results are ignored, but for the ISBNs
+// held, which -all-matched-isbns lists.
+func (r *targetResult) add(ap accessPoint, term string, result searchResult) {
+	if ap.name == isbnAccess.name && result.found() {
+		if result.matched != "" {
+			term = result.matched
+		}
+		r.addMatchedISBN(term)
+	}
+	if r.found {
+		return
+	}
+	if result.found() {
+		r.found = true
+		r.hits = result.hits
+		r.accessPoint = ap.name
+		if ap.name == isbnAccess.name {
+			r.isbn = term
+		}
+		if ap.name == oclcAccess.name {
+			r.oclc = term
+		}
+		if ap.name == lccnAccess.name {
+			r.lccn = term
+		}
+		if ap.name == ismnAccess.name {
+			r.ismn = term
+		}
+	}
+	r.diag = result.diagCode(r.diag)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// netTimeout is a net.Error which timed out, like a dial's.
+type netTimeout struct{}
+
+func (netTimeout) Error() string   { return "i/o timeout" }
+func (netTimeout) Timeout() bool   { return true }
+func (netTimeout) Temporary() bool { return true }
+
+func TestFailDiag(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		diag string
+	}{
+		{"query timeout", fmt.Errorf("yaz-client search stopped: %w", context.DeadlineExceeded), "timeout"},
+		{"connection timeout", fmt.Errorf("dialing: %w", netTimeout{}), "timeout"},
+		{"diagnostic", diagnosticError{code: "114"}, "diag:114"},
+		{"other error", errors.New("exit status 1"), "error"},
+	}
+	for _, tt := range tests {
+		var result targetResult
+		result.fail(isbnAccess, "0306406152", tt.err)
+		if result.diag != tt.diag || !result.failed {
+			t.Errorf("%v: fail gave diag %q, failed %v, want %q, true", tt.name, result.diag, result.failed, tt.diag)
+		}
+	}
+}
+
+func TestYazTemplate(t *testing.T) {
+	target := target{Name: "T", Host: "z.example:210", Database: "100%", User: "reader", Password: "p%d", Charset: "utf-8"}
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name: "built-in",
+			want: "auth open reader/p%d\ncharset utf-8\nopen z.example:210/100%\nfind @attr 1=7 \"0306406152\"\nclose\nquit\n",
+		},
+		{
+			name:     "custom",
+			template: "{auth}\n{charset}\nopen {address}\nfind {attributes} \"%v\"\nquit\n",
+			want:     "auth open reader/p%d\ncharset utf-8\nopen z.example:210/100%\nfind @attr 1=7 \"0306406152\"\nquit\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := customTemplate
+			t.Cleanup(func() { customTemplate = previous })
+			customTemplate = tt.template
+			// Searched with the template as a format string, see z3950Search.
+			if got := fmt.Sprintf(target.yazTemplate(isbnAccess), "0306406152"); got != tt.want {
+				t.Errorf("script = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	t.Setenv("WCG_TEST_USER", "reader")
+	t.Setenv("WCG_TEST_TOKEN", "s3cret")
+	config := `{"targets": [
+		{"name": "Z", "host": "z.example:210", "user": "${WCG_TEST_USER}", "group": "$group", "password": "pa$$word"},
+		{"name": "S", "protocol": "sru", "host": "https://s.example/sru", "headers": {"Authorization": "Bearer ${WCG_TEST_TOKEN}", "X-Cost": "$5"}}
+	]}`
+	path := t.TempDir() + "/targets.json"
+	if err := os.WriteFile(path, []byte(config), 0666); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig error = %v", err)
+	}
+	// Only ${VAR} references are expanded, a bare $ is kept as written.
+	z := c.Targets[0]
+	if z.User != "reader" || z.Group != "$group" || z.Password != "pa$$word" {
+		t.Errorf("credentials = %q, %q, %q, want \"reader\", \"$group\", \"pa$$word\"", z.User, z.Group, z.Password)
+	}
+	s := c.Targets[1]
+	if s.Headers["Authorization"] != "Bearer s3cret" || s.Headers["X-Cost"] != "$5" {
+		t.Errorf("headers = %q, want the token filled in and the $5 kept", s.Headers)
+	}
+}
+
+func TestSearchURL(t *testing.T) {
+	target := target{
+		Name:                "T",
+		FoundURLTemplate:    "https://t.example/?type={searchType}&q={isbn}",
+		OCLCURLTemplate:     "https://t.example/?type={searchType}&q={oclc}",
+		LCCNURLTemplate:     "https://t.example/?type={searchType}&q={lccn}",
+		ISMNURLTemplate:     "https://t.example/?type={searchType}&q={ismn}",
+		NotFoundURLTemplate: "https://t.example/?type={searchType}&q={title}",
+		SearchTypes:         map[string]string{"isbn": "i", "oclc": "o", "lccn": "l", "ismn": "m", "title": "t"},
+	}
+	tests := []struct {
+		name   string
+		result targetResult
+		want   string
+	}{
+		{"isbn", targetResult{found: true, isbn: "0306406152"}, "https://t.example/?type=i&q=0306406152"},
+		{"oclc", targetResult{found: true, oclc: "12345678"}, "https://t.example/?type=o&q=12345678"},
+		{"lccn", targetResult{found: true, lccn: "2001012345"}, "https://t.example/?type=l&q=2001012345"},
+		{"ismn", targetResult{found: true, ismn: "9790260000438"}, "https://t.example/?type=m&q=9790260000438"},
+		{"not found", targetResult{}, "https://t.example/?type=t&q=hobbit"},
+	}
+	for _, tt := range tests {
+		if got := target.searchURL(tt.result, "The hobbit"); got != tt.want {
+			t.Errorf("%v: searchURL = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// titleSimilarity returns how alike two titles are, from 0 to 1, as one
+// less the Levenshtein distance between their titles proper, lowercased
+// and without punctuation, over the longer's length. A record held under
+// the ISBN with a completely different title, from an ISBN reused or
+// mistyped, scores near 0.
+func titleSimilarity(a, b string) float64 {
+	x, y := []rune(comparableTitle(a)), []rune(comparableTitle(b))
+	longest := len(x)
+	if len(y) > longest {
+		longest = len(y)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(x, y))/float64(longest)
+}
+
+// comparableTitle returns the title proper, see canonicalTitle, in lower
+// case with its punctuation dropped and spaces collapsed.
+func comparableTitle(title string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			return unicode.ToLower(r)
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return -1
+	}, canonicalTitle(title))
+	return strings.Join(strings.Fields(cleaned), " ")
+}
+
+// levenshtein returns the number of single rune insertions, deletions
+// and substitutions which turn a into b.
+func levenshtein(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
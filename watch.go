@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// processedDir is the subdirectory of the -watch directory which
+// inputs are moved into once processed, with -move-processed.
+const processedDir = "processed"
+
+// watch polls the directory every -watch-interval, processing each file
+// matching the -glob pattern once it has stopped changing, until the
+// context is done. The directory is polled rather than notified of
+// changes so no dependencies are needed, and a file is only processed
+// once its size and modification time are the same on two polls, so
+// files still being copied in aren't read half written. It returns the
+// files which failed.
+func watch(ctx context.Context, wg *sync.WaitGroup, dir string) []fileFailure {
+	slog.Info("watching for files", "dir", dir, "glob", *globPattern, "interval", *watchInterval)
+	failures := []fileFailure{}
+	// Files handled already, and how each looked on the last poll.
+	handled := map[string]bool{}
+	seen := map[string]os.FileInfo{}
+	for {
+		ready, err := readyFiles(dir, handled, seen)
+		if err != nil {
+			slog.Error("unable to read the watched directory", "dir", dir, "err", err)
+		}
+		if len(ready) > 0 {
+			failed := processFiles(ctx, wg, ready)
+			failures = append(failures, failed...)
+			for _, filename := range ready {
+				handled[filename] = true
+				if ctx.Err() == nil && *moveProcessed && !failedFile(failed, filename) {
+					if err := moveToProcessed(dir, filename); err != nil {
+						slog.Error("unable to move processed file", "file", filename, "err", err)
+					}
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return failures
+		case <-time.After(*watchInterval):
+		}
+	}
+}
+
+// readyFiles returns the unhandled files in the directory which haven't
+// changed since the last poll, updating seen with how each looks now.
+func readyFiles(dir string, handled map[string]bool, seen map[string]os.FileInfo) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ready := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || (*suffix != "" && strings.Contains(name, *suffix)) {
+			continue
+		}
+		if matched, _ := filepath.Match(*globPattern, name); !matched {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if handled[path] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		last, ok := seen[path]
+		seen[path] = info
+		if ok && last.Size() == info.Size() && last.ModTime().Equal(info.ModTime()) {
+			delete(seen, path)
+			ready = append(ready, path)
+		}
+	}
+	return ready, nil
+}
+
+// failedFile reports whether the file is among the failures.
+func failedFile(failures []fileFailure, filename string) bool {
+	for _, f := range failures {
+		if f.filename == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// moveToProcessed moves a processed input into the processed subdirectory.
+func moveToProcessed(dir, filename string) error {
+	target := filepath.Join(dir, processedDir)
+	if err := os.MkdirAll(target, 0777); err != nil {
+		return fmt.Errorf("%v - unable to create %v", err, target)
+	}
+	moved := filepath.Join(target, filepath.Base(filename))
+	if err := os.Rename(filename, moved); err != nil {
+		return fmt.Errorf("%v - unable to move %v to %v", err, filename, moved)
+	}
+	slog.Debug("moved processed file", "file", filename, "to", moved)
+	return nil
+}
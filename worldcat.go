@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// worldcatTokenURL issues the access tokens of the WorldCat Search API,
+// for a target's apiKey and apiSecret.
+const worldcatTokenURL = "https://oauth.oclc.org/token"
+
+// worldcatIndexes are the WorldCat Search API's indexes for each access
+// point, used instead of their CQL indexes for worldcat targets.
+var worldcatIndexes = map[string]string{
+	isbnAccess.name:   "bn",
+	titleAccess.name:  "ti",
+	oclcAccess.name:   "no",
+	lccnAccess.name:   "dn",
+	ismnAccess.name:   "sn",
+	authorAccess.name: "au",
+}
+
+// worldcatTokens are the access tokens fetched for each target, reused
+// until shortly before they expire.
+var worldcatTokens = struct {
+	sync.Mutex
+	byTarget map[string]worldcatToken
+}{byTarget: map[string]worldcatToken{}}
+
+type worldcatToken struct {
+	value   string
+	expires time.Time
+}
+
+// worldcatQuery returns the WorldCat query for the term, like bn:term,
+// ANDing the searches of an access point which makes two.
+func worldcatQuery(ap accessPoint, term string) string {
+	clauses := ap.clauses(term)
+	query := worldcatIndexes[ap.name] + ":" + worldcatTerm(clauses[0])
+	if ap.and != nil {
+		query += " AND " + worldcatIndexes[ap.and.name] + ":" + worldcatTerm(clauses[1])
+	}
+	return query
+}
+
+// worldcatOr returns a WorldCat query matching any of the terms.
+func worldcatOr(ap accessPoint, terms []string) string {
+	clauses := []string{}
+	for _, term := range terms {
+		clauses = append(clauses, worldcatIndexes[ap.name]+":"+worldcatTerm(term))
+	}
+	return strings.Join(clauses, " OR ")
+}
+
+// worldcatTerm quotes a search term for a WorldCat query.
+func worldcatTerm(term string) string {
+	return `"` + strings.ReplaceAll(term, `"`, ``) + `"`
+}
+
+// worldcatSearch is the WorldCat equivalent of z3950Search, searching the
+// target's brief bibliographic records for each term in turn.
+func worldcatSearch(ctx context.Context, terms []string, t target, ap accessPoint) (searchResult, error) {
+	found := searchResult{threshold: t.minHits()}
+	for _, term := range terms {
+		result, err := worldcatRequest(ctx, t, worldcatQuery(ap, term))
+		if err != nil {
+			return found, err
+		}
+		result.threshold = found.threshold
+		if result.found() {
+			found.hits = result.hits
+			found.matched = term
+			break
+		}
+	}
+	return found, nil
+}
+
+// worldcatSearchOr is the WorldCat equivalent of z3950SearchOr.
+func worldcatSearchOr(ctx context.Context, terms []string, t target, ap accessPoint) (searchResult, error) {
+	return worldcatRequest(ctx, t, worldcatOr(ap, terms))
+}
+
+// worldcatRequest runs one search of the target's brief-bibs endpoint,
+// asking for a single record, since only the count is used.
+func worldcatRequest(ctx context.Context, t target, query string) (searchResult, error) {
+	found := searchResult{}
+
+	u, err := url.Parse(strings.TrimSuffix(t.Host, "/") + "/brief-bibs")
+	if err != nil {
+		return found, fmt.Errorf("%v - unable to parse WorldCat URL %v", err, t.Host)
+	}
+	values := u.Query()
+	values.Set("q", query)
+	values.Set("limit", "1")
+	u.RawQuery = values.Encode()
+
+	token, err := worldcatAccessToken(ctx, t)
+	if err != nil {
+		return found, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return found, err
+	}
+	for name, value := range t.Headers {
+		request.Header.Set(name, value)
+	}
+	request.Header.Set("User-Agent", t.userAgent())
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := sruClient.Do(request)
+	if err != nil {
+		return found, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusUnauthorized {
+		// The token was revoked or expired early, fetch another next time.
+		worldcatTokens.Lock()
+		delete(worldcatTokens.byTarget, t.Name)
+		worldcatTokens.Unlock()
+	}
+	if response.StatusCode != http.StatusOK {
+		return found, fmt.Errorf("WorldCat server %v returned %v%v", u.Host, response.Status, worldcatProblem(response.Body))
+	}
+
+	var body struct {
+		NumberOfRecords *int `json:"numberOfRecords"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return found, fmt.Errorf("%v - unable to parse WorldCat response", err)
+	}
+	if body.NumberOfRecords == nil {
+		return found, errNoResults
+	}
+	found.hits = *body.NumberOfRecords
+	return found, nil
+}
+
+// worldcatProblem returns the detail of an error response, like
+// ": Invalid query", or nothing if it has none.
+func worldcatProblem(r io.Reader) string {
+	var problem struct {
+		Title  string `json:"title"`
+		Detail string `json:"detail"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r, 64<<10)).Decode(&problem); err != nil {
+		return ""
+	}
+	if problem.Detail != "" {
+		return ": " + problem.Detail
+	}
+	if problem.Title != "" {
+		return ": " + problem.Title
+	}
+	return ""
+}
+
+// worldcatAccessToken returns an access token for the target, fetching
+// one with its apiKey and apiSecret by the client credentials grant when
+// there's none which lasts another minute.
+func worldcatAccessToken(ctx context.Context, t target) (string, error) {
+	worldcatTokens.Lock()
+	defer worldcatTokens.Unlock()
+	if token, ok := worldcatTokens.byTarget[t.Name]; ok && time.Until(token.expires) > time.Minute {
+		return token.value, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}, "scope": {"wcapi"}}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, worldcatTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("User-Agent", t.userAgent())
+	request.SetBasicAuth(t.APIKey, t.APISecret)
+	response, err := sruClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("%v - unable to fetch a WorldCat access token", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("WorldCat token server returned %v, check the apiKey and apiSecret of %v", response.Status, t.Name)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("%v - unable to parse WorldCat access token", err)
+	}
+	if body.AccessToken == "" {
+		return "", fmt.Errorf("WorldCat token server returned no access token for %v", t.Name)
+	}
+	worldcatTokens.byTarget[t.Name] = worldcatToken{
+		value:   body.AccessToken,
+		expires: time.Now().Add(time.Duration(body.ExpiresIn) * time.Second),
+	}
+	return body.AccessToken, nil
+}
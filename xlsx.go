@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// xlsxWriter writes the augmented rows as a single sheet Excel workbook,
+// with the catalogue search links as clickable hyperlinks. The sheet is
+// streamed into the zip a row at a time, the links are kept until close.
+type xlsxWriter struct {
+	z     *zip.Writer
+	sheet io.Writer
+	rows  int
+	// The cell reference and URL of each hyperlink.
+	links  [][2]string
+	opened bool
+	closed bool
+}
+
+func newXLSXWriter(w io.Writer) *xlsxWriter {
+	return &xlsxWriter{z: zip.NewWriter(w)}
+}
+
+// The workbook's fixed parts, written when it's closed.
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/><Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Augmented" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/></Relationships>`},
+	// Style 1 is the blue underlined hyperlink font.
+	{"xl/styles.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><u/><sz val="11"/><color rgb="FF0563C1"/><name val="Calibri"/></font></fonts><fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills><borders count="1"><border/></borders><cellStyleXfs count="1"><xf/></cellStyleXfs><cellXfs count="2"><xf/><xf fontId="1" applyFont="1"/></cellXfs></styleSheet>`},
+}
+
+// columnName returns the spreadsheet name of the zero based column, A to Z then AA.
+func columnName(column int) string {
+	name := ""
+	for column++; column > 0; column = (column - 1) / 26 {
+		name = string(rune('A'+(column-1)%26)) + name
+	}
+	return name
+}
+
+func (x *xlsxWriter) open() error {
+	if x.opened {
+		return nil
+	}
+	x.opened = true
+	sheet, err := x.z.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	x.sheet = sheet
+	_, err = io.WriteString(sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheetData>`)
+	return err
+}
+
+// writeCells writes a row of inline string cells, as hyperlinks for the
+// columns in links which have a value.
+func (x *xlsxWriter) writeCells(values []string, links map[int]bool) error {
+	if err := x.open(); err != nil {
+		return err
+	}
+	x.rows++
+	var b strings.Builder
+	fmt.Fprintf(&b, `<row r="%v">`, x.rows)
+	for i, value := range values {
+		if value == "" {
+			continue
+		}
+		ref := columnName(i) + strconv.Itoa(x.rows)
+		style := ""
+		if links[i] {
+			style = ` s="1"`
+			x.links = append(x.links, [2]string{ref, value})
+		}
+		fmt.Fprintf(&b, `<c r="%v"%v t="inlineStr"><is><t xml:space="preserve">`, ref, style)
+		xml.EscapeText(&b, []byte(value))
+		b.WriteString(`</t></is></c>`)
+	}
+	b.WriteString(`</row>`)
+	_, err := io.WriteString(x.sheet, b.String())
+	return err
+}
+
+func (x *xlsxWriter) writeHeader(header []string) error {
+	return x.writeCells(outputHeader(header), nil)
+}
+
+func (x *xlsxWriter) writeRow(row augmentedRow) error {
+	links := map[int]bool{}
+	for i := range row.results {
+		links[len(row.record)+2*i+1] = true
+		if *bothURLs {
+			links[len(row.record)+2*len(row.results)+i] = true
+		}
+	}
+	if row.columns != nil {
+		selected := map[int]bool{}
+		for i, column := range row.columns {
+			selected[i] = links[column]
+		}
+		links = selected
+	}
+	return x.writeCells(selectColumns(augmentedRecord(row), row.columns), links)
+}
+
+// close finishes the sheet with its hyperlinks, and writes the rest of
+// the workbook. Like the JSON writer's close, it's safe to call twice.
+func (x *xlsxWriter) close() error {
+	if x.closed {
+		return nil
+	}
+	x.closed = true
+	if err := x.open(); err != nil {
+		return err
+	}
+
+	var sheet, rels strings.Builder
+	sheet.WriteString(`</sheetData>`)
+	rels.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	if len(x.links) > 0 {
+		sheet.WriteString(`<hyperlinks>`)
+		for i, link := range x.links {
+			fmt.Fprintf(&sheet, `<hyperlink ref="%v" r:id="rId%v"/>`, link[0], i+1)
+			fmt.Fprintf(&rels, `<Relationship Id="rId%v" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/hyperlink" Target="`, i+1)
+			xml.EscapeText(&rels, []byte(link[1]))
+			rels.WriteString(`" TargetMode="External"/>`)
+		}
+		sheet.WriteString(`</hyperlinks>`)
+	}
+	sheet.WriteString(`</worksheet>`)
+	rels.WriteString(`</Relationships>`)
+	if _, err := io.WriteString(x.sheet, sheet.String()); err != nil {
+		return err
+	}
+
+	parts := append(xlsxParts, struct{ name, content string }{"xl/worksheets/_rels/sheet1.xml.rels", rels.String()})
+	for _, part := range parts {
+		w, err := x.z.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, part.content); err != nil {
+			return err
+		}
+	}
+	return x.z.Close()
+}
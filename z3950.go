@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// A minimal Z39.50 client, implementing just enough of the protocol to
+// initialize a session and run Type-1 searches, so that yaz-client isn't
+// needed when -backend native is selected.
+
+const (
+	berUniversal   byte = 0x00
+	berContext     byte = 0x80
+	berConstructed byte = 0x20
+
+	// The default Z39.50 port, used when a target's host has none.
+	z3950Port = "210"
+)
+
+// The bib-1 attribute set, 1.2.840.10003.3.1, as BER encoded OID content.
+var bib1OID = []byte{0x2a, 0x86, 0x48, 0xce, 0x13, 0x03, 0x01}
+
+// berNode is a decoded BER element.
+type berNode struct {
+	class       byte
+	constructed bool
+	tag         int
+	value       []byte
+	children    []berNode
+}
+
+// child returns the first child with the given context tag.
+func (n berNode) child(tag int) (berNode, bool) {
+	for _, c := range n.children {
+		if c.class == berContext && c.tag == tag {
+			return c, true
+		}
+	}
+	return berNode{}, false
+}
+
+// integer decodes the element's value as a two's complement integer.
+func (n berNode) integer() int {
+	value := 0
+	for i, b := range n.value {
+		if i == 0 && b&0x80 != 0 {
+			value = -1
+		}
+		value = value<<8 | int(b)
+	}
+	return value
+}
+
+// berTLV encodes a BER element with the given class, form, tag and content.
+func berTLV(class byte, constructed bool, tag int, content ...[]byte) []byte {
+	value := bytes.Join(content, nil)
+	first := class
+	if constructed {
+		first |= berConstructed
+	}
+
+	out := []byte{}
+	if tag < 31 {
+		out = append(out, first|byte(tag))
+	} else {
+		// High tag numbers are base-128, most significant group first.
+		groups := []byte{}
+		for t := tag; ; t >>= 7 {
+			groups = append([]byte{byte(t & 0x7f)}, groups...)
+			if t < 0x80 {
+				break
+			}
+		}
+		for i := 0; i < len(groups)-1; i++ {
+			groups[i] |= 0x80
+		}
+		out = append(out, first|0x1f)
+		out = append(out, groups...)
+	}
+
+	if len(value) < 0x80 {
+		out = append(out, byte(len(value)))
+	} else {
+		length := []byte{}
+		for l := len(value); l > 0; l >>= 8 {
+			length = append([]byte{byte(l)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	return append(out, value...)
+}
+
+// berInt encodes a non-negative integer's minimal content octets.
+func berInt(n int) []byte {
+	out := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		out = append([]byte{byte(n)}, out...)
+	}
+	if out[0]&0x80 != 0 {
+		out = append([]byte{0}, out...)
+	}
+	return out
+}
+
+// readBER reads and decodes one complete BER element.
+func readBER(r *bufio.Reader) (berNode, error) {
+	node := berNode{}
+
+	first, err := r.ReadByte()
+	if err != nil {
+		return node, err
+	}
+	node.class = first & 0xc0
+	node.constructed = first&berConstructed != 0
+	node.tag = int(first & 0x1f)
+	if node.tag == 0x1f {
+		node.tag = 0
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return node, err
+			}
+			node.tag = node.tag<<7 | int(b&0x7f)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+	}
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return node, err
+	}
+	length := int(b)
+	if b&0x80 != 0 {
+		count := int(b & 0x7f)
+		if count == 0 || count > 4 {
+			return node, errors.New("unsupported BER length encoding")
+		}
+		length = 0
+		for i := 0; i < count; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return node, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+
+	node.value = make([]byte, length)
+	if _, err := io.ReadFull(r, node.value); err != nil {
+		return node, err
+	}
+
+	if node.constructed {
+		inner := bufio.NewReader(bytes.NewReader(node.value))
+		for {
+			child, err := readBER(inner)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return node, err
+			}
+			node.children = append(node.children, child)
+		}
+	}
+	return node, nil
+}
+
+// z3950Session is an initialized connection to a Z39.50 target.
+type z3950Session struct {
+	ctx    context.Context
+	conn   net.Conn
+	reader *bufio.Reader
+	// Closed when the session is, to stop watching the context.
+	done chan struct{}
+}
+
+// dialZ3950 connects to the target and initializes a session.
+// The connection is closed if the context is done.
+func dialZ3950(ctx context.Context, t target) (*z3950Session, error) {
+	address := t.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, z3950Port)
+	}
+
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	s := &z3950Session{ctx: ctx, conn: conn, reader: bufio.NewReader(conn), done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-s.done:
+		}
+	}()
+
+	fields := [][]byte{
+		// Protocol versions 1, 2 and 3.
+		berTLV(berContext, false, 3, []byte{0x05, 0xe0}),
+		// The search and present services.
+		berTLV(berContext, false, 4, []byte{0x06, 0xc0}),
+		berTLV(berContext, false, 5, berInt(1048576)),
+		berTLV(berContext, false, 6, berInt(1048576)),
+	}
+	if auth := idAuthentication(t); auth != nil {
+		fields = append(fields, auth)
+	}
+	fields = append(fields,
+		berTLV(berContext, false, 110, []byte("well-connected-gardener")),
+		berTLV(berContext, false, 111, []byte("Well Connected Gardener")),
+		berTLV(berContext, false, 112, []byte(version)),
+	)
+	initRequest := berTLV(berContext, true, 20, fields...)
+	response, err := s.roundTrip(initRequest, 21)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	result, ok := response.child(12)
+	if !ok || len(result.value) == 0 || result.value[0] == 0 {
+		s.close()
+		return nil, fmt.Errorf("%v rejected the Z39.50 init request", t.Name)
+	}
+	return s, nil
+}
+
+// idAuthentication encodes the target's credentials for the init request,
+// as idPass when there's a group and open otherwise. It returns nil when
+// the target has no credentials.
+func idAuthentication(t target) []byte {
+	switch {
+	case t.User == "" && t.Password == "":
+		return nil
+	case t.Group != "":
+		return berTLV(berContext, true, 7, berTLV(berUniversal, true, 16,
+			berTLV(berContext, false, 0, []byte(t.Group)),
+			berTLV(berContext, false, 1, []byte(t.User)),
+			berTLV(berContext, false, 2, []byte(t.Password)),
+		))
+	}
+	return berTLV(berContext, true, 7, berTLV(berUniversal, false, 26, []byte(t.User+"/"+t.Password)))
+}
+
+// roundTrip sends a request PDU and reads the response,
+// which must have the expected tag.
+func (s *z3950Session) roundTrip(request []byte, expected int) (berNode, error) {
+	s.conn.SetDeadline(time.Now().Add(60 * time.Second))
+	if _, err := s.conn.Write(request); err != nil {
+		return berNode{}, s.contextErr(err)
+	}
+	response, err := readBER(s.reader)
+	if err != nil {
+		return response, s.contextErr(err)
+	}
+	if response.class == berContext && response.tag == 48 {
+		return response, errors.New("target closed the Z39.50 session")
+	}
+	if response.class != berContext || response.tag != expected {
+		return response, fmt.Errorf("unexpected Z39.50 response with tag %v", response.tag)
+	}
+	return response, nil
+}
+
+// The Type-1 query operators combining two operands.
+const (
+	rpnAnd = 0
+	rpnOr  = 1
+)
+
+// rpnOperand returns an attributes plus term operand of a Type-1 query.
+func rpnOperand(attributes [][2]int, term string) []byte {
+	attributeList := [][]byte{}
+	for _, attribute := range attributes {
+		attributeList = append(attributeList, berTLV(berUniversal, true, 16,
+			berTLV(berContext, false, 120, berInt(attribute[0])),
+			berTLV(berContext, false, 121, berInt(attribute[1])),
+		))
+	}
+	return berTLV(berContext, true, 0, berTLV(berContext, true, 102,
+		berTLV(berContext, true, 44, attributeList...),
+		berTLV(berContext, false, 45, []byte(term)),
+	))
+}
+
+// rpnOperator returns an rpnRpnOp combining the two with the operator.
+func rpnOperator(left, right []byte, operator int) []byte {
+	return berTLV(berContext, true, 1,
+		left,
+		right,
+		berTLV(berContext, true, 46, berTLV(berContext, false, operator)),
+	)
+}
+
+// search runs a Type-1 query for the terms against the databases,
+// using the given bib-1 attribute type and value pairs. More than
+// one term are ORed together.
+func (s *z3950Session) search(databases []string, attributes [][2]int, terms ...string) (searchResult, error) {
+	var structure []byte
+	for i, term := range terms {
+		operand := rpnOperand(attributes, term)
+		if i == 0 {
+			structure = operand
+			continue
+		}
+		// The terms so far, or this one.
+		structure = rpnOperator(structure, operand, rpnOr)
+	}
+	return s.searchRPN(databases, structure)
+}
+
+// searchAccess runs a Type-1 query for the term by the access point,
+// ANDing the searches of one which makes two, like titleAuthorAccess.
+func (s *z3950Session) searchAccess(databases []string, ap accessPoint, term string) (searchResult, error) {
+	if ap.and == nil {
+		return s.search(databases, ap.attributes, term)
+	}
+	clauses := ap.clauses(term)
+	structure := rpnOperator(rpnOperand(ap.attributes, clauses[0]), rpnOperand(ap.and.attributes, clauses[1]), rpnAnd)
+	return s.searchRPN(databases, structure)
+}
+
+// searchRPN runs the Type-1 query structure against the databases.
+func (s *z3950Session) searchRPN(databases []string, structure []byte) (searchResult, error) {
+	found := searchResult{}
+
+	rpnQuery := berTLV(berContext, true, 1,
+		berTLV(berUniversal, false, 6, bib1OID),
+		structure,
+	)
+
+	databaseNames := [][]byte{}
+	for _, database := range databases {
+		databaseNames = append(databaseNames, berTLV(berContext, false, 105, []byte(database)))
+	}
+
+	searchRequest := berTLV(berContext, true, 22,
+		berTLV(berContext, false, 13, berInt(0)),
+		berTLV(berContext, false, 14, berInt(1)),
+		berTLV(berContext, false, 15, berInt(0)),
+		berTLV(berContext, false, 16, []byte{0xff}),
+		berTLV(berContext, false, 17, []byte("default")),
+		berTLV(berContext, true, 18, databaseNames...),
+		berTLV(berContext, true, 21, rpnQuery),
+	)
+	response, err := s.roundTrip(searchRequest, 23)
+	if err != nil {
+		return found, err
+	}
+
+	if count, ok := response.child(23); ok {
+		found.hits = count.integer()
+	}
+	if diagnostic, ok := response.child(130); ok {
+		found.diagnostic = diagnosticCondition(diagnostic)
+	}
+	if diagnostics, ok := response.child(205); ok && len(diagnostics.children) > 0 {
+		found.diagnostic = diagnosticCondition(diagnostics.children[0])
+	}
+	return found, nil
+}
+
+// diagnosticCondition returns the condition code of a DefaultDiagFormat.
+func diagnosticCondition(n berNode) string {
+	for _, c := range n.children {
+		if c.class == berUniversal && c.tag == 2 {
+			return strconv.Itoa(c.integer())
+		}
+	}
+	return ""
+}
+
+// contextErr reports the context's error in place of the
+// network error caused by closing the connection when it was done.
+func (s *z3950Session) contextErr(err error) error {
+	if s.ctx.Err() != nil {
+		return fmt.Errorf("Z39.50 search stopped: %w", s.ctx.Err())
+	}
+	return err
+}
+
+func (s *z3950Session) close() error {
+	close(s.done)
+	return s.conn.Close()
+}
+
+// z3950SearchNative is the native equivalent of z3950Search,
+// searching for each term in turn within a single session.
+func z3950SearchNative(ctx context.Context, terms []string, t target, ap accessPoint) (searchResult, error) {
+	found := searchResult{threshold: t.minHits()}
+
+	session, err := dialZ3950(ctx, t)
+	if err != nil {
+		return found, err
+	}
+	defer session.close()
+
+	databases := t.databases()
+	if len(databases) == 0 {
+		databases = []string{"Default"}
+	}
+
+	for _, term := range terms {
+		result, err := session.searchAccess(databases, ap, term)
+		if err != nil {
+			return found, err
+		}
+		result.threshold = found.threshold
+		if found.diagnostic == "" {
+			found.diagnostic = result.diagnostic
+		}
+		if result.found() {
+			found.hits = result.hits
+			found.matched = term
+			break
+		}
+	}
+	return found, nil
+}
+
+// z3950SearchNativeOr is the native equivalent of z3950SearchOr.
+func z3950SearchNativeOr(ctx context.Context, terms []string, t target, attributes [][2]int) (searchResult, error) {
+	session, err := dialZ3950(ctx, t)
+	if err != nil {
+		return searchResult{}, err
+	}
+	defer session.close()
+
+	databases := t.databases()
+	if len(databases) == 0 {
+		databases = []string{"Default"}
+	}
+	return session.search(databases, attributes, terms...)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// zipArchive is a .zip of input files given as an argument. Its entries
+// matching -glob are extracted to a temporary directory and processed like
+// any other files, then their augmented files, and the errors, missing
+// and diff files beside them, are packed into an augmented zip beside it.
+type zipArchive struct {
+	path string
+	dir  string
+	// The extracted entries, which aren't packed.
+	entries map[string]bool
+}
+
+// archives are the zip arguments, cleaned up by finishArchives.
+var archives []*zipArchive
+
+// isZip reports whether a file is a zip archive, judging by its name.
+func isZip(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".zip")
+}
+
+// augmentedZipPath returns the name of the augmented zip of an archive,
+// following -suffix, so weeding.zip has weeding_augmented.zip.
+func augmentedZipPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + *suffix + ".zip"
+}
+
+// extractZip extracts the archive's entries matching -glob, returning
+// their paths in the order they're in it.
+func extractZip(path string) ([]string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("%v - unable to open zip archive %v", err, path)
+	}
+	defer r.Close()
+
+	dir, err := os.MkdirTemp(*tmpDir, "well-connected-gardener-zip-")
+	if err != nil {
+		return nil, fmt.Errorf("%v - unable to create a directory to extract %v to", err, path)
+	}
+	archive := &zipArchive{path: path, dir: dir, entries: map[string]bool{}}
+	archives = append(archives, archive)
+
+	filenames := []string{}
+	for _, entry := range r.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		if matched, _ := filepath.Match(*globPattern, filepath.Base(entry.Name)); !matched {
+			continue
+		}
+		// Entries like ../../etc/passwd mustn't be written outside the
+		// directory.
+		if !filepath.IsLocal(entry.Name) {
+			return nil, fmt.Errorf("zip archive %v has an entry %q outside of it", path, entry.Name)
+		}
+		extracted := filepath.Join(dir, filepath.FromSlash(entry.Name))
+		if err := extractEntry(entry, extracted); err != nil {
+			return nil, fmt.Errorf("%v - unable to extract %v from %v", err, entry.Name, path)
+		}
+		archive.entries[extracted] = true
+		filenames = append(filenames, extracted)
+	}
+	if len(filenames) == 0 {
+		slog.Warn("zip archive has no files matching -glob", "file", path, "glob", *globPattern)
+	}
+	slog.Debug("extracted zip archive", "file", path, "dir", dir, "files", len(filenames))
+	return filenames, nil
+}
+
+func extractEntry(entry *zip.File, extracted string) error {
+	if err := os.MkdirAll(filepath.Dir(extracted), 0777); err != nil {
+		return err
+	}
+	in, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(extracted)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// finishArchives packs each archive's outputs into its augmented zip,
+// unless they were written elsewhere, to an -out directory or -merge
+// file, and removes the extracted files. It returns the augmented zips
+// which couldn't be written.
+func finishArchives() []string {
+	failed := []string{}
+	for _, archive := range archives {
+		if writesOutput() && !outIsDir && *mergePath == "" {
+			if err := archive.pack(); err != nil {
+				slog.Error("unable to write the augmented zip", "file", archive.path, "err", err)
+				failed = append(failed, augmentedZipPath(archive.path))
+			}
+		}
+		if err := os.RemoveAll(archive.dir); err != nil {
+			slog.Warn("unable to remove the extracted files", "dir", archive.dir, "err", err)
+		}
+	}
+	return failed
+}
+
+// pack writes the files in the archive's directory which weren't
+// extracted from it, apart from unfinished .partial files, to its
+// augmented zip, with the paths of the entries they're beside.
+func (a *zipArchive) pack() error {
+	outputs := []string{}
+	err := filepath.Walk(a.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !a.entries[path] && !strings.HasSuffix(path, ".partial") {
+			outputs = append(outputs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%v - unable to read directory %v", err, a.dir)
+	}
+	if len(outputs) == 0 {
+		slog.Warn("no files of the zip archive were augmented, not writing an augmented zip", "file", a.path)
+		return nil
+	}
+	sort.Strings(outputs)
+
+	path := augmentedZipPath(a.path)
+	partial := path + ".partial"
+	file, err := os.Create(partial)
+	if err != nil {
+		return fmt.Errorf("%v - unable to open file %v for writing", err, partial)
+	}
+	w := zip.NewWriter(file)
+	for _, output := range outputs {
+		if err := addToZip(w, a.dir, output); err != nil {
+			file.Close()
+			os.Remove(partial)
+			return fmt.Errorf("%v - unable to add %v to %v", err, output, partial)
+		}
+	}
+	if err := w.Close(); err != nil {
+		file.Close()
+		os.Remove(partial)
+		return fmt.Errorf("%v - unable to write %v", err, partial)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("%v - unable to close %v", err, partial)
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return fmt.Errorf("%v - unable to rename %v to %v", err, partial, path)
+	}
+	slog.Info("wrote augmented zip", "file", path, "files", len(outputs))
+	return nil
+}
+
+// addToZip adds the file to the zip, named by its path within dir.
+func addToZip(w *zip.Writer, dir, path string) error {
+	name, err := filepath.Rel(dir, path)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := w.Create(filepath.ToSlash(name))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	return err
+}